@@ -0,0 +1,200 @@
+package crow
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// a backoff for spin loops. we start by spinning, pausing the cpu each time,
+// then yield to other goroutines, and after that, it depends on what we're
+// waiting for:
+//
+// - spin() keeps yielding, for things that won't take long, like a cell
+//   that's been allocated but not yet written
+// - wait() sleeps, doubling the sleep each time up to a millisecond
+// - park() blocks until the next pop, for waiting on other cells
+//
+// when a LockLanePriority is in progress, everyone else parks straight
+// away, rather than spinning, so the priority waiter gets the cpu
+//
+// with rb.AdaptiveSpin, park() yields for longer when recent waits have
+// been short, and parks sooner when they've been long, see parkAfter()
+
+type rb_backoff struct {
+	n        int
+	priority bool            // we're the priority waiter
+	done     <-chan struct{} // park() stops blocking when this closes
+	yields   int             // park() blocks after this, 0 for backoffYields
+}
+
+const (
+	backoffSpins  = 16
+	backoffYields = 64
+	backoffMax    = time.Millisecond
+
+	// with AdaptiveSpin, a wait this long keeps backoffYields, and we
+	// scale it inversely from there, between backoffSpins and maxYields
+	adaptTarget = 10 * time.Microsecond
+	maxYields   = 4 * backoffYields
+)
+
+func (b *rb_backoff) spin() {
+	b.n++
+	if b.n < backoffSpins {
+		cpuPause()
+	} else {
+		runtime.Gosched()
+	}
+}
+
+func (b *rb_backoff) wait() {
+	b.n++
+	if b.n < backoffSpins {
+		cpuPause()
+		return
+	} else if b.n < backoffYields {
+		runtime.Gosched()
+		return
+	}
+
+	d := time.Microsecond << min(b.n-backoffYields, 10)
+	time.Sleep(min(d, backoffMax))
+}
+
+func (b *rb_backoff) park(rb *Roundabout, addr *atomic.Uint64, old uint64) {
+	b.n++
+	if !b.priority && rb.priority.Load() != 0 {
+		rb.park(addr, old, b.done)
+		return
+	}
+	yields := b.yields
+	if yields == 0 {
+		yields = backoffYields
+	}
+	if b.n < backoffSpins {
+		cpuPause()
+		return
+	} else if b.n < yields {
+		runtime.Gosched()
+		return
+	}
+	rb.park(addr, old, b.done)
+}
+
+// how long to yield before parking, from the average of recent waits. a
+// wait that's shorter than a park and wakeup is better spent yielding,
+// and one that's longer is better spent off the cpu
+
+func (rb *Roundabout) parkAfter() int {
+	if !rb.AdaptiveSpin {
+		return backoffYields
+	}
+	avg := rb.waitAvg.Load()
+	if avg <= 0 {
+		return backoffYields
+	}
+	n := int64(backoffYields) * int64(adaptTarget) / avg
+	return int(min(max(n, backoffSpins), maxYields))
+}
+
+// fold a wait into the moving average, with a weight of 1/8. racing
+// updates can lose a sample, which is fine for an estimate
+
+func (rb *Roundabout) sampleWait(d time.Duration) {
+	avg := rb.waitAvg.Load()
+	if avg == 0 {
+		rb.waitAvg.Store(int64(d))
+		return
+	}
+	rb.waitAvg.Store(avg + (int64(d)-avg)/8)
+}
+
+// has done closed? never, if there isn't one
+
+func (b *rb_backoff) cancelled() bool {
+	if b.done == nil {
+		return false
+	}
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// block until addr no longer holds old, or until something else wakes us.
+//
+// a parked goroutine blocks on a channel receive, so that it shows up in
+// the block profile. the channel is shared by every parked goroutine, and
+// closed by the next pop, so wakeups can be spurious, but never lost: we
+// publish the channel before checking addr, and pop changes the log before
+// checking for a channel. Abort() does the same with the abort flag. we
+// also stop blocking if done closes
+
+func (rb *Roundabout) park(addr *atomic.Uint64, old uint64, done <-chan struct{}) {
+	ch := rb.wakeChan()
+	if ch == nil {
+		return
+	}
+
+	if addr.Load() != old || rb.aborting() {
+		return
+	}
+	select {
+	case <-*ch:
+	case <-done:
+	}
+}
+
+// the channel the next wakeup closes, or nil if someone's just woken
+// everyone up, and there's no point blocking
+
+func (rb *Roundabout) wakeChan() *chan struct{} {
+	ch := rb.wake.Load()
+	if ch == nil {
+		c := make(chan struct{})
+		if rb.wake.CompareAndSwap(nil, &c) {
+			ch = &c
+		} else if ch = rb.wake.Load(); ch == nil {
+			return nil
+		}
+	}
+	return ch
+}
+
+// like park, but for the queue for a full ring, see FullWait. we block
+// until the next wakeup, or until done closes, unless ready() already
+// holds. everything that ready() looks at is followed by a wakeup when it
+// changes: pops free a cell, admit hands on the turn, and Abort and Close
+// change the flags. returns true if expired fires first
+
+func (rb *Roundabout) parkQueued(ready func() bool, done <-chan struct{}, expired <-chan time.Time) bool {
+	ch := rb.wakeChan()
+	if ch == nil {
+		return false
+	}
+
+	if ready() || rb.aborting() {
+		return false
+	}
+	select {
+	case <-*ch:
+	case <-done:
+	case <-expired:
+		return true
+	}
+	return false
+}
+
+// wake up every parked goroutine, one load when no-one is parked
+
+func (rb *Roundabout) wakeup() {
+	if rb.wake.Load() == nil {
+		return
+	}
+	if ch := rb.wake.Swap(nil); ch != nil {
+		close(*ch)
+	}
+}
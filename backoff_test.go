@@ -0,0 +1,301 @@
+package crow
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParkBlockProfile(t *testing.T) {
+	runtime.SetBlockProfileRate(1)
+	defer runtime.SetBlockProfileRate(0)
+
+	rb := &Roundabout{}
+	held := make(chan bool)
+	go rb.LockRing(func(uint16, uint16) error {
+		close(held)
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	<-held
+
+	rb.LockRing(func(uint16, uint16) error { return nil })
+
+	var buf bytes.Buffer
+	pprof.Lookup("block").WriteTo(&buf, 1)
+	if !strings.Contains(buf.String(), "crow.(*Roundabout).park") {
+		t.Error("no block profile sample for park")
+	}
+}
+
+func TestParkWakeup(t *testing.T) {
+	// lots of goroutines parking on the same cell, all woken by one pop
+	rb := &Roundabout{}
+	held := make(chan bool)
+	release := make(chan bool)
+	go rb.LockRing(func(uint16, uint16) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+
+	done := make(chan bool)
+	for range 8 {
+		go func() {
+			rb.ShareRing(func(uint16, uint16) error { return nil })
+			done <- true
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	for range 8 {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("parked goroutine never woke", rb.String())
+		}
+	}
+}
+
+func TestPriorityLatency(t *testing.T) {
+	// more background workers than cells, so there's a queue for the ring,
+	// which a priority call skips
+
+	rb := &Roundabout{}
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	for range 3 * width {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rb.LockLane(1, func(uint16, uint16) error {
+					time.Sleep(20 * time.Microsecond)
+					return nil
+				})
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	fn := func(uint16, uint16) error { return nil }
+	var normal, priority time.Duration
+	for range 10 {
+		start := time.Now()
+		rb.LockLane(1, fn)
+		normal += time.Since(start)
+
+		start = time.Now()
+		rb.LockLanePriority(1, fn)
+		priority += time.Since(start)
+	}
+	close(stop)
+	wg.Wait()
+
+	// the timings depend on the scheduler, so they're only logged, and
+	// TestPriorityPark checks the mechanism
+	t.Log("normal", normal/10, "priority", priority/10)
+	if rb.priority.Load() != 0 {
+		t.Error("priority count left behind", rb.priority.Load())
+	}
+}
+
+// while a priority call is in progress, everyone else parks on their
+// first wait, rather than spinning, and the priority waiter still spins.
+// parking makes a wake channel, and spinning doesn't touch it, and done
+// is closed so that parking doesn't block
+
+func TestPriorityPark(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+	parked := func(priority, inProgress bool) bool {
+		rb := &Roundabout{}
+		if inProgress {
+			rb.priority.Add(1)
+		}
+		var addr atomic.Uint64
+		b := rb_backoff{priority: priority, done: done}
+		b.park(rb, &addr, 0)
+		return rb.wake.Load() != nil
+	}
+
+	if parked(false, false) {
+		t.Error("parked on the first wait with no priority call")
+	}
+	if !parked(false, true) {
+		t.Error("spun during a priority call")
+	}
+	if parked(true, true) {
+		t.Error("priority waiter parked on the first wait")
+	}
+}
+
+// a priority cell is still a LockLane to everyone else
+
+func TestPriorityExclusion(t *testing.T) {
+	rb := &Roundabout{}
+	inside := 0
+	fn := func(uint16, uint16) error {
+		inside++
+		if inside != 1 {
+			t.Error("two callbacks in the lane")
+		}
+		inside--
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for w := range stressedWorkers(8) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range stressed(200) {
+				if (w+i)%3 == 0 {
+					rb.LockLanePriority(1, fn)
+				} else {
+					rb.LockLane(1, fn)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// every goroutine hammers the same lane, so they all queue up behind
+// each other, and we see how the spinning holds up as we add more
+
+func BenchmarkLockLaneScaling(b *testing.B) {
+	fn := func(uint16, uint16) error { return nil }
+	for _, workers := range []int{1, 2, 4, 8, 16, 32, 64} {
+		b.Run(fmt.Sprint(workers), func(b *testing.B) {
+			rb := &Roundabout{}
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for w := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := w; i < b.N; i += workers {
+						rb.LockLane(1, fn)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestParkAfter(t *testing.T) {
+	rb := &Roundabout{}
+	if n := rb.parkAfter(); n != backoffYields {
+		t.Error("fixed spin changed:", n)
+	}
+
+	rb.AdaptiveSpin = true
+	if n := rb.parkAfter(); n != backoffYields {
+		t.Error("no samples yet, but got", n)
+	}
+
+	// short waits yield for longer, up to maxYields
+	for range 64 {
+		rb.sampleWait(100 * time.Nanosecond)
+	}
+	if n := rb.parkAfter(); n != maxYields {
+		t.Error("short waits should yield longer, got", n)
+	}
+
+	// long waits park sooner, but we always spin first
+	for range 64 {
+		rb.sampleWait(10 * time.Millisecond)
+	}
+	if n := rb.parkAfter(); n != backoffSpins {
+		t.Error("long waits should park sooner, got", n)
+	}
+
+	// and it settles back around the target
+	for range 256 {
+		rb.sampleWait(adaptTarget)
+	}
+	if n := rb.parkAfter(); n < backoffYields-1 || n > backoffYields+1 {
+		t.Error("target wait should keep the default, got", n)
+	}
+
+	// a contended lane still works with it on
+	var wg sync.WaitGroup
+	count := 0
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				rb.LockLane(1, func(uint16, uint16) error {
+					count++
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if count != 8*200 {
+		t.Error("lost updates:", count)
+	}
+}
+
+// short and long critical sections, with and without AdaptiveSpin. a
+// short hold should do better yielding, and a long hold parking
+
+func BenchmarkAdaptiveSpin(b *testing.B) {
+	holds := []struct {
+		name string
+		hold time.Duration
+	}{
+		{"short", 0},
+		{"long", 50 * time.Microsecond},
+	}
+	for _, h := range holds {
+		fn := func(uint16, uint16) error {
+			if h.hold > 0 {
+				end := time.Now().Add(h.hold)
+				for time.Now().Before(end) {
+				}
+			}
+			return nil
+		}
+		for _, adaptive := range []bool{false, true} {
+			name := h.name + "/fixed"
+			if adaptive {
+				name = h.name + "/adaptive"
+			}
+			b.Run(name, func(b *testing.B) {
+				rb := NewRoundaboutFromConfig(Config{AdaptiveSpin: adaptive})
+				workers := 8
+				var wg sync.WaitGroup
+				b.ResetTimer()
+				for w := range workers {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := w; i < b.N; i += workers {
+							rb.LockLane(1, fn)
+						}
+					}()
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
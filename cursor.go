@@ -0,0 +1,54 @@
+package crow
+
+// where a RangePage got to
+//
+// The zero Cursor starts from the beginning, and the first page takes a
+// snapshot of the keys. Later pages load the values for the next keys in
+// the snapshot, so keys added after the first page are missed, and keys
+// deleted since are skipped, but each page only holds the map for as
+// long as it takes to load its values.
+
+type Cursor struct {
+	keys    []any
+	next    int
+	started bool
+	visited int
+}
+
+// true once every key in the snapshot has been looked at
+func (c Cursor) Done() bool {
+	return c.started && c.next >= len(c.keys)
+}
+
+// how many entries have been passed to the callback so far
+func (c Cursor) Visited() int {
+	return c.visited
+}
+
+// keys() takes the snapshot, load() returns the values for a page of keys,
+// with nil for the missing ones. f is called after load() returns, so that
+// it can use the map
+
+func (c Cursor) page(limit int, f func(key, value any) bool, keys func() []any, load func(keys []any) []any) Cursor {
+	if !c.started {
+		c.keys = keys()
+		c.started = true
+	}
+	if limit <= 0 {
+		limit = len(c.keys)
+	}
+
+	page := c.keys[c.next:min(c.next+limit, len(c.keys))]
+	values := load(page)
+	for i, k := range page {
+		c.next++
+		if values[i] == nil {
+			continue
+		}
+		c.visited++
+		if !f(k, values[i]) {
+			break
+		}
+	}
+	return c
+}
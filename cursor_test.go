@@ -0,0 +1,84 @@
+package crow
+
+import (
+	"testing"
+)
+
+func TestRangePage(t *testing.T) {
+	maps := []interface {
+		ConcurrentMap
+		RangePage(c Cursor, limit int, f func(key, value any) bool) Cursor
+	}{&LockedMap{}, &BoxedMap{}}
+
+	for _, m := range maps {
+		for i := range 10000 {
+			m.Store(i, i)
+		}
+
+		seen := map[any]int{}
+		pages := 0
+		var c Cursor
+		for !c.Done() {
+			c = m.RangePage(c, 1000, func(k, v any) bool {
+				if k != v {
+					t.Errorf("%T: wrong value for %v: %v", m, k, v)
+				}
+				seen[k]++
+				// changing the map between pages is fine
+				m.Delete(k.(int) + 1)
+				return true
+			})
+			pages++
+		}
+
+		if pages != 10 {
+			t.Errorf("%T: wrong number of pages %d", m, pages)
+		}
+		if c.Visited() != len(seen) {
+			t.Errorf("%T: visited %d, saw %d", m, c.Visited(), len(seen))
+		}
+		for k, n := range seen {
+			if n != 1 {
+				t.Errorf("%T: key %v seen %d times", m, k, n)
+			}
+		}
+		// we delete the key after each one we see, but only within a page
+		// can we be sure we've not seen it already
+		if len(seen) >= 10000 || len(seen) < 5000 {
+			t.Errorf("%T: deleted keys not skipped, saw %d", m, len(seen))
+		}
+	}
+}
+
+func TestRangePageStop(t *testing.T) {
+	m := &LockedMap{}
+	for i := range 10 {
+		m.Store(i, i)
+	}
+
+	var c Cursor
+	c = m.RangePage(c, 0, func(k, v any) bool {
+		return false
+	})
+	if c.Done() || c.Visited() != 1 {
+		t.Error("didn't stop", c.Visited())
+	}
+
+	seen := 0
+	c = m.RangePage(c, 0, func(k, v any) bool {
+		seen++
+		return true
+	})
+	if !c.Done() || c.Visited() != 10 || seen != 9 {
+		t.Error("didn't resume where it stopped", c.Visited(), seen)
+	}
+
+	var empty Cursor
+	empty = (&BoxedMap{}).RangePage(empty, 10, func(k, v any) bool {
+		t.Error("empty map has entries")
+		return true
+	})
+	if !empty.Done() {
+		t.Error("empty map not done")
+	}
+}
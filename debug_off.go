@@ -0,0 +1,11 @@
+//go:build !crowdebug
+
+package crow
+
+// the checks are compiled out unless built with -tags crowdebug
+
+const checkNesting = false
+
+// pop checks the cell is still the one it was given, see checkPop()
+
+const checkPops = false
@@ -0,0 +1,11 @@
+//go:build crowdebug
+
+package crow
+
+// built with -tags crowdebug: slower, but checks more, see checkNesting
+
+const checkNesting = true
+
+// pop checks the cell is still the one it was given, see checkPop()
+
+const checkPops = true
@@ -0,0 +1,83 @@
+package crow
+
+import (
+	"slices"
+)
+
+// Frees that wait for the readers to go
+//
+// The free list for epoch based reclamation: unlink something from a
+// structure guarded by a roundabout, take a marker with RetireEpoch(),
+// and Defer its free with the marker. Collect runs every free whose
+// marker CanReclaim, i.e once every operation that could have seen the
+// thing has left the log, and it's up to the caller to call it now and
+// then, from wherever's convenient.
+//
+// The frees are kept sorted by marker, and markers become reclaimable in
+// order, so Collect stops at the first one that isn't, and doesn't look
+// at the rest. Like CanReclaim, a marker that's 65536 epochs stale wraps
+// around, and waits again, so Collect should be called well before then.
+//
+// The frees run outside of the list's lock, on the goroutine that called
+// Collect, in marker order, so they can Defer more of their own.
+
+type DeferredFree struct {
+	rb    *Roundabout // the roundabout the markers come from
+	lock  Roundabout  // for the list
+	frees []deferred_free
+}
+
+type deferred_free struct {
+	marker uint16
+	free   func()
+}
+
+func NewDeferredFree(rb *Roundabout) *DeferredFree {
+	return &DeferredFree{rb: rb}
+}
+
+// markers usually arrive in order, so we look for the spot from the back
+
+func (d *DeferredFree) Defer(marker uint16, free func()) {
+	d.lock.LockRing(func(epoch uint16, flags uint16) error {
+		i := len(d.frees)
+		for i > 0 && int16(marker-d.frees[i-1].marker) < 0 {
+			i--
+		}
+		d.frees = slices.Insert(d.frees, i, deferred_free{marker, free})
+		return nil
+	})
+}
+
+// run every free that's safe to run, and return how many ran
+
+func (d *DeferredFree) Collect() int {
+	var ready []deferred_free
+	d.lock.LockRing(func(epoch uint16, flags uint16) error {
+		n := 0
+		for n < len(d.frees) && d.rb.CanReclaim(d.frees[n].marker) {
+			n++
+		}
+		if n == 0 {
+			return nil
+		}
+		ready = slices.Clone(d.frees[:n])
+		clear(d.frees[:n])
+		d.frees = d.frees[n:]
+		return nil
+	})
+	for _, f := range ready {
+		f.free()
+	}
+	return len(ready)
+}
+
+// how many frees are still waiting
+
+func (d *DeferredFree) Pending() (n int) {
+	d.lock.ShareRing(func(epoch uint16, flags uint16) error {
+		n = len(d.frees)
+		return nil
+	})
+	return
+}
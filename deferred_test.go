@@ -0,0 +1,81 @@
+package crow
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestDeferredFree(t *testing.T) {
+	rb := &Roundabout{}
+	d := NewDeferredFree(rb)
+	var freed []string
+	free := func(name string) func() {
+		return func() { freed = append(freed, name) }
+	}
+
+	// a reader that could see a, and one that could see b, but not a
+	first, _ := rb.AcquireRing(context.Background(), ShareRing)
+	a := rb.RetireEpoch()
+	second, _ := rb.AcquireRing(context.Background(), ShareRing)
+	b := rb.RetireEpoch()
+
+	// deferred out of order, they still run in order
+	d.Defer(b, free("b"))
+	d.Defer(a, free("a"))
+	if n := d.Collect(); n != 0 || len(freed) != 0 || d.Pending() != 2 {
+		t.Fatal("freed while readers were active:", freed)
+	}
+
+	first.Release()
+	if n := d.Collect(); n != 1 || !slices.Equal(freed, []string{"a"}) {
+		t.Fatal("wrong frees once the first reader went:", freed)
+	}
+	second.Release()
+	if n := d.Collect(); n != 1 || !slices.Equal(freed, []string{"a", "b"}) {
+		t.Fatal("wrong frees once both readers went:", freed)
+	}
+
+	// a free can defer another, which waits for the next Collect
+	third, _ := rb.AcquireRing(context.Background(), ShareRing)
+	d.Defer(rb.RetireEpoch(), func() {
+		freed = append(freed, "c")
+		d.Defer(rb.RetireEpoch(), free("d"))
+	})
+	third.Release()
+	if n := d.Collect(); n != 1 || d.Pending() != 1 {
+		t.Fatal("wrong frees from a free:", freed)
+	}
+	if n := d.Collect(); n != 1 || d.Pending() != 0 || !slices.Equal(freed, []string{"a", "b", "c", "d"}) {
+		t.Fatal("wrong frees:", freed)
+	}
+}
+
+// markers either side of the epoch wrapping stay in order
+
+func TestDeferredFreeWrap(t *testing.T) {
+	rb := &Roundabout{}
+	d := NewDeferredFree(rb)
+	fn := func(uint16, uint16) error { return nil }
+	for rb.Epoch() != 0xffff-2 {
+		rb.OrderRing(fn)
+	}
+
+	var held []Ticket
+	var order []uint16
+	for range 4 {
+		ticket, _ := rb.AcquireRing(context.Background(), ShareRing)
+		held = append(held, ticket)
+		marker := rb.RetireEpoch()
+		d.Defer(marker, func() { order = append(order, marker) })
+	}
+	for i, ticket := range held {
+		ticket.Release()
+		if n := d.Collect(); n != 1 || len(order) != i+1 {
+			t.Fatal("wrong frees after", i+1, "releases:", order)
+		}
+	}
+	if !slices.Equal(order, []uint16{0xfffd, 0xfffe, 0xffff, 0}) {
+		t.Error("wrong order:", order)
+	}
+}
@@ -0,0 +1,35 @@
+package crow
+
+import (
+	"errors"
+	"fmt"
+)
+
+// returned by a callback to give up its cell and start again with a new one,
+// for when it notices that it's working from a stale epoch
+
+var ErrRetry = errors.New("crow: retry operation")
+
+// returned by the operations that don't wait forever
+
+var (
+	ErrTimeout  = errors.New("crow: timed out")            // a deadline passed before we got in
+	ErrRingFull = errors.New("crow: no free cells")        // a non-blocking push found the ring full
+	ErrClosed   = errors.New("crow: roundabout is closed") // no new operations are being let in
+	ErrAborted  = errors.New("crow: aborted")              // the abort flag went up while we waited
+)
+
+// a bug in crow, not in the caller. we panic with it rather than return it,
+// so that it can't be mistaken for the callback's error
+
+var ErrInternal = errors.New("crow: internal error")
+
+// returned by Validate, wrapped with what it found
+
+var ErrInvalid = errors.New("crow: log doesn't match the header")
+
+// for the end of a for true {} loop that should never exit
+
+func unreachable(where string) error {
+	return fmt.Errorf("%w: %s fell out of its loop", ErrInternal, where)
+}
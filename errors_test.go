@@ -0,0 +1,16 @@
+package crow
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUnreachable(t *testing.T) {
+	err := unreachable("run")
+	if !errors.Is(err, ErrInternal) {
+		t.Error("internal errors should wrap ErrInternal", err)
+	}
+	if errors.Is(err, ErrRetry) {
+		t.Error("internal error looks like a retry", err)
+	}
+}
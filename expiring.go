@@ -0,0 +1,83 @@
+package crow
+
+import (
+	"time"
+)
+
+// A BoxedMap where entries expire
+//
+// There's no background thread, expired entries are deleted when
+// they're loaded, or when Sweep() is called.
+
+type ExpiringMap struct {
+	TTL time.Duration    // how long entries last, zero means forever
+	Now func() time.Time // the clock, defaults to time.Now
+
+	inner BoxedMap
+}
+
+// stored as a pointer, so we can CompareAndDelete any value
+
+type expiring_value struct {
+	value   any
+	expires time.Time
+}
+
+func (m *ExpiringMap) now() time.Time {
+	if m.Now == nil {
+		return time.Now()
+	}
+	return m.Now()
+}
+
+func (e *expiring_value) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+func (m *ExpiringMap) Store(key, value any) {
+	e := &expiring_value{value: value}
+	if m.TTL > 0 {
+		e.expires = m.now().Add(m.TTL)
+	}
+	m.inner.Store(key, e)
+}
+
+func (m *ExpiringMap) Load(key any) (value any, ok bool) {
+	v, ok := m.inner.Load(key)
+	if !ok {
+		return nil, false
+	}
+	e := v.(*expiring_value)
+	if e.expired(m.now()) {
+		// only delete it if no-one has stored a new value since
+		m.inner.CompareAndDelete(key, e)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (m *ExpiringMap) Delete(key any) {
+	m.inner.Delete(key)
+}
+
+// remove every expired entry from the map, under a LockRing
+
+func (m *ExpiringMap) Sweep() (removed int) {
+	now := m.now()
+	m.inner.rb.LockRing(func(epoch uint16, flags uint16) error {
+		for k, v := range m.inner.inner {
+			var a any
+			if v != nil {
+				a = v.Load()
+			}
+			if a == nil || a.(*expiring_value).expired(now) {
+				delete(m.inner.inner, k)
+				if a != nil {
+					removed++
+				}
+			}
+		}
+		return nil
+	})
+	return
+}
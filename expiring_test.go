@@ -0,0 +1,67 @@
+package crow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiringMap(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := &ExpiringMap{
+		TTL: time.Minute,
+		Now: func() time.Time { return now },
+	}
+
+	m.Store("a", 1)
+	if v, ok := m.Load("a"); !ok || v != 1 {
+		t.Error("missing value before ttl", v)
+	}
+
+	now = now.Add(30 * time.Second)
+	m.Store("b", 2)
+
+	now = now.Add(30 * time.Second)
+	if _, ok := m.Load("a"); ok {
+		t.Error("value still there after ttl")
+	}
+	if v, ok := m.Load("b"); !ok || v != 2 {
+		t.Error("value expired early", v)
+	}
+
+	m.Store("a", 3)
+	if v, ok := m.Load("a"); !ok || v != 3 {
+		t.Error("couldn't store after expiry", v)
+	}
+}
+
+func TestExpiringMapSweep(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := &ExpiringMap{
+		TTL: time.Minute,
+		Now: func() time.Time { return now },
+	}
+
+	for i := range 10 {
+		m.Store(i, i)
+	}
+	now = now.Add(time.Minute)
+	m.Store("fresh", true)
+
+	if removed := m.Sweep(); removed != 10 {
+		t.Error("wrong number of expired entries", removed)
+	}
+	if len(m.inner.inner) != 1 {
+		t.Error("expired entries left behind", len(m.inner.inner))
+	}
+	if _, ok := m.Load("fresh"); !ok {
+		t.Error("sweep removed a fresh entry")
+	}
+}
+
+func TestExpiringMapNoTTL(t *testing.T) {
+	m := &ExpiringMap{}
+	m.Store("a", 1)
+	if v, ok := m.Load("a"); !ok || v != 1 {
+		t.Error("value expired without a ttl", v)
+	}
+}
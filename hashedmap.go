@@ -0,0 +1,213 @@
+package crow
+
+import (
+	"reflect"
+)
+
+// A Locked Map for keys that aren't comparable
+//
+// Like a LockedMap, but entries are kept by Hash(key), so a key can be a
+// slice, a map, or a struct holding one, which would panic as the key of
+// a map[any]any. keys with the same hash are chained, and told apart
+// with Equal, which defaults to reflect.DeepEqual. Hash must be set before
+// the map is used, and keys that are Equal must have the same hash.
+//
+// Values are still compared with ==, as they are in the other maps, and
+// nil values count as absent keys, so storing nil deletes the key
+
+type HashedMap struct {
+	rb    Roundabout
+	inner map[uint64][]hashed_entry
+
+	Hash  func(key any) uint64
+	Equal func(a, b any) bool
+}
+
+type hashed_entry struct {
+	key, value any
+}
+
+func (m *HashedMap) hash(key any) uint64 {
+	if m.Hash == nil {
+		panic("crow: HashedMap used without a Hash function")
+	}
+	return m.Hash(key)
+}
+
+func (m *HashedMap) equal(a, b any) bool {
+	if m.Equal == nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return m.Equal(a, b)
+}
+
+// the rest of these are for when we hold a cell, and only writers
+// holding the LockRing change the map
+
+func (m *HashedMap) get(h uint64, key any) (value any, ok bool) {
+	for _, e := range m.inner[h] {
+		if m.equal(e.key, key) {
+			return e.value, true
+		}
+	}
+	return nil, false
+}
+
+func (m *HashedMap) set(h uint64, key, value any) {
+	if value == nil {
+		m.del(h, key)
+		return
+	}
+	chain := m.inner[h]
+	for i, e := range chain {
+		if m.equal(e.key, key) {
+			chain[i].value = value
+			return
+		}
+	}
+	if m.inner == nil {
+		m.inner = make(map[uint64][]hashed_entry, 8)
+	}
+	m.inner[h] = append(chain, hashed_entry{key, value})
+}
+
+// the chain is unordered, so we move the last entry into the gap
+
+func (m *HashedMap) del(h uint64, key any) {
+	chain := m.inner[h]
+	for i, e := range chain {
+		if !m.equal(e.key, key) {
+			continue
+		}
+		last := len(chain) - 1
+		chain[i] = chain[last]
+		chain[last] = hashed_entry{}
+		if last == 0 {
+			delete(m.inner, h)
+		} else {
+			m.inner[h] = chain[:last]
+		}
+		return
+	}
+}
+
+func (m *HashedMap) Load(key any) (value any, ok bool) {
+	if m == nil {
+		return nil, false
+	}
+	h := m.hash(key)
+	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		value, ok = m.get(h, key)
+		return nil
+	})
+	return
+}
+
+func (m *HashedMap) Store(key, value any) {
+	h := m.hash(key)
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		m.set(h, key, value)
+		return nil
+	})
+}
+
+func (m *HashedMap) Swap(key, value any) (previous any, loaded bool) {
+	h := m.hash(key)
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		previous, loaded = m.get(h, key)
+		m.set(h, key, value)
+		return nil
+	})
+	return
+}
+
+func (m *HashedMap) LoadOrStore(key, value any) (actual any, loaded bool) {
+	h := m.hash(key)
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		actual, loaded = m.get(h, key)
+		if !loaded {
+			m.set(h, key, value)
+			actual = value
+		}
+		return nil
+	})
+	return
+}
+
+func (m *HashedMap) LoadAndDelete(key any) (value any, loaded bool) {
+	h := m.hash(key)
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		value, loaded = m.get(h, key)
+		m.del(h, key)
+		return nil
+	})
+	return
+}
+
+func (m *HashedMap) Delete(key any) {
+	h := m.hash(key)
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		m.del(h, key)
+		return nil
+	})
+}
+
+// an old value of nil means the key must be absent, for insert-if-absent
+
+func (m *HashedMap) CompareAndSwap(key, old, new any) (swapped bool) {
+	h := m.hash(key)
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		v, _ := m.get(h, key)
+		if v == old {
+			m.set(h, key, new)
+			swapped = true
+		}
+		return nil
+	})
+	return
+}
+
+// nil values count as absent, so CompareAndDelete(key, nil) is always false
+
+func (m *HashedMap) CompareAndDelete(key, old any) (deleted bool) {
+	if old == nil {
+		return false
+	}
+	h := m.hash(key)
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		if v, ok := m.get(h, key); ok && v == old {
+			m.del(h, key)
+			deleted = true
+		}
+		return nil
+	})
+	return
+}
+
+// like LockedMap, we copy the entries out, so the callback can use the map
+
+func (m *HashedMap) Range(f func(key, value any) bool) {
+	var entries []hashed_entry
+	m.rb.OrderRing(func(epoch uint16, flags uint16) error {
+		for _, chain := range m.inner {
+			entries = append(entries, chain...)
+		}
+		return nil
+	})
+	for _, e := range entries {
+		if !f(e.key, e.value) {
+			break
+		}
+	}
+}
+
+func (m *HashedMap) RangeErr(f func(key, value any) error) error {
+	return rangeErr(m, f)
+}
+
+func (m *HashedMap) Clear() {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		clear(m.inner)
+		return nil
+	})
+}
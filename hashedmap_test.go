@@ -0,0 +1,148 @@
+package crow
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// a HashedMap for the ConcurrentMap tests, which only use comparable keys
+func newHashedMap() *HashedMap {
+	return &HashedMap{Hash: func(key any) uint64 { return uint64(LaneFor(key)) }}
+}
+
+func TestHashedMap(t *testing.T) {
+	// every key of the same length collides, so the chains get long
+	m := &HashedMap{
+		Hash: func(key any) uint64 { return uint64(len(key.([]int))) },
+	}
+
+	m.Store([]int{1, 2}, "a")
+	m.Store([]int{2, 1}, "b")
+	m.Store([]int{3}, "c")
+	m.Store([]int{1, 2}, "A")
+
+	if v, ok := m.Load([]int{1, 2}); !ok || v != "A" {
+		t.Error("wrong value for a colliding key", v, ok)
+	}
+	if v, ok := m.Load([]int{2, 1}); !ok || v != "b" {
+		t.Error("wrong value for a colliding key", v, ok)
+	}
+	if _, ok := m.Load([]int{2, 2}); ok {
+		t.Error("found a key that was never stored")
+	}
+	if len(m.inner[2]) != 2 {
+		t.Error("wrong chain", m.inner[2])
+	}
+
+	// deleting from the middle of a chain keeps the rest
+	m.Store([]int{9, 9}, "z")
+	m.Delete([]int{1, 2})
+	if _, ok := m.Load([]int{1, 2}); ok {
+		t.Error("deleted key still there")
+	}
+	for _, k := range [][]int{{2, 1}, {9, 9}} {
+		if _, ok := m.Load(k); !ok {
+			t.Error("delete lost a neighbour", k)
+		}
+	}
+
+	if v, loaded := m.LoadOrStore([]int{4, 4}, "d"); loaded || v != "d" {
+		t.Error("LoadOrStore of a new key", v, loaded)
+	}
+	if !m.CompareAndSwap([]int{5, 5}, nil, "e") || m.CompareAndSwap([]int{5, 5}, nil, "f") {
+		t.Error("insert if absent")
+	}
+	if !m.CompareAndDelete([]int{5, 5}, "e") {
+		t.Error("CompareAndDelete")
+	}
+	m.Store([]int{4, 4}, nil)
+	if _, ok := m.Load([]int{4, 4}); ok {
+		t.Error("storing nil didn't delete")
+	}
+
+	var keys []string
+	m.Range(func(k, v any) bool {
+		keys = append(keys, fmt.Sprint(k, " ", v))
+		return true
+	})
+	slices.Sort(keys)
+	if want := []string{"[2 1] b", "[3] c", "[9 9] z"}; !slices.Equal(keys, want) {
+		t.Error("wrong entries", keys)
+	}
+
+	m.Clear()
+	if len(m.inner) != 0 {
+		t.Error("clear left entries", m.inner)
+	}
+}
+
+func TestHashedMapEqual(t *testing.T) {
+	// keys are equal when they have the same elements, in any order
+	sorted := func(k any) []int {
+		s := slices.Clone(k.([]int))
+		slices.Sort(s)
+		return s
+	}
+	m := &HashedMap{
+		Hash: func(key any) uint64 {
+			var h uint64
+			for _, v := range key.([]int) {
+				h += uint64(v)
+			}
+			return h
+		},
+		Equal: func(a, b any) bool { return slices.Equal(sorted(a), sorted(b)) },
+	}
+	m.Store([]int{1, 2, 3}, "x")
+	if v, _ := m.Load([]int{3, 1, 2}); v != "x" {
+		t.Error("Equal wasn't used", v)
+	}
+	if _, ok := m.Load([]int{0, 3, 3}); ok {
+		t.Error("same hash, not equal, but found")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("no hash function didn't panic")
+			}
+		}()
+		(&HashedMap{}).Store("a", 1)
+	}()
+}
+
+func TestHashedMapConcurrent(t *testing.T) {
+	m := &HashedMap{
+		Hash: func(key any) uint64 { return uint64(key.([]int)[0] % 4) },
+	}
+	workers, rounds := stressedWorkers(8), stressed(100)
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rounds {
+				k := []int{w*rounds + i, w}
+				m.Store(k, i)
+				if v, ok := m.Load(k); !ok || v != i {
+					t.Error("lost a store", k, v)
+				}
+				if i%2 == 0 {
+					m.Delete(k)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	n := 0
+	m.Range(func(k, v any) bool {
+		n++
+		return true
+	})
+	if n != workers*rounds/2 {
+		t.Error("wrong number of entries", n)
+	}
+}
@@ -0,0 +1,177 @@
+package crow
+
+// An Integer Keyed Map
+//
+// The keys are split over a number of shards, and each shard gets
+// its own lane in the roundabout. Readers use ShareLane, writers use
+// LockLane, and so operations on different shards don't wait on
+// each other. Operations that touch every shard use the whole ring.
+
+const intShards = 32
+
+type IntMap struct {
+	rb     Roundabout
+	shards [intShards]map[uint64]any
+}
+
+// the shard is the lane, so keys in the same shard wait on each other
+func intLane(key uint64) uint32 {
+	return laneForUint64(key) % intShards
+}
+
+func (m *IntMap) Load(key uint64) (value any, ok bool) {
+	if m == nil {
+		return nil, false
+	}
+	lane := intLane(key)
+	m.rb.ShareLane(lane, func(epoch uint16, flags uint16) error {
+		value, ok = m.shards[lane][key]
+		return nil
+	})
+	if value == nil {
+		return nil, false
+	}
+	return
+}
+
+func (m *IntMap) Store(key uint64, value any) {
+	lane := intLane(key)
+	m.rb.LockLane(lane, func(epoch uint16, flags uint16) error {
+		if m.shards[lane] == nil {
+			m.shards[lane] = make(map[uint64]any, 8)
+		}
+		m.shards[lane][key] = value
+		return nil
+	})
+}
+
+// store all of the entries under one LockRing, rather than a lane each
+
+func (m *IntMap) StoreMany(entries map[uint64]any) {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		for k, v := range entries {
+			lane := intLane(k)
+			if m.shards[lane] == nil {
+				m.shards[lane] = make(map[uint64]any, 8)
+			}
+			m.shards[lane][k] = v
+		}
+		return nil
+	})
+}
+
+func (m *IntMap) Swap(key uint64, value any) (previous any, loaded bool) {
+	lane := intLane(key)
+	m.rb.LockLane(lane, func(epoch uint16, flags uint16) error {
+		if m.shards[lane] == nil {
+			m.shards[lane] = make(map[uint64]any, 8)
+		}
+		previous, loaded = m.shards[lane][key]
+		m.shards[lane][key] = value
+		return nil
+	})
+	if previous == nil {
+		return nil, false
+	}
+	return
+}
+
+func (m *IntMap) CompareAndDelete(key uint64, old any) (deleted bool) {
+	if old == nil {
+		return false
+	}
+	lane := intLane(key)
+	m.rb.LockLane(lane, func(epoch uint16, flags uint16) error {
+		v, ok := m.shards[lane][key]
+		if ok && v == old {
+			delete(m.shards[lane], key)
+			deleted = true
+		}
+		return nil
+	})
+	return
+}
+
+// an old value of nil means the key must be absent, for insert-if-absent
+
+func (m *IntMap) CompareAndSwap(key uint64, old, new any) (swapped bool) {
+	lane := intLane(key)
+	m.rb.LockLane(lane, func(epoch uint16, flags uint16) error {
+		if m.shards[lane] == nil {
+			m.shards[lane] = make(map[uint64]any, 8)
+		}
+		v := m.shards[lane][key]
+		if v == old {
+			m.shards[lane][key] = new
+			swapped = true
+		}
+		return nil
+	})
+	return
+}
+
+func (m *IntMap) Delete(key uint64) {
+	lane := intLane(key)
+	m.rb.LockLane(lane, func(epoch uint16, flags uint16) error {
+		delete(m.shards[lane], key)
+		return nil
+	})
+}
+
+func (m *IntMap) LoadAndDelete(key uint64) (value any, loaded bool) {
+	lane := intLane(key)
+	m.rb.LockLane(lane, func(epoch uint16, flags uint16) error {
+		value, loaded = m.shards[lane][key]
+		delete(m.shards[lane], key)
+		return nil
+	})
+	if value == nil {
+		return nil, false
+	}
+	return
+}
+
+func (m *IntMap) LoadOrStore(key uint64, value any) (actual any, loaded bool) {
+	lane := intLane(key)
+	m.rb.LockLane(lane, func(epoch uint16, flags uint16) error {
+		if m.shards[lane] == nil {
+			m.shards[lane] = make(map[uint64]any, 8)
+		}
+		actual, loaded = m.shards[lane][key]
+		if !loaded || actual == nil {
+			m.shards[lane][key] = value
+			actual, loaded = value, false
+		}
+		return nil
+	})
+	return
+}
+
+func (m *IntMap) Range(f func(key uint64, value any) bool) {
+	// like LockedMap, we copy so the callback can use the map
+	copy := make(map[uint64]any)
+	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		for _, shard := range m.shards {
+			for k, v := range shard {
+				if v != nil {
+					copy[k] = v
+				}
+			}
+		}
+		return nil
+	})
+	for k, v := range copy {
+		if !f(k, v) {
+			break
+		}
+	}
+}
+
+func (m *IntMap) Clear() {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		for _, shard := range m.shards {
+			clear(shard)
+		}
+		return nil
+	})
+}
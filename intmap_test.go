@@ -0,0 +1,127 @@
+package crow
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestIntMap(t *testing.T) {
+	m := &IntMap{}
+
+	for i := range uint64(100) {
+		m.Store(i, i*2)
+	}
+	for i := range uint64(100) {
+		v, ok := m.Load(i)
+		if !ok || v != i*2 {
+			t.Error("wrong value", i, v)
+		}
+	}
+
+	if prev, loaded := m.Swap(1, "one"); !loaded || prev != uint64(2) {
+		t.Error("bad swap", prev, loaded)
+	}
+	if !m.CompareAndSwap(1, "one", "uno") {
+		t.Error("compare and swap failed")
+	}
+	if m.CompareAndDelete(1, "one") {
+		t.Error("compare and delete with old value succeeded")
+	}
+	if !m.CompareAndDelete(1, "uno") {
+		t.Error("compare and delete failed")
+	}
+	if !m.CompareAndSwap(5000, nil, "inserted") || m.CompareAndSwap(5000, nil, "again") {
+		t.Error("compare and swap with nil should only insert absent keys")
+	}
+	if actual, loaded := m.LoadOrStore(1, "new"); loaded || actual != "new" {
+		t.Error("bad load or store", actual, loaded)
+	}
+	if v, loaded := m.LoadAndDelete(1); !loaded || v != "new" {
+		t.Error("bad load and delete", v, loaded)
+	}
+
+	count := 0
+	m.Range(func(k uint64, v any) bool {
+		count++
+		return true
+	})
+	if count != 100 {
+		t.Error("wrong count", count)
+	}
+
+	m.Clear()
+	if _, ok := m.Load(2); ok {
+		t.Error("clear left values behind")
+	}
+}
+
+func TestIntMapStoreMany(t *testing.T) {
+	m := &IntMap{}
+	m.StoreMany(map[uint64]any{1: "a", 2: "b", 1000: "c"})
+	for k, want := range map[uint64]any{1: "a", 2: "b", 1000: "c"} {
+		if v, _ := m.Load(k); v != want {
+			t.Error("wrong value", k, v)
+		}
+	}
+}
+
+func TestIntMapConcurrent(t *testing.T) {
+	m := &IntMap{}
+	var wg sync.WaitGroup
+	for w := range uint64(4) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range uint64(200) {
+				m.Store(w*1000+i, i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for w := range uint64(4) {
+		for i := range uint64(200) {
+			if v, _ := m.Load(w*1000 + i); v != i {
+				t.Error("wrong value", w, i, v)
+			}
+		}
+	}
+}
+
+func BenchmarkIntMapStore(b *testing.B) {
+	m := &IntMap{}
+	b.ResetTimer()
+	for i := range b.N {
+		m.Store(uint64(i%1024), i)
+	}
+}
+
+func BenchmarkIntMapLoad(b *testing.B) {
+	m := &IntMap{}
+	for i := range 1024 {
+		m.Store(uint64(i), i)
+	}
+	b.ResetTimer()
+	for i := range b.N {
+		m.Load(uint64(i % 1024))
+	}
+}
+
+func BenchmarkLockedMapIntStore(b *testing.B) {
+	m := &LockedMap{}
+	b.ResetTimer()
+	for i := range b.N {
+		m.Store(uint64(i%1024), i)
+	}
+}
+
+func BenchmarkLockedMapIntLoad(b *testing.B) {
+	m := &LockedMap{}
+	for i := range 1024 {
+		m.Store(uint64(i), i)
+	}
+	b.ResetTimer()
+	for i := range b.N {
+		m.Load(uint64(i % 1024))
+	}
+}
@@ -0,0 +1,113 @@
+package crow
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+)
+
+// a map written out as a JSON object, one entry at a time, for WriteJSON
+//
+// The keys are snapshotted first, under one brief read, and then each
+// value is loaded with a Load of its own, and written out before the next
+// one is loaded. so the whole dump is never held in memory, and writers
+// are only kept out for the snapshot, but it isn't one instant's view of
+// the map:
+//
+// - a key deleted after the snapshot is left out
+// - a key added after the snapshot is missed
+// - each value is one its key held at some point during the call, but
+//   two keys written together can show one old and one new value
+//
+// Keys are written in sorted order, as encoding/json does for maps, and
+// must be strings, integers, or encoding.TextMarshalers. a key of any
+// other type is an error, found before anything is written. an error from
+// the writer, or from encoding a value, stops the dump part way through
+
+func writeJSON(w io.Writer, keys []any, load func(key any) (any, bool)) error {
+	type json_key struct {
+		key  any
+		name string
+	}
+	names := make([]json_key, 0, len(keys))
+	for _, k := range keys {
+		name, err := jsonKey(k)
+		if err != nil {
+			return err
+		}
+		names = append(names, json_key{k, name})
+	}
+	slices.SortFunc(names, func(a, b json_key) int {
+		switch {
+		case a.name < b.name:
+			return -1
+		case a.name > b.name:
+			return 1
+		}
+		return 0
+	})
+
+	// each entry is encoded into buf, and then written out in one go
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	buf.WriteByte('{')
+	first := true
+	for _, k := range names {
+		v, ok := load(k.key)
+		if !ok {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		if err := enc.Encode(k.name); err != nil {
+			return err
+		}
+		buf.Truncate(buf.Len() - 1) // Encode ends with a newline
+		buf.WriteByte(':')
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		buf.Truncate(buf.Len() - 1)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		buf.Reset()
+	}
+	buf.WriteByte('}')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// the same keys encoding/json allows in a map, checked in the order its
+// classic encoder checks them: a string kind wins over MarshalText, and
+// a nil pointer that implements it is written as "", rather than calling
+// MarshalText on it. the encoder built on json/v2, under
+// GOEXPERIMENT=jsonv2, calls MarshalText on a string kind instead
+
+func jsonKey(key any) (string, error) {
+	v := reflect.ValueOf(key)
+	if v.Kind() == reflect.String {
+		return v.String(), nil
+	}
+	if tm, ok := key.(encoding.TextMarshaler); ok {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			return "", nil
+		}
+		b, err := tm.MarshalText()
+		return string(b), err
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("crow: can't write a %T as a JSON key", key)
+}
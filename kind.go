@@ -0,0 +1,68 @@
+package crow
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Kinds of cell beyond the built-in ones
+//
+// RegisterKind adds a kind with its own rule for what it conflicts with.
+// A custom cell has no lane, so the rule only gets the other cell's kind,
+// and it decides both ways: whether a cell of this kind waits for an
+// earlier cell of the other kind, and whether a later one waits for it.
+// Two custom kinds conflict if either one says so.
+//
+// The built-in kinds follow the rule too, so a LockRing will run over a
+// custom cell that doesn't conflict with LockRing. LockLanePriority is
+// passed in as LockLane, as it is everywhere else.
+//
+// Kinds are registered for the whole program, usually from an init(), and
+// can't be taken back. Registering a built-in kind, or the same kind
+// twice, panics. Counts() doesn't count custom cells.
+
+type Kind uint16
+
+var customKinds sync.Map // uint16 -> func(otherKind uint16) bool
+
+func RegisterKind(id uint16, conflictsWith func(otherKind uint16) bool) Kind {
+	if id <= LockLaneRange {
+		panic(fmt.Sprintf("crow: kind %d is built in", id))
+	} else if conflictsWith == nil {
+		panic(fmt.Sprintf("crow: kind %d registered without a conflict function", id))
+	}
+	if _, loaded := customKinds.LoadOrStore(id, conflictsWith); loaded {
+		panic(fmt.Sprintf("crow: kind %d registered twice", id))
+	}
+	return Kind(id)
+}
+
+func customKind(kind uint16) func(uint16) bool {
+	if kind <= LockLaneRange {
+		return nil
+	}
+	if fn, ok := customKinds.Load(kind); ok {
+		return fn.(func(uint16) bool)
+	}
+	return nil
+}
+
+// one of the kinds is a custom one. a kind we don't know about is one
+// that's been written over, and we look at the cell again
+
+func customConflicts(kind, other uint16) bool {
+	a, b := customKind(kind), customKind(other)
+	if a == nil && b == nil {
+		return true
+	}
+	return (a != nil && a(other)) || (b != nil && b(kind))
+}
+
+// run the callback in a cell of a registered kind, like LockRing and friends
+
+func (rb *Roundabout) RunKind(k Kind, fn func(epoch uint16, flags uint16) error) error {
+	if customKind(uint16(k)) == nil {
+		panic(fmt.Sprintf("crow: kind %d isn't registered", k))
+	}
+	return rb.run(0, uint16(k), nil, fn)
+}
@@ -0,0 +1,113 @@
+package crow
+
+import (
+	"testing"
+	"time"
+)
+
+var ringOnlyKind = RegisterKind(100, func(other uint16) bool { return other == LockRing })
+
+// run op in the background, holding it until release is closed
+
+func holdOp(op func(fn func(uint16, uint16) error) error) (release func()) {
+	held := make(chan bool)
+	done := make(chan bool)
+	go op(func(uint16, uint16) error {
+		close(held)
+		<-done
+		return nil
+	})
+	<-held
+	return func() { close(done) }
+}
+
+// does op run within a short while, or is it blocked?
+
+func runsNow(op func(fn func(uint16, uint16) error) error) (ran bool, wait func()) {
+	done := make(chan bool)
+	go op(func(uint16, uint16) error {
+		close(done)
+		return nil
+	})
+	select {
+	case <-done:
+		return true, func() {}
+	case <-time.After(20 * time.Millisecond):
+		return false, func() { <-done }
+	}
+}
+
+func TestRegisterKind(t *testing.T) {
+	rb := &Roundabout{}
+	custom := func(fn func(uint16, uint16) error) error { return rb.RunKind(ringOnlyKind, fn) }
+	lane := func(fn func(uint16, uint16) error) error { return rb.LockLane(0, fn) }
+	priority := func(fn func(uint16, uint16) error) error { return rb.LockLanePriority(0, fn) }
+
+	// the custom cell passes everything but a LockRing, both ways round
+	for name, op := range map[string]func(func(uint16, uint16) error) error{
+		"LockLane":         lane,
+		"LockLanePriority": priority,
+		"OrderRing":        rb.OrderRing,
+		"ShareRing":        rb.ShareRing,
+		"custom":           custom,
+	} {
+		release := holdOp(op)
+		if ran, wait := runsNow(custom); !ran {
+			t.Error("custom kind waited for", name)
+			release()
+			wait()
+		} else {
+			release()
+		}
+
+		release = holdOp(custom)
+		if ran, wait := runsNow(op); !ran {
+			t.Error(name, "waited for the custom kind")
+			release()
+			wait()
+		} else {
+			release()
+		}
+	}
+
+	release := holdOp(rb.LockRing)
+	ran, wait := runsNow(custom)
+	if ran {
+		t.Error("custom kind ran over a LockRing")
+	}
+	release()
+	wait()
+
+	release = holdOp(custom)
+	ran, wait = runsNow(rb.LockRing)
+	if ran {
+		t.Error("LockRing ran over the custom kind")
+	}
+	release()
+	wait()
+
+	rb.Quiesce()
+	if !rb.idle() {
+		t.Error("cells leaked", rb.String())
+	}
+}
+
+func TestRegisterKindMisuse(t *testing.T) {
+	panics := func(name string, fn func()) {
+		defer func() {
+			if recover() == nil {
+				t.Error(name, "didn't panic")
+			}
+		}()
+		fn()
+	}
+	never := func(uint16) bool { return false }
+
+	panics("built in", func() { RegisterKind(LockRing, never) })
+	panics("twice", func() { RegisterKind(uint16(ringOnlyKind), never) })
+	panics("no function", func() { RegisterKind(101, nil) })
+	panics("unregistered", func() {
+		rb := &Roundabout{}
+		rb.RunKind(Kind(102), func(uint16, uint16) error { return nil })
+	})
+}
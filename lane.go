@@ -0,0 +1,167 @@
+package crow
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"math"
+	"reflect"
+)
+
+// Turning keys into lanes
+//
+// Lanes only need to be consistent within a process, so we use maphash
+// with a seed picked at startup, and a cheap mixer for integers. Two keys
+// in the same lane will wait on each other, so a bad hash means false
+// conflicts, rather than wrong answers.
+
+var laneSeed = maphash.MakeSeed()
+
+func LaneForString(key string) uint32 {
+	return foldLane(maphash.String(laneSeed, key))
+}
+
+func LaneForBytes(key []byte) uint32 {
+	return foldLane(maphash.Bytes(laneSeed, key))
+}
+
+// strings, byte slices, and integers are hashed directly, and so are
+// pointers, chans, funcs, maps, and unsafe.Pointers, by their address, as
+// that's what makes them the same key. anything else is walked with
+// reflect, see laneHash, so keys that are == always share a lane, which
+// LockManager and SingleFlight rely on. printing them wouldn't do: 0.0
+// and -0.0 are equal, but print differently, and printing a pointer field
+// follows it, so the lane would move when what it points at changed
+
+func LaneFor(key any) uint32 {
+	switch k := key.(type) {
+	case string:
+		return LaneForString(k)
+	case []byte:
+		return LaneForBytes(k)
+	case int:
+		return laneForUint64(uint64(k))
+	case int8:
+		return laneForUint64(uint64(k))
+	case int16:
+		return laneForUint64(uint64(k))
+	case int32:
+		return laneForUint64(uint64(k))
+	case int64:
+		return laneForUint64(uint64(k))
+	case uint:
+		return laneForUint64(uint64(k))
+	case uint8:
+		return laneForUint64(uint64(k))
+	case uint16:
+		return laneForUint64(uint64(k))
+	case uint32:
+		return laneForUint64(uint64(k))
+	case uint64:
+		return laneForUint64(k)
+	case uintptr:
+		return laneForUint64(uint64(k))
+	}
+	v := reflect.ValueOf(key)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return laneForUint64(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return laneForUint64(v.Uint())
+	case reflect.Pointer, reflect.Chan, reflect.Func, reflect.Map, reflect.UnsafePointer:
+		return laneForUint64(uint64(v.Pointer()))
+	}
+	var h maphash.Hash
+	h.SetSeed(laneSeed)
+	if v.IsValid() {
+		h.WriteString(v.Type().String())
+	}
+	laneHash(&h, v)
+	return foldLane(h.Sum64())
+}
+
+// hash a value the way == compares it: floats by their bits, with -0
+// folded into +0, pointer-like values by address, interfaces by their
+// dynamic type and value, and arrays and structs field by field, skipping
+// blank fields, which == ignores. strings are written with their length,
+// so that two fields can't run together. slices aren't comparable, but
+// they're hashed by their elements, as LaneFor always has
+
+func laneHash(h *maphash.Hash, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Invalid:
+		h.WriteByte(0)
+	case reflect.Bool:
+		if v.Bool() {
+			h.WriteByte(1)
+		} else {
+			h.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		laneWriteUint64(h, uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		laneWriteUint64(h, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		laneWriteFloat(h, v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		laneWriteFloat(h, real(c))
+		laneWriteFloat(h, imag(c))
+	case reflect.String:
+		laneWriteUint64(h, uint64(v.Len()))
+		h.WriteString(v.String())
+	case reflect.Pointer, reflect.Chan, reflect.Func, reflect.Map, reflect.UnsafePointer:
+		laneWriteUint64(h, uint64(v.Pointer()))
+	case reflect.Interface:
+		if v.IsNil() {
+			h.WriteByte(0)
+			return
+		}
+		h.WriteByte(1)
+		h.WriteString(v.Elem().Type().String())
+		laneHash(h, v.Elem())
+	case reflect.Array, reflect.Slice:
+		laneWriteUint64(h, uint64(v.Len()))
+		for i := range v.Len() {
+			laneHash(h, v.Index(i))
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := range v.NumField() {
+			if t.Field(i).Name != "_" {
+				laneHash(h, v.Field(i))
+			}
+		}
+	}
+}
+
+func laneWriteUint64(h *maphash.Hash, x uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], x)
+	h.Write(b[:])
+}
+
+// -0 == +0, so they have to hash the same. NaNs never equal anything, so
+// whichever bits they have will do
+
+func laneWriteFloat(h *maphash.Hash, f float64) {
+	if f == 0 {
+		f = 0
+	}
+	laneWriteUint64(h, math.Float64bits(f))
+}
+
+// the splitmix64 finalizer, xored with the seed so integer lanes aren't
+// the same in every process either
+
+var laneIntSeed = maphash.String(laneSeed, "int")
+
+func laneForUint64(k uint64) uint32 {
+	k ^= laneIntSeed
+	k = (k ^ (k >> 30)) * 0xbf58476d1ce4e5b9
+	k = (k ^ (k >> 27)) * 0x94d049bb133111eb
+	return foldLane(k ^ (k >> 31))
+}
+
+func foldLane(h uint64) uint32 {
+	return uint32(h) ^ uint32(h>>32)
+}
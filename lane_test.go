@@ -0,0 +1,104 @@
+package crow
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestLaneFor(t *testing.T) {
+	if LaneFor("abc") != LaneForString("abc") || LaneFor([]byte("abc")) != LaneForBytes([]byte("abc")) {
+		t.Error("LaneFor doesn't match the typed helpers")
+	}
+	if LaneFor(uint64(7)) != LaneFor(7) {
+		t.Error("integer lanes depend on the type")
+	}
+	type point struct{ x, y int }
+	if LaneFor(point{1, 2}) != LaneFor(point{1, 2}) || LaneFor(point{1, 2}) == LaneFor(point{2, 1}) {
+		t.Error("struct lanes aren't consistent")
+	}
+
+	// pointer-like keys are hashed by address, not by what they point at
+	p, q := &point{1, 2}, &point{1, 2}
+	lane := LaneFor(p)
+	p.x = 3
+	if LaneFor(p) != lane {
+		t.Error("pointer key changed lanes when its pointee changed")
+	}
+	if LaneFor(q) == lane {
+		t.Error("different pointers to equal values share a lane")
+	}
+	m := map[int]int{1: 1}
+	lane = LaneFor(m)
+	m[2] = 2
+	if LaneFor(m) != lane {
+		t.Error("map key changed lanes when the map changed")
+	}
+
+	// keys that are == share a lane, even when they print differently
+	negZero := math.Copysign(0, -1)
+	if LaneFor(0.0) != LaneFor(negZero) {
+		t.Error("0.0 and -0.0 are in different lanes")
+	}
+	if LaneFor(complex(0, 1)) != LaneFor(complex(negZero, 1)) {
+		t.Error("complex zeroes are in different lanes")
+	}
+	type named struct {
+		P *stringer
+		V any
+	}
+	n := &stringer{"a"}
+	lane = LaneFor(named{n, 0.0})
+	n.s = "b"
+	if LaneFor(named{n, negZero}) != lane {
+		t.Error("struct key changed lanes when a pointer field's pointee changed")
+	}
+	if LaneFor(named{n, 1}) == LaneFor(named{n, 1.0}) {
+		t.Error("interface fields with different types share a lane")
+	}
+}
+
+type stringer struct{ s string }
+
+func (s *stringer) String() string {
+	return s.s
+}
+
+func TestLaneDistribution(t *testing.T) {
+	const keys = 1 << 15
+	const buckets = 32
+
+	sets := map[string]func(i int) uint32{
+		"string": func(i int) uint32 { return LaneForString(fmt.Sprint("key-", i)) },
+		"bytes":  func(i int) uint32 { return LaneForBytes([]byte(fmt.Sprint(i))) },
+		"int":    func(i int) uint32 { return LaneFor(i) },
+		"stride": func(i int) uint32 { return LaneFor(i * 1024) },
+	}
+
+	for name, lane := range sets {
+		seen := make(map[uint32]bool, keys)
+		collisions := 0
+		var counts [buckets]int
+		for i := range keys {
+			l := lane(i)
+			if seen[l] {
+				collisions++
+			}
+			seen[l] = true
+			counts[l%buckets]++
+		}
+
+		// we expect about keys^2 / 2^33 = 0.125 collisions
+		if collisions > 4 {
+			t.Error(name, "too many collisions", collisions)
+		}
+		// and each bucket within 20% of keys/buckets. the seed changes
+		// every run, and a bucket's standard deviation is about 3%, so 10%
+		// fails now and again across 128 buckets
+		for b, n := range counts {
+			if n < keys/buckets*8/10 || n > keys/buckets*12/10 {
+				t.Error(name, "uneven bucket", b, n)
+			}
+		}
+	}
+}
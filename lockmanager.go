@@ -0,0 +1,82 @@
+package crow
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// A reader/writer lock for each key
+//
+// LockManager is like a map of sync.RWMutexes, without the map: a key is
+// turned into a lane with LaneFor, and RLock takes a ShareLane cell, and
+// Lock a LockLane cell, which are held until the matching unlock, like a
+// Ticket. Readers of a key share it, a writer has it to itself, and other
+// keys carry on around them. Two keys that land in the same lane wait on
+// each other, as they would in any other lane operation.
+//
+// Every lock that's held, or waited for, takes up a cell, so only width of
+// them can be in play at once, and the rest wait for room in the ring.
+// Locks are for short critical sections, not for holding on to.
+//
+// Keys are compared with == to match an unlock to its lock, so they must
+// be comparable. Unlocking a key that isn't locked panics. Like a
+// sync.RWMutex, a lock isn't tied to a goroutine, and a goroutine that
+// takes RLock twice for the same key can deadlock behind a writer.
+//
+// The zero value is ready to use.
+
+type LockManager struct {
+	rb   Roundabout
+	held [width]atomic.Pointer[held_lock] // by the slot of the lock's cell
+}
+
+type held_lock struct {
+	key    any
+	ticket Ticket
+}
+
+// the manager's roundabout is never closed or aborted, and nothing here
+// gives up waiting, so acquire can't fail
+
+func (m *LockManager) lock(key any, kind uint16) {
+	t, err := m.rb.acquire(context.Background(), rb_cell{lane: LaneFor(key), kind: kind}, false)
+	if err != nil {
+		panic(fmt.Errorf("%w: LockManager couldn't lock: %w", ErrInternal, err))
+	}
+	// no-one else has this slot until we pop the cell
+	m.held[t.cell.n].Store(&held_lock{key, t})
+}
+
+// any held lock of the right kind for the key will do, as two readers of
+// a key are interchangeable
+
+func (m *LockManager) unlock(key any, kind uint16, name string) {
+	for i := range m.held {
+		h := m.held[i].Load()
+		if h == nil || h.ticket.cell.kind != kind || h.key != key {
+			continue
+		}
+		if m.held[i].CompareAndSwap(h, nil) {
+			h.ticket.Release()
+			return
+		}
+	}
+	panic(fmt.Sprintf("crow: %s of %v, which isn't locked", name, key))
+}
+
+func (m *LockManager) RLock(key any) {
+	m.lock(key, ShareLane)
+}
+
+func (m *LockManager) RUnlock(key any) {
+	m.unlock(key, ShareLane, "RUnlock")
+}
+
+func (m *LockManager) Lock(key any) {
+	m.lock(key, LockLane)
+}
+
+func (m *LockManager) Unlock(key any) {
+	m.unlock(key, LockLane, "Unlock")
+}
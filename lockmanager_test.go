@@ -0,0 +1,157 @@
+package crow
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockManager(t *testing.T) {
+	var m LockManager
+	if LaneFor("a") == LaneFor("b") {
+		t.Skip("keys share a lane")
+	}
+
+	// three readers of a, all holding it at once
+	const readers = 3
+	var holding sync.WaitGroup
+	var inside atomic.Int32
+	holding.Add(readers)
+	release := make(chan bool)
+	var done sync.WaitGroup
+	for range readers {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			m.RLock("a")
+			inside.Add(1)
+			holding.Done()
+			<-release
+			inside.Add(-1)
+			m.RUnlock("a")
+		}()
+	}
+	holding.Wait()
+	if inside.Load() != readers {
+		t.Fatal("readers didn't share the key:", inside.Load())
+	}
+
+	// a writer on b gets in while they hold a
+	locked := make(chan bool)
+	go func() {
+		m.Lock("b")
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("writer on b waited for readers of a")
+	}
+
+	// and a writer on a waits for them
+	writing := make(chan bool)
+	go func() {
+		m.Lock("a")
+		if inside.Load() != 0 {
+			t.Error("writer got in with readers inside")
+		}
+		close(writing)
+	}()
+	select {
+	case <-writing:
+		t.Fatal("writer on a didn't wait for readers")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	done.Wait()
+	<-writing
+
+	// a reader of b waits for the writer of b, too
+	reading := make(chan bool)
+	go func() {
+		m.RLock("b")
+		close(reading)
+	}()
+	select {
+	case <-reading:
+		t.Fatal("reader of b didn't wait for the writer")
+	case <-time.After(20 * time.Millisecond):
+	}
+	m.Unlock("b")
+	<-reading
+	m.RUnlock("b")
+	m.Unlock("a")
+
+	if err := m.rb.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLockManagerMisuse(t *testing.T) {
+	var m LockManager
+	expectPanic := func(name, want string, fn func()) {
+		t.Helper()
+		defer func() {
+			r := recover()
+			if s, _ := r.(string); !strings.Contains(s, want) {
+				t.Errorf("%s: wrong panic: %v", name, r)
+			}
+		}()
+		fn()
+	}
+
+	expectPanic("Unlock", "Unlock of k", func() { m.Unlock("k") })
+
+	// a read lock can't be unlocked as a write lock, or the other way round
+	m.RLock("k")
+	expectPanic("Unlock of a read lock", "Unlock of k", func() { m.Unlock("k") })
+	m.RUnlock("k")
+	expectPanic("RUnlock twice", "RUnlock of k", func() { m.RUnlock("k") })
+
+	m.Lock("k")
+	expectPanic("RUnlock of a write lock", "RUnlock of k", func() { m.RUnlock("k") })
+	m.Unlock("k")
+}
+
+// writers of each key see their own counter without anyone else in the
+// middle, and readers never see it half updated
+
+func TestLockManagerConcurrent(t *testing.T) {
+	var m LockManager
+	keys := []string{"a", "b", "c", "d"}
+	counts := make([][2]int, len(keys))
+
+	var wg sync.WaitGroup
+	for w := range stressedWorkers(8) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range stressed(500) {
+				k := (w + i) % len(keys)
+				if i%3 == 0 {
+					m.Lock(keys[k])
+					counts[k][0]++
+					counts[k][1]++
+					m.Unlock(keys[k])
+				} else {
+					m.RLock(keys[k])
+					if counts[k][0] != counts[k][1] {
+						t.Error("torn read of", keys[k])
+					}
+					m.RUnlock(keys[k])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, c := range counts {
+		total += c[0]
+	}
+	if want := stressedWorkers(8) * ((stressed(500) + 2) / 3); total != want {
+		t.Error("lost writes:", total, "want", want)
+	}
+}
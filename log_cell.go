@@ -0,0 +1,15 @@
+//go:build !crowpadded
+
+package crow
+
+import (
+	"sync/atomic"
+)
+
+// a slot in the log. eight of them share a cache line, so pushing and
+// popping neighbouring slots bounces the line between cpus. building with
+// -tags crowpadded gives each slot a line of its own, see log_cell_padded.go
+
+type log_cell struct {
+	atomic.Uint64
+}
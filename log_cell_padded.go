@@ -0,0 +1,17 @@
+//go:build crowpadded
+
+package crow
+
+import (
+	"sync/atomic"
+)
+
+// a slot in the log, padded out to a 64 byte cache line, so that threads
+// working on neighbouring slots don't invalidate each other's lines. it
+// makes the log 2k rather than 256 bytes, and a WideRoundabout doesn't pad
+// its wide lanes, as they're only read when the hashes match
+
+type log_cell struct {
+	atomic.Uint64
+	_ [56]byte
+}
@@ -1,10 +1,15 @@
 package crow
 
 import (
+	"io"
+	"reflect"
+	"slices"
+	"sort"
 	"sync/atomic"
 )
 
-// note, CompareAndSwap(key, nil, new), key must exist
+// note, nil values are treated as absent keys, so
+// CompareAndSwap(key, nil, new) only succeeds if key is absent
 type ConcurrentMap interface {
 	Clear()
 	CompareAndDelete(key, old any) (deleted bool)
@@ -18,11 +23,179 @@ type ConcurrentMap interface {
 	Swap(key, value any) (previous any, loaded bool)
 }
 
+var (
+	_ ConcurrentMap = (*LockedMap)(nil)
+	_ ConcurrentMap = (*BoxedMap)(nil)
+	_ ConcurrentMap = (*ReadWriteMap)(nil)
+	_ ConcurrentMap = (*SyncMapAdapter)(nil)
+	_ ConcurrentMap = (*HashedMap)(nil)
+)
+
+// pointers, chans, and unsafe.Pointers are always comparable, and compare
+// by identity, but we check the kind so that no-one can pass in a struct
+// by mistake and have it compared by value
+
+func isPointer(v any) bool {
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Pointer, reflect.UnsafePointer, reflect.Chan:
+		return true
+	}
+	return false
+}
+
+func samePointer(a, b any) bool {
+	if !isPointer(a) || reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false
+	}
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+func rangeSorted(m ConcurrentMap, less func(a, b any) bool, f func(key, value any) bool) {
+	var keys []any
+	entries := map[any]any{}
+	m.Range(func(k, v any) bool {
+		keys = append(keys, k)
+		entries[k] = v
+		return true
+	})
+
+	sort.Slice(keys, func(i, j int) bool {
+		return less(keys[i], keys[j])
+	})
+	for _, k := range keys {
+		if !f(k, entries[k]) {
+			break
+		}
+	}
+}
+
+// an entry copied out of a map, for RangeInto
+
+type KV struct {
+	Key, Value any
+}
+
+// after a RangeInto, we drop the references in the buffer, so they can be
+// collected while the caller holds on to it, and hand it back empty
+
+func releaseKV(buf []KV) []KV {
+	clear(buf)
+	return buf[:0]
+}
+
+func rangeErr(m ConcurrentMap, f func(key, value any) error) (err error) {
+	m.Range(func(k, v any) bool {
+		err = f(k, v)
+		return err == nil
+	})
+	return
+}
+
 // A Big Locked Struct
+//
+// Most maps only ever hold one key, so the first key is kept inline, in an
+// atomic pointer, and the map is only made for the second. a Load of the
+// inline key is one atomic load, without a cell. writes still take the
+// LockRing, so the switch over to the map can't race with another write,
+// and it's done in an order that a Load can follow: spilled goes up before
+// single is cleared, so a Load that finds single empty, and spilled still
+// down, knows the map is empty. once a map has spilled, it stays spilled.
+// the inline entry is never changed in place, so storing to it allocates
+// a new one each time, which makes it a win for maps that are read more
+// than written
 
 type LockedMap struct {
-	rb    Roundabout
-	inner map[any]any
+	rb        Roundabout
+	inner     map[any]any
+	single    atomic.Pointer[locked_entry] // the only entry, until spilled
+	spilled   atomic.Bool                  // entries live in inner, not single
+	versions  map[any]uint16               // for inner, once LoadVersioned is used
+	versioned atomic.Bool                  // LoadVersioned has been called
+}
+
+type locked_entry struct {
+	key, value any
+	version    uint16 // the epoch it was written in
+}
+
+// the rest of these are for when we hold a cell, and only writers
+// holding the LockRing change the map, or flip it over to spilled
+
+func (m *LockedMap) get(key any) (value any, ok bool) {
+	if p := m.single.Load(); p != nil {
+		if p.key == key {
+			return p.value, true
+		}
+		return nil, false
+	}
+	value, ok = m.inner[key]
+	return
+}
+
+func (m *LockedMap) set(epoch uint16, key, value any) {
+	if !m.spilled.Load() {
+		if p := m.single.Load(); p == nil || p.key == key {
+			m.single.Store(&locked_entry{key, value, epoch})
+			return
+		}
+		m.spill(8)
+	}
+	if m.inner == nil {
+		m.inner = make(map[any]any, 8)
+	}
+	m.inner[key] = value
+	if m.versions != nil {
+		m.versions[key] = epoch
+	}
+}
+
+func (m *LockedMap) del(key any) {
+	if p := m.single.Load(); p != nil {
+		if p.key == key {
+			m.single.Store(nil)
+		}
+		return
+	}
+	delete(m.inner, key)
+	delete(m.versions, key)
+}
+
+// move the inline entry over to the map, for when we need room for more
+
+func (m *LockedMap) spill(size int) {
+	if m.spilled.Load() {
+		return
+	}
+	if m.inner == nil {
+		m.inner = make(map[any]any, size)
+	}
+	if p := m.single.Load(); p != nil {
+		m.inner[p.key] = p.value
+		if m.versioned.Load() {
+			m.versions = map[any]uint16{p.key: p.version}
+		}
+	}
+	m.spilled.Store(true)
+	m.single.Store(nil)
+}
+
+func (m *LockedMap) length() int {
+	if m.single.Load() != nil {
+		return 1
+	}
+	return len(m.inner)
+}
+
+func (m *LockedMap) each(f func(key, value any) bool) {
+	if p := m.single.Load(); p != nil {
+		f(p.key, p.value)
+		return
+	}
+	for k, v := range m.inner {
+		if !f(k, v) {
+			return
+		}
+	}
 }
 
 func (m *LockedMap) Load(key any) (value any, ok bool) {
@@ -30,8 +203,17 @@ func (m *LockedMap) Load(key any) (value any, ok bool) {
 		return nil, false
 	}
 
+	if p := m.single.Load(); p != nil {
+		if p.key != key || p.value == nil {
+			return nil, false
+		}
+		return p.value, true
+	} else if !m.spilled.Load() {
+		return nil, false
+	}
+
 	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
-		value, ok = m.inner[key]
+		value, ok = m.get(key)
 		return nil
 	})
 	if value == nil {
@@ -42,44 +224,54 @@ func (m *LockedMap) Load(key any) (value any, ok bool) {
 
 func (m *LockedMap) Store(key, value any) {
 	m.rb.LockRing(func(epoch uint16, flags uint16) error {
-		if m.inner == nil {
-			m.inner = make(map[any]any, 8)
-		}
-		m.inner[key] = value
+		m.set(epoch, key, value)
 		return nil
 	})
 
 }
 
-func (m *LockedMap) Swap(key, value any) (previous any, loaded bool) {
+// store all of the entries under one lock, rather than one lock each
+
+func (m *LockedMap) StoreMany(entries map[any]any) {
 	m.rb.LockRing(func(epoch uint16, flags uint16) error {
-		if m.inner == nil {
-			m.inner = make(map[any]any, 8)
+		if len(entries) > 1 {
+			m.spill(len(entries))
 		}
-		previous, loaded = m.inner[key]
-		if !loaded {
-			previous = value
+		for k, v := range entries {
+			m.set(epoch, k, v)
 		}
-		m.inner[key] = value
+		return nil
+	})
+}
+
+// like sync.Map, previous is nil and loaded is false when the key was absent,
+// and a key stored as nil counts as absent
+
+func (m *LockedMap) Swap(key, value any) (previous any, loaded bool) {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		previous, _ = m.get(key)
+		m.set(epoch, key, value)
 		return nil
 	})
 	if previous == nil {
 		return nil, false
 	}
-	return
+	return previous, true
 }
 
+// values are compared with ==, like sync.Map, so pointers are compared by
+// identity, not by what they point to, and an uncomparable old value panics.
+// nil values count as absent, so there's never a nil value to delete, and
+// CompareAndDelete(key, nil) always returns false
+
 func (m *LockedMap) CompareAndDelete(key, old any) (deleted bool) {
 	if old == nil {
 		return false
 	}
 	m.rb.LockRing(func(epoch uint16, flags uint16) error {
-		if m.inner == nil {
-			return nil
-		}
-		v, ok := m.inner[key]
+		v, ok := m.get(key)
 		if ok && v == old {
-			delete(m.inner, key)
+			m.del(key)
 			if v != nil {
 				deleted = true
 			}
@@ -90,20 +282,132 @@ func (m *LockedMap) CompareAndDelete(key, old any) (deleted bool) {
 	return
 }
 
+// an old value of nil means the key must be absent, for insert-if-absent
+
 func (m *LockedMap) CompareAndSwap(key, old, new any) (swapped bool) {
-	if old == nil {
-		return false
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		v, _ := m.get(key)
+		if v == old {
+			m.set(epoch, key, new)
+			swapped = true
+		}
+
+		return nil
+	})
+	return
+}
+
+// Versioned values
+//
+// Every value in a LockedMap is tagged with the epoch of the LockRing that
+// wrote it, and LoadVersioned returns it alongside the value, so that a
+// caller can tell later on whether the key has been written since, and
+// CompareVersionAndSwap only swaps if it hasn't. it's optimistic
+// concurrency, without having to compare the values themselves.
+//
+// The version is the roundabout's epoch, so it wraps, and a key that's
+// written exactly a multiple of 65536 operations later can come back with
+// the same version. it's a check for a read going stale, not a unique id.
+//
+// The inline entry always carries its version, but the map only keeps
+// them once LoadVersioned has been called, so that maps that never use
+// them don't pay for them. the first call takes a LockRing to turn them
+// on, and if the map has already spilled by then, it takes another, and
+// tags every key with its epoch
+
+func (m *LockedMap) LoadVersioned(key any) (value any, version uint16, ok bool) {
+	if m == nil {
+		return nil, 0, false
+	}
+
+	// spill() checks this to keep the inline entry's version, so the first
+	// call sets it under a LockRing, before we look. a spill that's running
+	// finishes first, and one that comes after sees it, so the version we
+	// hand out can't be dropped by a spill in between
+	if !m.versioned.Load() {
+		m.rb.LockRing(func(epoch uint16, flags uint16) error {
+			m.versioned.Store(true)
+			return nil
+		})
+	}
+	if p := m.single.Load(); p != nil {
+		if p.key != key || p.value == nil {
+			return nil, 0, false
+		}
+		return p.value, p.version, true
+	} else if !m.spilled.Load() {
+		return nil, 0, false
+	}
+
+	versioned := false
+	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		if m.versions != nil {
+			versioned = true
+			value, ok = m.get(key)
+			version = m.versions[key]
+		}
+		return nil
+	})
+	if !versioned {
+		m.rb.LockRing(func(epoch uint16, flags uint16) error {
+			value, ok = m.get(key)
+			version = m.version(epoch, key)
+			return nil
+		})
+	}
+	if value == nil {
+		return nil, 0, false
 	}
+	return
+}
+
+// swap in the new value only if the key is present, and hasn't been
+// written since the version was loaded. like Store, a nil new value
+// counts as deleting the key
+
+func (m *LockedMap) CompareVersionAndSwap(key any, version uint16, new any) (swapped bool) {
 	m.rb.LockRing(func(epoch uint16, flags uint16) error {
-		if m.inner == nil {
+		if v, _ := m.get(key); v == nil || m.version(epoch, key) != version {
 			return nil
 		}
-		v, ok := m.inner[key]
-		if ok && v == old {
-			m.inner[key] = new
-			swapped = true
+		m.set(epoch, key, new)
+		swapped = true
+		return nil
+	})
+	return
+}
+
+// the version of a key that's present, for when we hold the LockRing. the
+// first time round, every key in the map is tagged with our epoch, as
+// we know none of them were written after it
+
+func (m *LockedMap) version(epoch uint16, key any) uint16 {
+	if p := m.single.Load(); p != nil {
+		return p.version
+	}
+	if m.versions == nil {
+		m.versions = make(map[any]uint16, len(m.inner))
+		for k := range m.inner {
+			m.versions[k] = epoch
 		}
+	}
+	return m.versions[key]
+}
 
+// like CompareAndDelete, but old must be a pointer, chan, or unsafe.Pointer,
+// and the value is only deleted if it's the same one, of the same type.
+// anything else is never deleted
+
+func (m *LockedMap) CompareAndDeletePtr(key, old any) (deleted bool) {
+	if !isPointer(old) {
+		return false
+	}
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		v, ok := m.get(key)
+		if ok && samePointer(v, old) {
+			m.del(key)
+			deleted = true
+		}
 		return nil
 	})
 	return
@@ -111,21 +415,26 @@ func (m *LockedMap) CompareAndSwap(key, old, new any) (swapped bool) {
 
 func (m *LockedMap) Delete(key any) {
 	m.rb.LockRing(func(epoch uint16, flags uint16) error {
-		if m.inner == nil {
-			return nil
+		m.del(key)
+		return nil
+	})
+}
+
+// delete all of the keys under one lock, rather than one lock each
+
+func (m *LockedMap) DeleteMany(keys []any) {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		for _, k := range keys {
+			m.del(k)
 		}
-		delete(m.inner, key)
 		return nil
 	})
 }
 
 func (m *LockedMap) LoadAndDelete(key any) (value any, loaded bool) {
 	m.rb.LockRing(func(epoch uint16, flags uint16) error {
-		if m.inner == nil {
-			return nil
-		}
-		value, loaded = m.inner[key]
-		delete(m.inner, key)
+		value, loaded = m.get(key)
+		m.del(key)
 		return nil
 	})
 	if value == nil {
@@ -135,20 +444,71 @@ func (m *LockedMap) LoadAndDelete(key any) (value any, loaded bool) {
 
 }
 
+// like sync.Map, returns the existing value and true if the key is present,
+// otherwise stores the value and returns it with false. a key stored with a
+// nil value counts as absent, as it does for Load
+
 func (m *LockedMap) LoadOrStore(key, value any) (actual any, loaded bool) {
 	m.rb.LockRing(func(epoch uint16, flags uint16) error {
-		if m.inner == nil {
+		actual, _ = m.get(key)
+		if actual != nil {
+			loaded = true
 			return nil
 		}
-		actual, loaded = m.inner[key]
-		if !loaded {
-			m.inner[key] = value
+		m.set(epoch, key, value)
+		actual = value
+		return nil
+	})
+	return
+}
+
+// replace the value of every entry that pred matches with update(value),
+// all under one LockRing, so no-one sees some updated and some not, and
+// return how many matched. an update that returns nil deletes the entry.
+// pred and update run while we hold the lock, so they mustn't use the map
+
+func (m *LockedMap) UpdateWhere(pred func(key, value any) bool, update func(value any) any) (updated int) {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		var matched []locked_entry
+		m.each(func(k, v any) bool {
+			if v != nil && pred(k, v) {
+				matched = append(matched, locked_entry{key: k, value: v})
+			}
+			return true
+		})
+		for _, e := range matched {
+			m.set(epoch, e.key, update(e.value))
 		}
+		updated = len(matched)
+		return nil
+	})
+	return
+}
+
+// move the value at src over to dst under one lock, overwriting anything
+// already at dst, and deleting src. returns false, and changes nothing,
+// if src is absent. moving a key onto itself leaves it where it is
+
+func (m *LockedMap) Move(src, dst any) (moved bool) {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		v, _ := m.get(src)
+		if v == nil {
+			return nil
+		}
+		moved = true
+		if src == dst {
+			return nil
+		}
+		// Load reads the inline entry without a cell, so we swap it
+		// over in one store, rather than letting it see neither key
+		if p := m.single.Load(); p != nil && p.key == src {
+			m.single.Store(&locked_entry{dst, v, epoch})
+			return nil
+		}
+		m.del(src)
+		m.set(epoch, dst, v)
 		return nil
 	})
-	if actual == nil {
-		return nil, false
-	}
 	return
 }
 
@@ -157,14 +517,16 @@ func (m *LockedMap) Range(f func(key, value any) bool) {
 	// we make a copy, as go does not have iterators
 	var copy map[any]any
 	m.rb.OrderRing(func(epoch uint16, flags uint16) error {
-		if len(m.inner) == 0 {
+		if m.length() == 0 {
 			return nil
 		}
-		for k, v := range m.inner {
+		copy = make(map[any]any, m.length())
+		m.each(func(k, v any) bool {
 			if v != nil {
 				copy[k] = v
 			}
-		}
+			return true
+		})
 		return nil
 	})
 	for k, v := range copy {
@@ -175,36 +537,199 @@ func (m *LockedMap) Range(f func(key, value any) bool) {
 
 }
 
+// like Range, but the entries are copied into buf rather than a new map,
+// growing it if there isn't room. the buffer is returned empty, to be
+// passed in again next time, so a map that's ranged over often only
+// allocates when it grows
+
+func (m *LockedMap) RangeInto(buf []KV, f func(key, value any) bool) []KV {
+	buf = buf[:0]
+	m.rb.OrderRing(func(epoch uint16, flags uint16) error {
+		buf = slices.Grow(buf, m.length())
+		m.each(func(k, v any) bool {
+			if v != nil {
+				buf = append(buf, KV{k, v})
+			}
+			return true
+		})
+		return nil
+	})
+	for _, e := range buf {
+		if !f(e.Key, e.Value) {
+			break
+		}
+	}
+	return releaseKV(buf)
+}
+
+// visit up to limit entries, starting from the cursor, and return a cursor
+// for the next page, see Cursor. each page takes a brief ShareRing
+
+func (m *LockedMap) RangePage(c Cursor, limit int, f func(key, value any) bool) Cursor {
+	keys := func() (keys []any) {
+		m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+			keys = make([]any, 0, m.length())
+			m.each(func(k, v any) bool {
+				if v != nil {
+					keys = append(keys, k)
+				}
+				return true
+			})
+			return nil
+		})
+		return
+	}
+	load := func(keys []any) []any {
+		values := make([]any, len(keys))
+		m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+			for i, k := range keys {
+				values[i], _ = m.get(k)
+			}
+			return nil
+		})
+		return values
+	}
+	return c.page(limit, f, keys, load)
+}
+
+// like Range, but in the order given by less, for tests and dumps where
+// the order matters. the entries come from the same copy Range makes
+
+func (m *LockedMap) RangeSorted(less func(a, b any) bool, f func(key, value any) bool) {
+	rangeSorted(m, less, f)
+}
+
+// like Range, but the callback returns an error, and the first one stops
+// the iteration and is returned. it ranges over the same copy Range makes
+
+func (m *LockedMap) RangeErr(f func(key, value any) error) error {
+	return rangeErr(m, f)
+}
+
+// stream the map to w as a JSON object, without holding the map for the
+// whole dump, see writeJSON() for what that means for consistency
+
+func (m *LockedMap) WriteJSON(w io.Writer) error {
+	var keys []any
+	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		keys = make([]any, 0, m.length())
+		m.each(func(k, v any) bool {
+			if v != nil {
+				keys = append(keys, k)
+			}
+			return true
+		})
+		return nil
+	})
+	return writeJSON(w, keys, m.Load)
+}
+
+// iterate the live map under a ShareRing, without making a copy. the
+// callback must not call back into the map, as it would deadlock
+// waiting on us, so it panics instead
+
+func (m *LockedMap) RangeSnapshot(f func(key, value any) bool) {
+	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		m.rb.guard("RangeSnapshot", func() {
+			m.each(func(k, v any) bool {
+				return v == nil || f(k, v)
+			})
+		})
+		return nil
+	})
+}
+
+// empty the map, but keep hold of the capacity for reuse
+
 func (m *LockedMap) Clear() {
 	m.rb.LockRing(func(epoch uint16, flags uint16) error {
-		m.inner = make(map[any]any, 8)
+		m.single.Store(nil)
+		clear(m.inner)
+		clear(m.versions)
+		return nil
+	})
+}
+
+// swap the map for an empty one, and return the old one. unlike Clear,
+// we get the old entries back, and writers that come after us land in
+// the new map
+
+func (m *LockedMap) Drain() map[any]any {
+	var old map[any]any
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		if p := m.single.Swap(nil); p != nil {
+			old = map[any]any{p.key: p.value}
+		} else {
+			old = m.inner
+			m.inner = nil
+			m.versions = nil
+		}
+		return nil
+	})
+
+	// no-one else can see the old map, so we can tidy it up outside the lock
+	if old == nil {
+		return map[any]any{}
+	}
+	for k, v := range old {
+		if v == nil {
+			delete(old, k)
+		}
+	}
+	return old
+}
+
+// copy the map into a new one, with a fresh roundabout. the copy is taken
+// under a LockRing, so it's a consistent snapshot, but values are shared
+
+func (m *LockedMap) Clone() *LockedMap {
+	c := &LockedMap{}
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		if m.length() > 1 {
+			c.spill(m.length())
+		}
+		// c hasn't handed out any epochs yet, so its first write can't
+		// be told apart from these by version, but nothing was read before it
+		m.each(func(k, v any) bool {
+			c.set(0, k, v)
+			return true
+		})
 		return nil
 	})
+	return c
 }
 
 // Locked with Update
 
 type BoxedEntry struct {
-	inner atomic.Value
+	inner atomic.Value // always a boxed_value, so nil can be a tombstone
+}
+
+// atomic.Value won't store nil, or values of different types,
+// so we wrap everything in the same struct
+
+type boxed_value struct {
+	value any
 }
 
 func (b *BoxedEntry) Load() any {
-	return b.inner.Load()
+	v, _ := b.inner.Load().(boxed_value)
+	return v.value
 }
 
 func (b *BoxedEntry) Store(o any) {
-	b.inner.Store(o)
+	b.inner.Store(boxed_value{o})
 }
 
 func (b *BoxedEntry) CompareAndSwap(old any, new any) bool {
 	if old == nil {
 		return false
 	}
-	return b.inner.CompareAndSwap(old, new)
+	return b.inner.CompareAndSwap(boxed_value{old}, boxed_value{new})
 }
 
 func (b *BoxedEntry) Delete() {
-	b.inner.Store(nil)
+	b.inner.Store(boxed_value{})
 }
 
 type BoxedMap struct {
@@ -235,37 +760,96 @@ func (m *BoxedMap) init() {
 	m.inner = make(map[any]*BoxedEntry, 8)
 }
 
+// a go map can't be written while it's being read, even when the write
+// doesn't grow it, so adding a key always needs a LockRing. but entries
+// are atomic, so changing one that's already there only needs an OrderRing,
+// which keeps out other writers, but lets readers carry on.
+//
+// update() tries that, and returns false if the key is missing, and the
+// caller needs to take the LockRing. that's two trips for a new key, but
+// one that doesn't stop readers for an existing one
+
+func (m *BoxedMap) update(key any, fn func(v *BoxedEntry)) (found bool) {
+	m.rb.OrderRing(func(epoch uint16, flags uint16) error {
+		if v := m.inner[key]; v != nil {
+			fn(v)
+			found = true
+		}
+		return nil
+	})
+	return
+}
+
 func (m *BoxedMap) Store(key, value any) {
-	// XXX look up in map first, then store if not found
-	// else reuse BoxedEntry
+	if m.update(key, func(v *BoxedEntry) { v.Store(value) }) {
+		return
+	}
 
 	m.rb.LockRing(func(epoch uint16, flags uint16) error {
 		if m.inner == nil {
 			m.init()
 		}
-		v := new(BoxedEntry)
+		// someone may have added it since we looked
+		v := m.inner[key]
+		if v == nil {
+			v = new(BoxedEntry)
+			m.inner[key] = v
+		}
 		v.Store(value)
-		m.inner[key] = v
 		return nil
 	})
-
 }
 
-func (m *BoxedMap) Swap(key, value any) (previous any, loaded bool) {
+// store all of the entries under one lock, boxing them up beforehand
+// to keep the time spent in the lock short
+
+func (m *BoxedMap) StoreMany(entries map[any]any) {
+	boxes := make(map[any]*BoxedEntry, len(entries))
+	for k, v := range entries {
+		b := new(BoxedEntry)
+		b.Store(v)
+		boxes[k] = b
+	}
+
 	m.rb.LockRing(func(epoch uint16, flags uint16) error {
 		if m.inner == nil {
 			m.init()
 		}
+		for k, b := range boxes {
+			m.inner[k] = b
+		}
+		return nil
+	})
+}
 
-		v, loaded := m.inner[key]
-		if loaded && v != nil {
+// like sync.Map, previous is nil and loaded is false when the key was absent,
+// and a tombstoned or nil entry counts as absent
+
+func (m *BoxedMap) Swap(key, value any) (previous any, loaded bool) {
+	found := m.update(key, func(v *BoxedEntry) {
+		previous = v.Load()
+		v.Store(value)
+	})
+	if found {
+		if previous == nil {
+			return nil, false
+		}
+		return previous, true
+	}
+
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		if m.inner == nil {
+			m.init()
+		}
+
+		v, ok := m.inner[key]
+		if ok && v != nil {
 			previous = v.Load()
 			v.Store(value)
 		} else {
 			v := new(BoxedEntry)
 			v.Store(value)
 			m.inner[key] = v
-			previous = value
 		}
 
 		return nil
@@ -273,7 +857,7 @@ func (m *BoxedMap) Swap(key, value any) (previous any, loaded bool) {
 	if previous == nil {
 		return nil, false
 	}
-	return
+	return previous, true
 }
 
 func (m *BoxedMap) CompareAndDelete(key, old any) (deleted bool) {
@@ -297,7 +881,32 @@ func (m *BoxedMap) CompareAndDelete(key, old any) (deleted bool) {
 	return
 }
 
+// an old value of nil means the key must be absent, for insert-if-absent
+
 func (m *BoxedMap) CompareAndSwap(key, old any, newv any) (swapped bool) {
+	if old == nil {
+		// we might have to insert a new box, so we need the whole ring
+		m.rb.LockRing(func(epoch uint16, flags uint16) error {
+			if m.inner == nil {
+				m.init()
+			}
+			v, ok := m.inner[key]
+			if ok && v != nil {
+				if v.Load() == nil {
+					v.Store(newv)
+					swapped = true
+				}
+				return nil
+			}
+			v = new(BoxedEntry)
+			v.Store(newv)
+			m.inner[key] = v
+			swapped = true
+			return nil
+		})
+		return
+	}
+
 	m.rb.OrderRing(func(epoch uint16, flags uint16) error {
 		if m.inner == nil {
 			return nil
@@ -312,6 +921,28 @@ func (m *BoxedMap) CompareAndSwap(key, old any, newv any) (swapped bool) {
 	return
 }
 
+// like LockedMap.CompareAndDeletePtr, comparing the value inside the box
+
+func (m *BoxedMap) CompareAndDeletePtr(key, old any) (deleted bool) {
+	if !isPointer(old) {
+		return false
+	}
+	m.rb.OrderRing(func(epoch uint16, flags uint16) error {
+		if m.inner == nil {
+			return nil
+		}
+		v, ok := m.inner[key]
+		if ok && v != nil {
+			value := v.Load()
+			if samePointer(value, old) {
+				deleted = v.CompareAndSwap(value, nil)
+			}
+		}
+		return nil
+	})
+	return
+}
+
 func (m *BoxedMap) Delete(key any) {
 	// if delete put tombstone in atomic value, this
 	// could be shared write
@@ -327,44 +958,128 @@ func (m *BoxedMap) Delete(key any) {
 	})
 }
 
+// tombstone all of the keys under one lock, rather than one lock each
+
+func (m *BoxedMap) DeleteMany(keys []any) {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		if m.inner == nil {
+			return nil
+		}
+		for _, k := range keys {
+			v, ok := m.inner[k]
+			if ok && v != nil {
+				v.Delete()
+			}
+		}
+		return nil
+	})
+}
+
 func (m *BoxedMap) LoadAndDelete(key any) (value any, loaded bool) {
 	m.rb.OrderRing(func(epoch uint16, flags uint16) error {
 		if m.inner == nil {
 			return nil
 		}
+		// we tombstone rather than delete, as the OrderRing
+		// doesn't keep readers out of the map
 		v, ok := m.inner[key]
 		if ok && v != nil {
 			value = v.Load()
-			loaded = ok
 			v.Delete()
 		}
-
-		delete(m.inner, key)
 		return nil
 	})
 	if value == nil {
-		return nil, loaded
+		return nil, false
 	}
-	return
-
+	return value, true
 }
 
+// like sync.Map, returns the existing value and true if the key is present,
+// otherwise stores the value and returns it with false. a tombstoned or
+// nil entry counts as absent, and the box gets reused
+
 func (m *BoxedMap) LoadOrStore(key, value any) (actual any, loaded bool) {
+	found := m.update(key, func(v *BoxedEntry) {
+		actual = v.Load()
+		if actual != nil {
+			loaded = true
+		} else {
+			v.Store(value)
+			actual = value
+		}
+	})
+	if found {
+		return
+	}
+
 	m.rb.LockRing(func(epoch uint16, flags uint16) error {
 		if m.inner == nil {
-			return nil
+			m.init()
 		}
 		v, ok := m.inner[key]
 		if ok && v != nil {
 			actual = v.Load()
-			loaded = actual != nil
+			if actual != nil {
+				loaded = true
+				return nil
+			}
+		} else {
+			v = new(BoxedEntry)
+			m.inner[key] = v
 		}
+		v.Store(value)
+		actual = value
+		return nil
+	})
+	return
+}
 
-		if !loaded {
-			actual = value
-			// this could be two operations
-			m.inner[key].Store(value)
+// like LockedMap.UpdateWhere. the boxes are atomic, but we still take the
+// LockRing rather than an OrderRing, so that readers see every update or
+// none of them
+
+func (m *BoxedMap) UpdateWhere(pred func(key, value any) bool, update func(value any) any) (updated int) {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		for k, v := range m.inner {
+			if v == nil {
+				continue
+			}
+			if a := v.Load(); a != nil && pred(k, a) {
+				v.Store(update(a))
+				updated++
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// like LockedMap.Move. we need the LockRing, rather than an OrderRing,
+// as readers would otherwise see both boxes change one after the other,
+// and we might need to add a box for dst
+
+func (m *BoxedMap) Move(src, dst any) (moved bool) {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		from := m.inner[src]
+		if from == nil {
+			return nil
+		}
+		value := from.Load()
+		if value == nil {
+			return nil
+		}
+		moved = true
+		if src == dst {
+			return nil
 		}
+		to := m.inner[dst]
+		if to == nil {
+			to = new(BoxedEntry)
+			m.inner[dst] = to
+		}
+		to.Store(value)
+		from.Delete()
 		return nil
 	})
 	return
@@ -382,6 +1097,7 @@ func (m *BoxedMap) Range(f func(key, value any) bool) {
 		if len(m.inner) == 0 {
 			return nil
 		}
+		copy = make(map[any]any, len(m.inner))
 		for k, v := range m.inner {
 			var a any
 			if v != nil {
@@ -401,53 +1117,606 @@ func (m *BoxedMap) Range(f func(key, value any) bool) {
 
 }
 
+// like LockedMap.RangeInto
+
+func (m *BoxedMap) RangeInto(buf []KV, f func(key, value any) bool) []KV {
+	buf = buf[:0]
+	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		buf = slices.Grow(buf, len(m.inner))
+		for k, v := range m.inner {
+			var a any
+			if v != nil {
+				a = v.Load()
+			}
+			if a != nil {
+				buf = append(buf, KV{k, a})
+			}
+		}
+		return nil
+	})
+	for _, e := range buf {
+		if !f(e.Key, e.Value) {
+			break
+		}
+	}
+	return releaseKV(buf)
+}
+
+// iterate the live map under a ShareRing, without making a copy. the
+// callback must not call back into the map, as it would deadlock
+// waiting on us, so it panics instead
+
+func (m *BoxedMap) RangeSnapshot(f func(key, value any) bool) {
+	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		m.rb.guard("RangeSnapshot", func() {
+			for k, v := range m.inner {
+				var a any
+				if v != nil {
+					a = v.Load()
+				}
+				if a != nil && !f(k, a) {
+					break
+				}
+			}
+		})
+		return nil
+	})
+}
+
+// like LockedMap.RangePage
+
+func (m *BoxedMap) RangePage(c Cursor, limit int, f func(key, value any) bool) Cursor {
+	keys := func() (keys []any) {
+		m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+			keys = make([]any, 0, len(m.inner))
+			for k, v := range m.inner {
+				if v != nil && v.Load() != nil {
+					keys = append(keys, k)
+				}
+			}
+			return nil
+		})
+		return
+	}
+	load := func(keys []any) []any {
+		values := make([]any, len(keys))
+		m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+			for i, k := range keys {
+				if v := m.inner[k]; v != nil {
+					values[i] = v.Load()
+				}
+			}
+			return nil
+		})
+		return values
+	}
+	return c.page(limit, f, keys, load)
+}
+
+func (m *BoxedMap) RangeSorted(less func(a, b any) bool, f func(key, value any) bool) {
+	rangeSorted(m, less, f)
+}
+
+func (m *BoxedMap) RangeErr(f func(key, value any) error) error {
+	return rangeErr(m, f)
+}
+
+// like LockedMap.WriteJSON
+
+func (m *BoxedMap) WriteJSON(w io.Writer) error {
+	var keys []any
+	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		keys = make([]any, 0, len(m.inner))
+		for k, v := range m.inner {
+			if v != nil && v.Load() != nil {
+				keys = append(keys, k)
+			}
+		}
+		return nil
+	})
+	return writeJSON(w, keys, m.Load)
+}
+
+// the map's roundabout is its own, so it can use whichever flags it likes.
+// this one is set while SnapshotRCU is loading values
+
+const snapshotFlag uint16 = 1
+
+// a copy of the map, taken without holding writers off for long. we raise
+// a fence, so every write that started before the call has finished, copy
+// the boxes out under a brief ShareRing, and then load each value with
+// writers carrying on around us. what it promises:
+//
+// - every write that started before SnapshotRCU is in the snapshot, or a
+//   later write to the same key is
+// - each value is one its key held at some point during the call, never a
+//   torn or made up one, but two keys written together can show one old and
+//   one new value
+// - a key added during the call may or may not be there
+//
+// while the flag is up, Clear and Drain tombstone the boxes rather than
+// dropping the map, so that a clear is seen by the keys we're yet to load
+
+func (m *BoxedMap) SnapshotRCU() map[any]any {
+	var out map[any]any
+	m.rb.Fence(snapshotFlag, func(epoch uint16, flags uint16) error {
+		var keys []any
+		var boxes []*BoxedEntry
+		m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+			keys = make([]any, 0, len(m.inner))
+			boxes = make([]*BoxedEntry, 0, len(m.inner))
+			for k, v := range m.inner {
+				if v != nil {
+					keys = append(keys, k)
+					boxes = append(boxes, v)
+				}
+			}
+			return nil
+		})
+
+		out = make(map[any]any, len(keys))
+		for i, v := range boxes {
+			if a := v.Load(); a != nil {
+				out[keys[i]] = a
+			}
+		}
+		return nil
+	})
+	return out
+}
+
+// empty the map, but keep hold of the capacity for reuse
+
 func (m *BoxedMap) Clear() {
 	m.rb.LockRing(func(epoch uint16, flags uint16) error {
-		m.init()
+		if flags&snapshotFlag != 0 {
+			for _, v := range m.inner {
+				if v != nil {
+					v.Delete()
+				}
+			}
+			return nil
+		}
+		clear(m.inner)
 		return nil
 	})
 }
 
+// swap the map for an empty one, and return the values from the old one
+
+func (m *BoxedMap) Drain() map[any]any {
+	var old map[any]*BoxedEntry
+	var out map[any]any
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		if flags&snapshotFlag != 0 {
+			// take the values out of the boxes, see SnapshotRCU
+			out = make(map[any]any, len(m.inner))
+			for k, v := range m.inner {
+				if v == nil {
+					continue
+				}
+				if a := v.Load(); a != nil {
+					out[k] = a
+				}
+				v.Delete()
+			}
+			return nil
+		}
+		old = m.inner
+		m.inner = nil
+		return nil
+	})
+	if out != nil {
+		return out
+	}
+
+	// every write to the old boxes finished before our LockRing started
+	out = make(map[any]any, len(old))
+	for k, v := range old {
+		var a any
+		if v != nil {
+			a = v.Load()
+		}
+		if a != nil {
+			out[k] = a
+		}
+	}
+	return out
+}
+
+// copy the map into a new one, with a fresh roundabout and fresh boxes,
+// so that updating an entry in one map doesn't change the other
+
+func (m *BoxedMap) Clone() *BoxedMap {
+	c := &BoxedMap{}
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		if m.inner == nil {
+			return nil
+		}
+		c.inner = make(map[any]*BoxedEntry, len(m.inner))
+		for k, v := range m.inner {
+			var a any
+			if v != nil {
+				a = v.Load()
+			}
+			if a != nil {
+				e := new(BoxedEntry)
+				e.Store(a)
+				c.inner[k] = e
+			}
+		}
+		return nil
+	})
+	return c
+}
+
 // sync.Map style, with an unlocked read only copy
+//
+// read is a snapshot of the map that's never written to, only replaced,
+// so a Load that finds its key there takes no cell at all. keys added
+// since the last snapshot go into write, which is a copy of read plus the
+// new keys, and lookups that miss in read fall through to write under a
+// ShareRing. once enough lookups have missed, as many as there are keys
+// in write, write becomes the new read.
+//
+// entries are shared between read and write, so changing or deleting a
+// key that's in read is one atomic op on the entry. a deleted entry stays
+// in read as a tombstone, and when we next copy read into write, we leave
+// it out and mark it expunged, so that a store through read can't bring it
+// back to life in read alone.
+
+type ReadWriteMap struct {
+	rb     Roundabout
+	read   atomic.Pointer[rw_read]
+	write  map[any]*map_entry // only touched under rb, nil when it's the same as read
+	missed atomic.Int64       // lookups that fell through to write since the last promotion
+
+	stats struct {
+		reads      atomic.Uint64
+		readHits   atomic.Uint64
+		misses     atomic.Uint64
+		promotions atomic.Uint64
+	}
+}
+
+type rw_read struct {
+	m       map[any]*map_entry
+	amended bool // write has keys that m doesn't
+}
+
+// nil when deleted, expunged when deleted and missing from write
 
 type map_entry struct {
-	value atomic.Value
+	p atomic.Pointer[any]
 }
 
-type ReadWriteMap struct {
-	rb      Roundabout
-	read    atomic.Pointer[map[any]*map_entry]
-	write   map[any]*map_entry
-	changes map[any]bool // tells us which entries are deleted/new in write
-}
-
-/*
-	promote to read:
-		when misses >= updates
-		with lock, swap write and read
-		then copy changes into new write using changes map
-		dont need to mark expunged, promotion locks any changes being made
-		empty changes
-	insert
-		if write empty, create dict
-		insert into dict, copy to write, read
-		else lookup, then add to write and update changes
-	read
-		load from read, check for dead or nil entry
-		if miss, ShareRing() on write
-	delete
-		if in read, atomically update value to tombstone
-		if not in read, WriteRing to check write
-			and delete value with nil - can't delete unless we're sure it's not in read
-	update
-		if in read, atomically update value
-		if in write, WriteRing ..
-
-	on several misses
-		move write into read, maybe deleting old values
-	on insert
-		copy read into write, skipping deleted record, marking them as dead
-
-	could have a map of deleted[key] in the write bit
-
-*/
+var expunged = new(any)
+
+func entryValue(p *any) (value any, ok bool) {
+	if p == nil || p == expunged || *p == nil {
+		return nil, false
+	}
+	return *p, true
+}
+
+func (e *map_entry) load() (value any, ok bool) {
+	return entryValue(e.p.Load())
+}
+
+// swap the value in, unless the entry has been expunged, as then it's
+// missing from write and a store has to go through the LockRing
+
+func (e *map_entry) trySwap(v *any) (previous *any, ok bool) {
+	for true {
+		p := e.p.Load()
+		if p == expunged {
+			return nil, false
+		}
+		if e.p.CompareAndSwap(p, v) {
+			return p, true
+		}
+	}
+	// huh
+	panic(unreachable("trySwap"))
+}
+
+func (e *map_entry) tryLoadOrStore(v *any) (actual any, loaded, ok bool) {
+	for true {
+		p := e.p.Load()
+		if p == expunged {
+			return nil, false, false
+		}
+		if value, found := entryValue(p); found {
+			return value, true, true
+		}
+		if e.p.CompareAndSwap(p, v) {
+			return *v, false, true
+		}
+	}
+	// huh
+	panic(unreachable("tryLoadOrStore"))
+}
+
+func (e *map_entry) compareAndSwap(old any, v *any) bool {
+	for true {
+		p := e.p.Load()
+		if value, ok := entryValue(p); !ok || value != old {
+			return false
+		}
+		if e.p.CompareAndSwap(p, v) {
+			return true
+		}
+	}
+	// huh
+	panic(unreachable("compareAndSwap"))
+}
+
+func (e *map_entry) compareAndDelete(old any) bool {
+	return e.compareAndSwap(old, nil)
+}
+
+func (e *map_entry) delete() (value any, ok bool) {
+	for true {
+		p := e.p.Load()
+		if p == nil || p == expunged {
+			return nil, false
+		}
+		if e.p.CompareAndSwap(p, nil) {
+			return entryValue(p)
+		}
+	}
+	// huh
+	panic(unreachable("delete"))
+}
+
+// mark a deleted entry as expunged, returning true if it is
+
+func (e *map_entry) expunge() bool {
+	p := e.p.Load()
+	for p == nil {
+		if e.p.CompareAndSwap(nil, expunged) {
+			return true
+		}
+		p = e.p.Load()
+	}
+	return p == expunged
+}
+
+func (m *ReadWriteMap) readOnly() rw_read {
+	if r := m.read.Load(); r != nil {
+		return *r
+	}
+	return rw_read{}
+}
+
+// find the entry for a key, looking in write if it isn't in read. this
+// doesn't count as a miss, only Load decides when to promote
+
+func (m *ReadWriteMap) entry(key any) *map_entry {
+	r := m.readOnly()
+	if e := r.m[key]; e != nil || !r.amended {
+		return e
+	}
+
+	var e *map_entry
+	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		// read may have been replaced while we waited
+		r := m.readOnly()
+		e = r.m[key]
+		if e == nil && r.amended {
+			e = m.write[key]
+		}
+		return nil
+	})
+	return e
+}
+
+// with the LockRing held, find or make the entry for a key in write,
+// copying read into write if we need to
+
+func (m *ReadWriteMap) entryLocked(key any) *map_entry {
+	r := m.readOnly()
+	if e := r.m[key]; e != nil {
+		if e.p.CompareAndSwap(expunged, nil) {
+			m.write[key] = e
+		}
+		return e
+	}
+	if e := m.write[key]; e != nil {
+		return e
+	}
+
+	if !r.amended {
+		m.write = make(map[any]*map_entry, len(r.m)+1)
+		for k, e := range r.m {
+			if !e.expunge() {
+				m.write[k] = e
+			}
+		}
+		m.read.Store(&rw_read{m: r.m, amended: true})
+	}
+	e := new(map_entry)
+	m.write[key] = e
+	return e
+}
+
+// make write the new read, if there have been enough misses since the
+// last time. we check again under the LockRing, as someone may have
+// beaten us to it
+
+func (m *ReadWriteMap) promote() {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		if !m.readOnly().amended || m.missed.Load() < int64(len(m.write)) {
+			return nil
+		}
+		m.read.Store(&rw_read{m: m.write})
+		m.write = nil
+		m.missed.Store(0)
+		m.stats.promotions.Add(1)
+		return nil
+	})
+}
+
+func (m *ReadWriteMap) Load(key any) (value any, ok bool) {
+	if m == nil {
+		return nil, false
+	}
+
+	m.stats.reads.Add(1)
+	r := m.readOnly()
+	if e := r.m[key]; e != nil {
+		m.stats.readHits.Add(1)
+		return e.load()
+	} else if !r.amended {
+		return nil, false
+	}
+
+	var e *map_entry
+	promote := false
+	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		r := m.readOnly()
+		e = r.m[key]
+		if e == nil && r.amended {
+			e = m.write[key]
+			m.stats.misses.Add(1)
+			promote = m.missed.Add(1) >= int64(len(m.write))
+		}
+		return nil
+	})
+	if promote {
+		m.promote()
+	}
+	if e == nil {
+		return nil, false
+	}
+	return e.load()
+}
+
+// a snapshot of the counters: every Load is a read, the ones that found
+// their key in the read copy are hits, and the ones that fell through to
+// the write map are misses. a Load of a key that's nowhere, while there's
+// nothing new in write, is neither. promotions counts the times that the
+// write map replaced the read copy
+
+func (m *ReadWriteMap) Stats() (reads, readHits, misses, promotions uint64) {
+	return m.stats.reads.Load(), m.stats.readHits.Load(), m.stats.misses.Load(), m.stats.promotions.Load()
+}
+
+func (m *ReadWriteMap) Store(key, value any) {
+	m.Swap(key, value)
+}
+
+func (m *ReadWriteMap) Swap(key, value any) (previous any, loaded bool) {
+	v := &value
+	if e := m.readOnly().m[key]; e != nil {
+		if p, ok := e.trySwap(v); ok {
+			return entryValue(p)
+		}
+	}
+
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		previous, loaded = entryValue(m.entryLocked(key).p.Swap(v))
+		return nil
+	})
+	return
+}
+
+func (m *ReadWriteMap) LoadOrStore(key, value any) (actual any, loaded bool) {
+	v := &value
+	if e := m.readOnly().m[key]; e != nil {
+		if actual, loaded, ok := e.tryLoadOrStore(v); ok {
+			return actual, loaded
+		}
+	}
+
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		// we hold the LockRing, so the entry can't be expunged under us
+		actual, loaded, _ = m.entryLocked(key).tryLoadOrStore(v)
+		return nil
+	})
+	return
+}
+
+// an old value of nil means the key must be absent, for insert-if-absent
+
+func (m *ReadWriteMap) CompareAndSwap(key, old, new any) (swapped bool) {
+	if old == nil {
+		_, loaded := m.LoadOrStore(key, new)
+		return !loaded
+	}
+	if e := m.entry(key); e != nil {
+		return e.compareAndSwap(old, &new)
+	}
+	return false
+}
+
+func (m *ReadWriteMap) CompareAndDelete(key, old any) (deleted bool) {
+	if e := m.entry(key); e != nil {
+		return e.compareAndDelete(old)
+	}
+	return false
+}
+
+// a key that's only in write can be removed from it outright, but one
+// that's in read gets a tombstone
+
+func (m *ReadWriteMap) LoadAndDelete(key any) (value any, loaded bool) {
+	r := m.readOnly()
+	e := r.m[key]
+	if e == nil && r.amended {
+		m.rb.LockRing(func(epoch uint16, flags uint16) error {
+			r := m.readOnly()
+			e = r.m[key]
+			if e == nil && r.amended {
+				e = m.write[key]
+				delete(m.write, key)
+			}
+			return nil
+		})
+	}
+	if e == nil {
+		return nil, false
+	}
+	return e.delete()
+}
+
+func (m *ReadWriteMap) Delete(key any) {
+	m.LoadAndDelete(key)
+}
+
+// like sync.Map, we promote write first, so that we can range over a
+// read copy that no-one will change, without holding a cell
+
+func (m *ReadWriteMap) Range(f func(key, value any) bool) {
+	r := m.readOnly()
+	if r.amended {
+		m.rb.LockRing(func(epoch uint16, flags uint16) error {
+			r = m.readOnly()
+			if r.amended {
+				r = rw_read{m: m.write}
+				m.read.Store(&r)
+				m.write = nil
+				m.missed.Store(0)
+				m.stats.promotions.Add(1)
+			}
+			return nil
+		})
+	}
+
+	for k, e := range r.m {
+		if v, ok := e.load(); ok {
+			if !f(k, v) {
+				break
+			}
+		}
+	}
+}
+
+func (m *ReadWriteMap) Clear() {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		m.read.Store(&rw_read{})
+		m.write = nil
+		m.missed.Store(0)
+		return nil
+	})
+}
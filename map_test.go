@@ -1,8 +1,19 @@
 package crow
 
 import (
-	//"fmt"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // reminder:
@@ -32,11 +43,1502 @@ func TestMap(t *testing.T) {
 	//t.Logf()
 }
 
-func BenchMap(b *testing.B) {
-	// setup
+// run every method of the interface, against each implementation
+
+func TestConcurrentMap(t *testing.T) {
+	maps := []ConcurrentMap{&LockedMap{}, &BoxedMap{}, &ReadWriteMap{}, &SyncMapAdapter{}, newHashedMap()}
+
+	for _, m := range maps {
+		testConcurrentMap(t, m)
+	}
+}
+
+func testConcurrentMap(t *testing.T, m ConcurrentMap) {
+	t.Helper()
+	m.Store("a", 1)
+	m.Store("b", 2)
+
+	if v, ok := m.Load("a"); !ok || v != 1 {
+		t.Errorf("%T: Load = %v, %v", m, v, ok)
+	}
+	if prev, loaded := m.Swap("a", 10); !loaded || prev != 1 {
+		t.Errorf("%T: Swap = %v, %v", m, prev, loaded)
+	}
+	if !m.CompareAndSwap("a", 10, 11) || m.CompareAndSwap("a", 10, 12) {
+		t.Errorf("%T: CompareAndSwap", m)
+	}
+	if m.CompareAndDelete("a", 10) || !m.CompareAndDelete("a", 11) {
+		t.Errorf("%T: CompareAndDelete", m)
+	}
+	if actual, loaded := m.LoadOrStore("c", 3); loaded || actual != 3 {
+		t.Errorf("%T: LoadOrStore = %v, %v", m, actual, loaded)
+	}
+	if v, loaded := m.LoadAndDelete("c"); !loaded || v != 3 {
+		t.Errorf("%T: LoadAndDelete = %v, %v", m, v, loaded)
+	}
+
+	m.Store("d", 4)
+	m.Delete("d")
+
+	seen := map[any]any{}
+	m.Range(func(k, v any) bool {
+		seen[k] = v
+		// callbacks are free to use the map
+		m.Store(k, v)
+		return true
+	})
+	if len(seen) != 1 || seen["b"] != 2 {
+		t.Errorf("%T: Range saw %v", m, seen)
+	}
+
+	m.Clear()
+	if _, ok := m.Load("b"); ok {
+		t.Errorf("%T: Clear left values", m)
+	}
+}
+
+func TestLockedMapClone(t *testing.T) {
+	m := &LockedMap{}
+	m.Store("foo", "bar")
+
+	c := m.Clone()
+	c.Store("foo", "baz")
+	c.Store("new", "value")
+
+	if v, _ := m.Load("foo"); v != "bar" {
+		t.Error("clone changed original value", v)
+	}
+	if _, ok := m.Load("new"); ok {
+		t.Error("clone added key to original")
+	}
+	if v, _ := c.Load("foo"); v != "baz" {
+		t.Error("clone missing update", v)
+	}
+
+	e := (&LockedMap{}).Clone()
+	if _, ok := e.Load("foo"); ok {
+		t.Error("clone of empty map has values")
+	}
+}
+
+func TestBoxedMapClone(t *testing.T) {
+	m := &BoxedMap{}
+	m.Store("foo", "bar")
+
+	c := m.Clone()
+	c.Swap("foo", "baz")
+	c.Store("new", "value")
+
+	if v, _ := m.Load("foo"); v != "bar" {
+		t.Error("clone changed original value", v)
+	}
+	if _, ok := m.Load("new"); ok {
+		t.Error("clone added key to original")
+	}
+	if v, _ := c.Load("foo"); v != "baz" {
+		t.Error("clone missing update", v)
+	}
+}
+
+func TestStoreMany(t *testing.T) {
+	entries := map[any]any{"a": 1, "b": 2, "c": 3}
+
+	maps := []interface {
+		StoreMany(map[any]any)
+		Load(any) (any, bool)
+	}{&LockedMap{}, &BoxedMap{}}
+
+	for _, m := range maps {
+		m.StoreMany(entries)
+		m.StoreMany(map[any]any{"c": 4})
+		for k, want := range map[any]any{"a": 1, "b": 2, "c": 4} {
+			if v, ok := m.Load(k); !ok || v != want {
+				t.Errorf("%T: wrong value for %v: %v", m, k, v)
+			}
+		}
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	maps := []interface {
+		StoreMany(map[any]any)
+		DeleteMany([]any)
+		Load(any) (any, bool)
+	}{&LockedMap{}, &BoxedMap{}}
+
+	for _, m := range maps {
+		m.DeleteMany([]any{"a"})
+		m.StoreMany(map[any]any{"a": 1, "b": 2, "c": 3})
+		m.DeleteMany([]any{"a", "c", "missing"})
+
+		for _, k := range []any{"a", "c", "missing"} {
+			if v, ok := m.Load(k); ok {
+				t.Errorf("%T: %v not deleted: %v", m, k, v)
+			}
+		}
+		if v, ok := m.Load("b"); !ok || v != 2 {
+			t.Errorf("%T: unrelated key changed: %v", m, v)
+		}
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	m := &LockedMap{}
+	if _, _, ok := m.LoadVersioned("a"); ok || m.CompareVersionAndSwap("a", 0, 1) {
+		t.Error("absent key has a version")
+	}
+
+	// the inline entry, and then the same again once the map has spilled
+	for _, spilled := range []bool{false, true} {
+		if spilled {
+			for i := range 10 {
+				m.Store(i, i)
+			}
+		}
+		m.Store("a", 1)
+		v, version, ok := m.LoadVersioned("a")
+		if !ok || v != 1 {
+			t.Fatal("wrong value:", v, ok)
+		}
+
+		// a stale version is turned away, and changes nothing
+		if !m.CompareVersionAndSwap("a", version, 2) {
+			t.Fatal("swap with the current version failed, spilled:", spilled)
+		}
+		if m.CompareVersionAndSwap("a", version, 3) {
+			t.Error("swap with a stale version, spilled:", spilled)
+		}
+		v, next, _ := m.LoadVersioned("a")
+		if v != 2 || next == version {
+			t.Error("wrong value after swap:", v, next, version)
+		}
+
+		// writes to other keys leave it alone, writes to it don't
+		m.Store("b", 1)
+		if _, again, _ := m.LoadVersioned("a"); again != next {
+			t.Error("version moved without a write:", again, next)
+		}
+		m.Store("a", 2)
+		if m.CompareVersionAndSwap("a", next, 3) {
+			t.Error("swap after a Store of the same value, spilled:", spilled)
+		}
+
+		// and so do deletes, even if the key comes back
+		_, next, _ = m.LoadVersioned("a")
+		m.Delete("a")
+		if m.CompareVersionAndSwap("a", next, 3) {
+			t.Error("swap of a deleted key")
+		}
+		m.Store("a", 2)
+		if m.CompareVersionAndSwap("a", next, 3) {
+			t.Error("swap of a key deleted and stored again")
+		}
+		m.Delete("b")
+	}
+}
+
+// the first LoadVersioned of an inline entry races with the Store that
+// spills it, and the version it returns still works afterwards
+
+func TestVersionedSpill(t *testing.T) {
+	for range stressed(2000) {
+		m := &LockedMap{}
+		m.Store("a", 1)
+		stored := make(chan bool)
+		go func() {
+			m.Store("b", 1)
+			close(stored)
+		}()
+		_, version, _ := m.LoadVersioned("a")
+		<-stored
+		if !m.CompareVersionAndSwap("a", version, 2) {
+			t.Fatal("version lost to a spill")
+		}
+	}
+}
+
+// an optimistic counter: load, add one, and retry if anyone else got there
+// first, and no increment is lost
+
+func TestVersionedConcurrent(t *testing.T) {
+	for _, keys := range []int{1, 4} {
+		m := &LockedMap{}
+		for k := range keys {
+			m.Store(k, 0)
+		}
+		workers, n := stressedWorkers(4), stressed(200)
+		var wg sync.WaitGroup
+		for w := range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range n {
+					k := (w + i) % keys
+					for true {
+						v, version, _ := m.LoadVersioned(k)
+						if m.CompareVersionAndSwap(k, version, v.(int)+1) {
+							break
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		total := 0
+		for k := range keys {
+			v, _ := m.Load(k)
+			total += v.(int)
+		}
+		if total != workers*n {
+			t.Error("lost increments:", total, "want", workers*n)
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+	maps := []interface {
+		Move(src, dst any) bool
+		Store(key, value any)
+		Load(any) (any, bool)
+	}{&LockedMap{}, &BoxedMap{}}
+
+	for _, m := range maps {
+		if m.Move("a", "b") {
+			t.Errorf("%T: moved a missing key", m)
+		}
+
+		// inline, for LockedMap
+		m.Store("a", 1)
+		if !m.Move("a", "b") {
+			t.Errorf("%T: didn't move", m)
+		}
+		if _, ok := m.Load("a"); ok {
+			t.Errorf("%T: src left behind", m)
+		}
+		if v, ok := m.Load("b"); !ok || v != 1 {
+			t.Errorf("%T: wrong value at dst: %v", m, v)
+		}
+
+		// onto an existing key, which gets overwritten
+		m.Store("c", 3)
+		if !m.Move("c", "b") {
+			t.Errorf("%T: didn't move onto an existing key", m)
+		}
+		if v, ok := m.Load("b"); !ok || v != 3 {
+			t.Errorf("%T: dst not overwritten: %v", m, v)
+		}
+		if _, ok := m.Load("c"); ok {
+			t.Errorf("%T: src left behind", m)
+		}
+
+		// onto itself
+		if !m.Move("b", "b") {
+			t.Errorf("%T: didn't move onto itself", m)
+		}
+		if v, ok := m.Load("b"); !ok || v != 3 {
+			t.Errorf("%T: moving onto itself lost the value: %v", m, v)
+		}
+
+		// a nil value counts as absent
+		m.Store("d", nil)
+		if m.Move("d", "e") {
+			t.Errorf("%T: moved a nil value", m)
+		}
+	}
+}
+
+func TestUpdateWhere(t *testing.T) {
+	maps := []interface {
+		Store(key, value any)
+		Load(any) (any, bool)
+		UpdateWhere(func(key, value any) bool, func(value any) any) int
+	}{&LockedMap{}, &BoxedMap{}}
+
+	even := func(k, v any) bool { return v.(int)%2 == 0 }
+	double := func(v any) any { return v.(int) * 2 }
+
+	for _, m := range maps {
+		if n := m.UpdateWhere(even, double); n != 0 {
+			t.Errorf("%T: updated an empty map: %d", m, n)
+		}
+
+		// inline, for LockedMap
+		m.Store("a", 2)
+		if n := m.UpdateWhere(even, double); n != 1 {
+			t.Errorf("%T: wrong count for one entry: %d", m, n)
+		}
+		if v, _ := m.Load("a"); v != 4 {
+			t.Errorf("%T: inline entry not updated: %v", m, v)
+		}
+
+		for i := range 10 {
+			m.Store(i, i)
+		}
+		if n := m.UpdateWhere(even, double); n != 6 {
+			t.Errorf("%T: wrong count: %d", m, n)
+		}
+		for i := range 10 {
+			want := i
+			if i%2 == 0 {
+				want = i * 2
+			}
+			if v, ok := m.Load(i); !ok || v != want {
+				t.Errorf("%T: wrong value for %d: %v", m, i, v)
+			}
+		}
+
+		// returning nil deletes
+		if n := m.UpdateWhere(func(k, v any) bool { return k == 3 }, func(any) any { return nil }); n != 1 {
+			t.Errorf("%T: wrong count deleting: %d", m, n)
+		}
+		if _, ok := m.Load(3); ok {
+			t.Errorf("%T: nil update didn't delete", m)
+		}
+		if n := m.UpdateWhere(func(k, v any) bool { return k == 3 }, double); n != 0 {
+			t.Errorf("%T: matched a deleted entry: %d", m, n)
+		}
+	}
+}
+
+func TestUpdateWhereConcurrent(t *testing.T) {
+	// readers look at every entry at once, and never see half an update
+	maps := []interface {
+		Store(key, value any)
+		Range(func(key, value any) bool)
+		UpdateWhere(func(key, value any) bool, func(value any) any) int
+	}{&LockedMap{}, &BoxedMap{}}
+
+	all := func(k, v any) bool { return true }
+	inc := func(v any) any { return v.(int) + 1 }
+
+	for _, m := range maps {
+		for i := range 16 {
+			m.Store(i, 0)
+		}
+		stop := make(chan bool)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				m.UpdateWhere(all, inc)
+			}
+		}()
+
+		for range stressed(500) {
+			seen := map[int]bool{}
+			m.Range(func(k, v any) bool {
+				seen[v.(int)] = true
+				return true
+			})
+			if len(seen) != 1 {
+				t.Errorf("%T: saw a partial update: %v", m, seen)
+				break
+			}
+		}
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func TestMoveConcurrent(t *testing.T) {
+	// one value renamed back and forth between two keys, while readers
+	// look at both at once, and must always find exactly one
+	maps := []interface {
+		Move(src, dst any) bool
+		Store(key, value any)
+		Range(func(key, value any) bool)
+	}{&LockedMap{}, &BoxedMap{}}
+
+	for _, m := range maps {
+		m.Store("a", 1)
+		stop := make(chan bool)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys := []any{"a", "b"}
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if !m.Move(keys[i%2], keys[(i+1)%2]) {
+					t.Errorf("%T: lost the value", m)
+					return
+				}
+			}
+		}()
+
+		for range stressed(1000) {
+			found := 0
+			m.Range(func(key, value any) bool {
+				if value == 1 {
+					found++
+				}
+				return true
+			})
+			if found != 1 {
+				t.Errorf("%T: reader saw %d copies", m, found)
+				break
+			}
+		}
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func TestInsertIfAbsent(t *testing.T) {
+	maps := []ConcurrentMap{&LockedMap{}, &BoxedMap{}, &ReadWriteMap{}, &SyncMapAdapter{}, newHashedMap()}
+
+	for _, m := range maps {
+		var wins atomic.Int32
+		var wg sync.WaitGroup
+		for i := range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if m.CompareAndSwap("key", nil, i) {
+					wins.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if wins.Load() != 1 {
+			t.Errorf("%T: %v inserts won", m, wins.Load())
+		}
+		if m.CompareAndSwap("key", nil, "again") {
+			t.Errorf("%T: inserted over an existing key", m)
+		}
+
+		m.Delete("key")
+		if !m.CompareAndSwap("key", nil, "again") {
+			t.Errorf("%T: couldn't insert after delete", m)
+		}
+		if v, _ := m.Load("key"); v != "again" {
+			t.Errorf("%T: wrong value %v", m, v)
+		}
+	}
+}
+
+func TestRangeSnapshot(t *testing.T) {
+	maps := []interface {
+		ConcurrentMap
+		StoreMany(map[any]any)
+		RangeSnapshot(func(key, value any) bool)
+	}{&LockedMap{}, &BoxedMap{}}
+
+	for _, m := range maps {
+		m.StoreMany(map[any]any{"a": 1, "b": 2, "c": 3})
+
+		seen := map[any]any{}
+		m.RangeSnapshot(func(k, v any) bool {
+			seen[k] = v
+			return true
+		})
+		if len(seen) != 3 || seen["b"] != 2 {
+			t.Errorf("%T: wrong entries %v", m, seen)
+		}
+
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("%T: re-entry didn't panic", m)
+				} else {
+					t.Log(r)
+				}
+			}()
+			m.RangeSnapshot(func(k, v any) bool {
+				m.Store(k, "reentered")
+				return true
+			})
+		}()
+
+		// the panic should leave the map usable from this goroutine
+		m.Store("d", 4)
+		if v, _ := m.Load("d"); v != 4 {
+			t.Errorf("%T: map broken after panic", m)
+		}
+	}
+}
+
+func TestClear(t *testing.T) {
+	maps := []ConcurrentMap{&LockedMap{}, &BoxedMap{}, &ReadWriteMap{}, &SyncMapAdapter{}, newHashedMap()}
+
+	for _, m := range maps {
+		m.Clear()
+		m.Store("a", 1)
+		m.Store("b", 2)
+		m.Clear()
+
+		if _, ok := m.Load("a"); ok {
+			t.Errorf("%T: clear left values behind", m)
+		}
+
+		m.Store("c", 3)
+		if v, ok := m.Load("c"); !ok || v != 3 {
+			t.Errorf("%T: map unusable after clear", m)
+		}
+	}
+
+	// one key is kept inline, so we need two to make a map
+	m := &LockedMap{}
+	m.Store("a", 1)
+	m.Store("z", 26)
+	inner := m.inner
+	m.Clear()
+	if len(m.inner) != 0 || len(inner) != 0 {
+		t.Error("clear didn't empty the map")
+	}
+	m.Store("b", 2)
+	if len(inner) != 1 {
+		t.Error("clear didn't reuse the map")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	maps := []interface {
+		ConcurrentMap
+		Drain() map[any]any
+	}{&LockedMap{}, &BoxedMap{}}
+
+	for _, m := range maps {
+		if old := m.Drain(); len(old) != 0 {
+			t.Errorf("%T: empty map drained %v", m, old)
+		}
+
+		m.Store("a", 1)
+		m.Store("b", 2)
+		m.Store("c", nil)
+		old := m.Drain()
+		if len(old) != 2 || old["a"] != 1 || old["b"] != 2 {
+			t.Errorf("%T: wrong entries drained %v", m, old)
+		}
+		if _, ok := m.Load("a"); ok {
+			t.Errorf("%T: drain left values behind", m)
+		}
+
+		// writers racing with a drain end up in exactly one of the maps
+		var wg sync.WaitGroup
+		for w := range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 100 {
+					m.Store(w*100+i, i)
+				}
+			}()
+		}
+		drained := m.Drain()
+		wg.Wait()
+		after := m.Drain()
+
+		for k := range drained {
+			if _, ok := after[k]; ok {
+				t.Errorf("%T: key %v in both maps", m, k)
+			}
+		}
+		if len(drained)+len(after) != 400 {
+			t.Errorf("%T: lost writes, %d + %d", m, len(drained), len(after))
+		}
+	}
+}
+
+func TestCompareAndDeletePtr(t *testing.T) {
+	type point struct{ x, y int }
+
+	maps := []interface {
+		ConcurrentMap
+		CompareAndDeletePtr(key, old any) bool
+	}{&LockedMap{}, &BoxedMap{}}
+
+	for _, m := range maps {
+		a := &point{1, 2}
+		b := &point{1, 2}
+		m.Store("p", a)
+
+		if m.CompareAndDelete("p", b) || m.CompareAndDeletePtr("p", b) {
+			t.Errorf("%T: deleted a deep-equal pointer", m)
+		}
+		if m.CompareAndDeletePtr("p", *a) {
+			t.Errorf("%T: deleted by value", m)
+		}
+		if !m.CompareAndDeletePtr("p", a) {
+			t.Errorf("%T: didn't delete the same pointer", m)
+		}
+		if _, ok := m.Load("p"); ok {
+			t.Errorf("%T: value still there after delete", m)
+		}
+
+		m.Store("v", point{1, 2})
+		if m.CompareAndDeletePtr("v", point{1, 2}) {
+			t.Errorf("%T: deleted a struct value", m)
+		}
+		if m.CompareAndDeletePtr("missing", a) || m.CompareAndDeletePtr("v", nil) {
+			t.Errorf("%T: deleted a missing value", m)
+		}
+	}
+}
+
+func TestRangeSorted(t *testing.T) {
+	maps := []interface {
+		ConcurrentMap
+		RangeSorted(less func(a, b any) bool, f func(key, value any) bool)
+	}{&LockedMap{}, &BoxedMap{}}
+
+	for _, m := range maps {
+		for _, k := range []int{5, 3, 9, 1, 7} {
+			m.Store(k, k*10)
+		}
+		m.Store(4, nil)
+
+		var got []int
+		m.RangeSorted(func(a, b any) bool { return a.(int) < b.(int) }, func(k, v any) bool {
+			if v != k.(int)*10 {
+				t.Errorf("%T: wrong value for %v: %v", m, k, v)
+			}
+			got = append(got, k.(int))
+			return true
+		})
+		if !slices.Equal(got, []int{1, 3, 5, 7, 9}) {
+			t.Errorf("%T: wrong order %v", m, got)
+		}
+
+		got = nil
+		m.RangeSorted(func(a, b any) bool { return a.(int) > b.(int) }, func(k, v any) bool {
+			got = append(got, k.(int))
+			return len(got) < 2
+		})
+		if !slices.Equal(got, []int{9, 7}) {
+			t.Errorf("%T: wrong order or didn't stop %v", m, got)
+		}
+	}
+}
+
+func TestRangeErr(t *testing.T) {
+	maps := []interface {
+		ConcurrentMap
+		RangeErr(f func(key, value any) error) error
+	}{&LockedMap{}, &BoxedMap{}, &SyncMapAdapter{}, newHashedMap()}
+
+	bad := errors.New("bad entry")
+	for _, m := range maps {
+		for i := range 10 {
+			m.Store(i, i)
+		}
+
+		seen := 0
+		err := m.RangeErr(func(k, v any) error {
+			seen++
+			return nil
+		})
+		if err != nil || seen != 10 {
+			t.Errorf("%T: wrong range without errors: %v %d", m, err, seen)
+		}
+
+		seen = 0
+		err = m.RangeErr(func(k, v any) error {
+			seen++
+			if seen == 3 {
+				return fmt.Errorf("key %v: %w", k, bad)
+			}
+			return nil
+		})
+		if !errors.Is(err, bad) || seen != 3 {
+			t.Errorf("%T: didn't stop at the first error: %v %d", m, err, seen)
+		}
+
+		// the callback can change the map, as it's ranging over a copy
+		err = m.RangeErr(func(k, v any) error {
+			m.Delete(k)
+			return nil
+		})
+		if _, ok := m.Load(0); err != nil || ok {
+			t.Errorf("%T: couldn't delete while ranging: %v", m, err)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	maps := []interface {
+		Store(key, value any)
+		Delete(key any)
+		WriteJSON(w io.Writer) error
+	}{&LockedMap{}, &BoxedMap{}}
+
+	for _, m := range maps {
+		var out strings.Builder
+		if err := m.WriteJSON(&out); err != nil || out.String() != "{}" {
+			t.Errorf("%T: empty map: %q %v", m, out.String(), err)
+		}
+
+		want := map[string]any{}
+		for i := range 100 {
+			k := "key " + strconv.Itoa(i)
+			want[k] = float64(i)
+			m.Store(k, i)
+		}
+		m.Store(`"quoted"`, "a <b> & \\")
+		want[`"quoted"`] = "a <b> & \\"
+		m.Store("nested", map[string]any{"list": []any{1.5, "x"}})
+		want["nested"] = map[string]any{"list": []any{1.5, "x"}}
+		m.Delete("key 7")
+		delete(want, "key 7")
+
+		out.Reset()
+		if err := m.WriteJSON(&out); err != nil {
+			t.Fatalf("%T: %v", m, err)
+		}
+		var got map[string]any
+		if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+			t.Fatalf("%T: doesn't parse: %v\n%s", m, err, out.String())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: wrong contents: %v", m, got)
+		}
+
+		// the same keys encoding/json takes, and nothing is written for
+		// a key it doesn't
+		m.Store(12, "twelve")
+		if err := m.WriteJSON(io.Discard); err != nil {
+			t.Errorf("%T: int key: %v", m, err)
+		}
+		m.Store(struct{ a int }{1}, "struct")
+		out.Reset()
+		if err := m.WriteJSON(&out); err == nil || out.Len() != 0 {
+			t.Errorf("%T: struct key written: %v %q", m, err, out.String())
+		}
+	}
+}
+
+type textName string
+
+func (n textName) MarshalText() ([]byte, error) {
+	return []byte("text " + string(n)), nil
+}
+
+type textID struct{ n int }
+
+func (id textID) MarshalText() ([]byte, error) {
+	return []byte(strconv.Itoa(id.n)), nil
+}
+
+// the awkward keys come out the way encoding/json's classic encoder
+// writes them: a string kind wins over MarshalText, and a nil pointer is ""
+
+func TestJSONKey(t *testing.T) {
+	keys := []struct {
+		key  any
+		want string
+	}{
+		{textName("a"), "a"},
+		{textID{7}, "7"},
+		{&textID{7}, "7"},
+		{(*textID)(nil), ""},
+	}
+	for _, k := range keys {
+		if got, err := jsonKey(k.key); err != nil || got != k.want {
+			t.Errorf("%T: got %q %v, want %q", k.key, got, err, k.want)
+		}
+	}
+}
+
+// a dump taken while the map is written to is still valid JSON, with
+// the keys that were never deleted in it
+
+func TestWriteJSONConcurrent(t *testing.T) {
+	m := &BoxedMap{}
+	for i := range 100 {
+		m.Store(strconv.Itoa(i), i)
+	}
+
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; !stop.Load(); i++ {
+			k := strconv.Itoa(100 + i%100)
+			m.Store(k, i)
+			m.Delete(k)
+			m.Store(strconv.Itoa(i%100), i)
+		}
+	}()
+
+	for range stressed(20) {
+		var out strings.Builder
+		if err := m.WriteJSON(&out); err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]int
+		if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+			t.Fatalf("doesn't parse: %v\n%s", err, out.String())
+		}
+		for i := range 100 {
+			if _, ok := got[strconv.Itoa(i)]; !ok {
+				t.Fatal("missing key", i)
+			}
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+}
+
+func TestRangeInto(t *testing.T) {
+	maps := []interface {
+		Store(key, value any)
+		Delete(key any)
+		RangeInto([]KV, func(key, value any) bool) []KV
+	}{&LockedMap{}, &BoxedMap{}}
+
+	for _, m := range maps {
+		var buf []KV
+		buf = m.RangeInto(buf, func(k, v any) bool {
+			t.Errorf("%T: empty map ranged over %v", m, k)
+			return true
+		})
+
+		for i := range 100 {
+			m.Store(i, i*2)
+		}
+		m.Delete(7)
+
+		seen := map[any]any{}
+		buf = m.RangeInto(buf, func(k, v any) bool {
+			seen[k] = v
+			return true
+		})
+		if len(seen) != 99 || seen[7] != nil || seen[10] != 20 {
+			t.Errorf("%T: wrong entries: %v", m, seen)
+		}
+		if len(buf) != 0 || cap(buf) < 99 {
+			t.Errorf("%T: buffer not handed back: %d %d", m, len(buf), cap(buf))
+		}
+		if buf[:cap(buf)][0] != (KV{}) {
+			t.Errorf("%T: buffer still holds entries", m)
+		}
+
+		// the buffer's reused, and stopping early works
+		before := cap(buf)
+		n := 0
+		buf = m.RangeInto(buf, func(k, v any) bool {
+			n++
+			return n < 10
+		})
+		if n != 10 || cap(buf) != before {
+			t.Errorf("%T: wrong early stop or regrown: %d %d", m, n, cap(buf))
+		}
+	}
+}
+
+func TestBoxedMapUpdate(t *testing.T) {
+	m := &BoxedMap{}
+	m.Store("a", 1)
+
+	// hold a reader open, like a long Range
+	held := make(chan bool)
+	release := make(chan bool)
+	go m.rb.ShareRing(func(uint16, uint16) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+
+	// changing an existing entry doesn't wait for it
+	done := make(chan bool)
+	go func() {
+		m.Store("a", 2)
+		m.Swap("a", 3)
+		m.LoadOrStore("a", 4)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("update waited for a reader")
+	}
+
+	// but adding a key does
+	added := make(chan bool)
+	go func() {
+		m.Store("b", 1)
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("insert didn't wait for a reader")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	<-added
+
+	if v, _ := m.Load("a"); v != 3 {
+		t.Error("wrong value after updates", v)
+	}
+}
+
+func TestSnapshotRCU(t *testing.T) {
+	m := &BoxedMap{}
+	for k := range 100 {
+		m.Store(k, k*1000)
+	}
+
+	// each value is key*1000 + a generation, and the writers only go up,
+	// so a snapshot must have every key, with its own value, and at least
+	// the generation stored before the snapshot started
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for gen := 1; !stop.Load(); gen++ {
+				for k := w; k < 100; k += 4 {
+					m.Store(k, k*1000+min(gen, 999))
+				}
+			}
+		}()
+	}
+
+	for range 20 {
+		before := map[any]any{}
+		m.Range(func(k, v any) bool {
+			before[k] = v
+			return true
+		})
+		snap := m.SnapshotRCU()
+		if len(snap) != 100 {
+			t.Fatal("snapshot lost keys", len(snap))
+		}
+		for k, v := range snap {
+			if v.(int)/1000 != k.(int) {
+				t.Error("torn value", k, v)
+			}
+			if v.(int) < before[k].(int) {
+				t.Error("snapshot went backwards", k, v, before[k])
+			}
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	if m.rb.Flags() != 0 {
+		t.Error("snapshot left its flag set", m.rb.Flags())
+	}
+}
+
+func TestSnapshotRCUClear(t *testing.T) {
+	m := &BoxedMap{}
+	m.Store("a", 1)
+	m.Store("b", 2)
+
+	// with the flag up, clearing tombstones the boxes the snapshot holds
+	m.rb.Fence(snapshotFlag, func(epoch uint16, flags uint16) error {
+		box := m.inner["a"]
+		m.Clear()
+		if len(m.inner) != 2 || box.Load() != nil {
+			t.Error("clear dropped the map during a snapshot")
+		}
+		return nil
+	})
+	if _, ok := m.Load("a"); ok {
+		t.Error("clear didn't clear")
+	}
+
+	m.Store("c", 3)
+	m.rb.Fence(snapshotFlag, func(epoch uint16, flags uint16) error {
+		box := m.inner["c"]
+		got := m.Drain()
+		if len(got) != 1 || got["c"] != 3 || box.Load() != nil {
+			t.Error("drain dropped the map during a snapshot", got)
+		}
+		return nil
+	})
+	if len(m.SnapshotRCU()) != 0 {
+		t.Error("drained map isn't empty")
+	}
+}
+
+func TestBoxedMapUpdateConcurrent(t *testing.T) {
+	m := &BoxedMap{}
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 300 {
+				k := i % 30
+				switch (w + i) % 5 {
+				case 0:
+					m.Store(k, i)
+				case 1:
+					m.Swap(k, i)
+				case 2:
+					m.LoadOrStore(k, i)
+				case 3:
+					m.Delete(k)
+				case 4:
+					m.Range(func(k, v any) bool { return true })
+				}
+				m.Load(k)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLockedMapInline(t *testing.T) {
+	m := &LockedMap{}
+	m.Store("a", 1)
+	m.Store("a", 2)
+	if m.inner != nil || m.spilled.Load() {
+		t.Fatal("one key made a map")
+	}
+	if v, ok := m.Load("a"); !ok || v != 2 {
+		t.Error("wrong inline value", v, ok)
+	}
+	if _, ok := m.Load("b"); ok {
+		t.Error("found a missing key")
+	}
+	if v, loaded := m.LoadAndDelete("a"); !loaded || v != 2 {
+		t.Error("wrong LoadAndDelete", v, loaded)
+	}
+	m.Store("b", 3)
+	if m.spilled.Load() {
+		t.Error("replacing the only key made a map")
+	}
+
+	// the second key moves the first into the map, and it stays there
+	m.Store("c", 4)
+	if !m.spilled.Load() || m.single.Load() != nil || len(m.inner) != 2 {
+		t.Fatal("second key didn't spill", m.inner)
+	}
+	m.Delete("c")
+	if v, ok := m.Load("b"); !ok || v != 3 {
+		t.Error("lost the inline key", v, ok)
+	}
+	if c := m.Clone(); c.spilled.Load() {
+		t.Error("clone of one key made a map")
+	}
+}
+
+func TestLockedMapSpillConcurrent(t *testing.T) {
+	// readers of the first key mustn't lose it while the map spills
+	for range 50 {
+		m := &LockedMap{}
+		m.Store(0, 0)
+		var wg sync.WaitGroup
+		for range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 50 {
+					if v, ok := m.Load(0); !ok || v != 0 {
+						t.Error("lost the first key", v, ok)
+						return
+					}
+				}
+			}()
+		}
+		for i := 1; i < 10; i++ {
+			m.Store(i, i)
+		}
+		wg.Wait()
+	}
+}
+
+func TestLoadOrStore(t *testing.T) {
+	maps := []ConcurrentMap{&LockedMap{}, &BoxedMap{}, &ReadWriteMap{}, &SyncMapAdapter{}, newHashedMap()}
+
+	for _, m := range maps {
+		if actual, loaded := m.LoadOrStore("a", 1); loaded || actual != 1 {
+			t.Errorf("%T: first LoadOrStore = %v, %v", m, actual, loaded)
+		}
+		if actual, loaded := m.LoadOrStore("a", 2); !loaded || actual != 1 {
+			t.Errorf("%T: second LoadOrStore = %v, %v", m, actual, loaded)
+		}
+
+		// nil values are absent, so get replaced
+		m.Store("nil", nil)
+		if actual, loaded := m.LoadOrStore("nil", 3); loaded || actual != 3 {
+			t.Errorf("%T: LoadOrStore over nil = %v, %v", m, actual, loaded)
+		}
+
+		m.Delete("a")
+		if actual, loaded := m.LoadOrStore("a", 4); loaded || actual != 4 {
+			t.Errorf("%T: LoadOrStore after delete = %v, %v", m, actual, loaded)
+		}
+	}
+}
+
+func TestSwap(t *testing.T) {
+	maps := []ConcurrentMap{&LockedMap{}, &BoxedMap{}, &ReadWriteMap{}, &SyncMapAdapter{}, newHashedMap()}
+
+	for _, m := range maps {
+		if prev, loaded := m.Swap("a", 1); loaded || prev != nil {
+			t.Errorf("%T: Swap on absent key = %v, %v", m, prev, loaded)
+		}
+		if prev, loaded := m.Swap("a", 2); !loaded || prev != 1 {
+			t.Errorf("%T: Swap on present key = %v, %v", m, prev, loaded)
+		}
+		if prev, loaded := m.Swap("a", nil); !loaded || prev != 2 {
+			t.Errorf("%T: Swap to nil = %v, %v", m, prev, loaded)
+		}
+		if prev, loaded := m.Swap("a", 3); loaded || prev != nil {
+			t.Errorf("%T: Swap over nil = %v, %v", m, prev, loaded)
+		}
+		if v, _ := m.Load("a"); v != 3 {
+			t.Errorf("%T: wrong value after Swap %v", m, v)
+		}
+	}
+}
+
+func TestLoadOrStoreConcurrent(t *testing.T) {
+	maps := []ConcurrentMap{&LockedMap{}, &BoxedMap{}, &ReadWriteMap{}, &SyncMapAdapter{}, newHashedMap()}
+
+	for _, m := range maps {
+		var stored atomic.Int32
+		var wg sync.WaitGroup
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				actual, loaded := m.LoadOrStore("key", i)
+				if !loaded {
+					stored.Add(1)
+				}
+				if v, _ := m.Load("key"); v != actual {
+					t.Errorf("%T: LoadOrStore returned %v, map has %v", m, actual, v)
+				}
+			}()
+		}
+		wg.Wait()
+		if stored.Load() != 1 {
+			t.Errorf("%T: %v goroutines stored", m, stored.Load())
+		}
+	}
+}
+
+// adapted from sync.Map's TestMapMatchesRWMutex, using sync.Map itself
+// as the reference, and leaving out nil values, which we treat as absent
+
+func TestMatchesSyncMap(t *testing.T) {
+	maps := []ConcurrentMap{&LockedMap{}, &BoxedMap{}, &ReadWriteMap{}, &SyncMapAdapter{}, newHashedMap()}
+
+	for _, m := range maps {
+		var ref sync.Map
+		r := rand.New(rand.NewPCG(1, 2))
+
+		for i := range 2000 {
+			k, v := r.IntN(16), r.IntN(4)
+			var got, want [2]any
+			switch op := r.IntN(7); op {
+			case 0:
+				got[0], got[1] = m.Load(k)
+				want[0], want[1] = ref.Load(k)
+			case 1:
+				m.Store(k, v)
+				ref.Store(k, v)
+			case 2:
+				got[0], got[1] = m.LoadOrStore(k, v)
+				want[0], want[1] = ref.LoadOrStore(k, v)
+			case 3:
+				got[0], got[1] = m.LoadAndDelete(k)
+				want[0], want[1] = ref.LoadAndDelete(k)
+			case 4:
+				m.Delete(k)
+				ref.Delete(k)
+			case 5:
+				got[0] = m.CompareAndDelete(k, v)
+				want[0] = ref.CompareAndDelete(k, v)
+			case 6:
+				got[0], got[1] = m.Swap(k, v)
+				want[0], want[1] = ref.Swap(k, v)
+			}
+			if got != want {
+				t.Fatalf("%T: step %v: got %v, want %v", m, i, got, want)
+			}
+		}
+	}
+}
+
+// nil values are where a plain sync.Map differs, so we run the same steps
+// against a LockedMap and the adapter, and they should agree
+
+func TestSyncMapAdapterNil(t *testing.T) {
+	type step struct {
+		name string
+		fn   func(m ConcurrentMap) [2]any
+	}
+	steps := []step{
+		{"store nil", func(m ConcurrentMap) [2]any { m.Store("a", nil); return [2]any{} }},
+		{"load nil", func(m ConcurrentMap) [2]any { v, ok := m.Load("a"); return [2]any{v, ok} }},
+		{"insert", func(m ConcurrentMap) [2]any { return [2]any{m.CompareAndSwap("a", nil, 1)} }},
+		{"insert again", func(m ConcurrentMap) [2]any { return [2]any{m.CompareAndSwap("a", nil, 2)} }},
+		{"delete nil", func(m ConcurrentMap) [2]any { return [2]any{m.CompareAndDelete("a", nil)} }},
+		{"load or store nil", func(m ConcurrentMap) [2]any { v, ok := m.LoadOrStore("a", nil); return [2]any{v, ok} }},
+		{"swap nil", func(m ConcurrentMap) [2]any { v, ok := m.Swap("a", nil); return [2]any{v, ok} }},
+		{"load swapped", func(m ConcurrentMap) [2]any { v, ok := m.Load("a"); return [2]any{v, ok} }},
+		{"load or store nil absent", func(m ConcurrentMap) [2]any { v, ok := m.LoadOrStore("b", nil); return [2]any{v, ok} }},
+		{"swap absent", func(m ConcurrentMap) [2]any { v, ok := m.Swap("b", nil); return [2]any{v, ok} }},
+		{"nil to nil", func(m ConcurrentMap) [2]any { return [2]any{m.CompareAndSwap("c", nil, nil)} }},
+		{"store", func(m ConcurrentMap) [2]any { m.Store("c", 3); return [2]any{} }},
+		{"swap to nil", func(m ConcurrentMap) [2]any { return [2]any{m.CompareAndSwap("c", 3, nil)} }},
+		{"load deleted", func(m ConcurrentMap) [2]any { v, ok := m.Load("c"); return [2]any{v, ok} }},
+		{"range", func(m ConcurrentMap) [2]any {
+			n := 0
+			m.Range(func(k, v any) bool { n++; return true })
+			return [2]any{n}
+		}},
+	}
+
+	want, got := &LockedMap{}, &SyncMapAdapter{}
+	for _, s := range steps {
+		if w, g := s.fn(want), s.fn(got); w != g {
+			t.Errorf("%s: got %v, want %v", s.name, g, w)
+		}
+	}
+}
+
+func TestBoxedEntry(t *testing.T) {
+	b := &BoxedEntry{}
+	if b.Load() != nil {
+		t.Error("empty entry has a value")
+	}
+	b.Store("one")
+	b.Store(2)
+	if !b.CompareAndSwap(2, "three") || b.Load() != "three" {
+		t.Error("compare and swap failed")
+	}
+	b.Delete()
+	if b.Load() != nil {
+		t.Error("deleted entry has a value")
+	}
+}
+
+func TestReadWriteMapStats(t *testing.T) {
+	m := &ReadWriteMap{}
+	for i := range 4 {
+		m.Store(i, i)
+	}
+
+	// nothing's been promoted, so every hit is a miss in read, and the
+	// fourth miss promotes write, as there are four keys
+	for i := range 4 {
+		if v, ok := m.Load(i); !ok || v != i {
+			t.Error("wrong value", i, v, ok)
+		}
+	}
+	reads, hits, misses, promotions := m.Stats()
+	if reads != 4 || hits != 0 || misses != 4 || promotions != 1 {
+		t.Error("wrong stats after misses", reads, hits, misses, promotions)
+	}
+
+	// now they're all in read, and a missing key is neither
+	for i := range 5 {
+		m.Load(i)
+	}
+	reads, hits, misses, promotions = m.Stats()
+	if reads != 9 || hits != 4 || misses != 4 || promotions != 1 {
+		t.Error("wrong stats after hits", reads, hits, misses, promotions)
+	}
+
+	// a new key misses until it's promoted, and a missing key misses too
+	// while there's a write map to look in
+	m.Store(4, 4)
+	m.Load(4)
+	m.Load(5)
+	reads, hits, misses, promotions = m.Stats()
+	if reads != 11 || hits != 4 || misses != 6 || promotions != 1 {
+		t.Error("wrong stats after a store", reads, hits, misses, promotions)
+	}
+}
+
+func TestReadWriteMapExpunged(t *testing.T) {
+	m := &ReadWriteMap{}
+	m.Store("a", 1)
+	m.Store("b", 2)
+	m.Range(func(k, v any) bool { return true }) // promotes write
+
+	// a is tombstoned in read, then expunged when c is added
+	m.Delete("a")
+	m.Store("c", 3)
+	if e := m.readOnly().m["a"]; e == nil || e.p.Load() != expunged {
+		t.Fatal("a wasn't expunged")
+	}
+
+	// storing it again has to put it back in write, or promotion loses it
+	m.Store("a", 4)
+	m.Range(func(k, v any) bool { return true })
+	if v, ok := m.Load("a"); !ok || v != 4 {
+		t.Error("expunged entry lost", v, ok)
+	}
+	if v, ok := m.Load("c"); !ok || v != 3 {
+		t.Error("new entry lost", v, ok)
+	}
+}
+
+// one key, kept inline, against the same key in a map
+
+func BenchmarkLockedMapSingle(b *testing.B) {
+	inline := &LockedMap{}
+	inline.Store("key", 1)
+	spilled := &LockedMap{}
+	spilled.Store("key", 1)
+	spilled.Store("other", 2)
+	spilled.Delete("other")
+
+	for _, m := range []struct {
+		name string
+		m    *LockedMap
+	}{{"inline", inline}, {"map", spilled}} {
+		b.Run("Load/"+m.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					m.m.Load("key")
+				}
+			})
+		})
+		b.Run("Store/"+m.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m.m.Store("key", i)
+			}
+		})
+	}
+}
+
+func bulkEntries() map[any]any {
+	entries := make(map[any]any, 10000)
+	for i := range 10000 {
+		entries[i] = i
+	}
+	return entries
+}
+
+func BenchmarkLockedMapStoreMany(b *testing.B) {
+	entries := bulkEntries()
 	b.ResetTimer()
 	for range b.N {
+		m := &LockedMap{}
+		m.StoreMany(entries)
+	}
+}
+
+func BenchmarkLockedMapStoreLoop(b *testing.B) {
+	entries := bulkEntries()
+	b.ResetTimer()
+	for range b.N {
+		m := &LockedMap{}
+		for k, v := range entries {
+			m.Store(k, v)
+		}
+	}
+}
+
+func BenchmarkBoxedMapStoreMany(b *testing.B) {
+	entries := bulkEntries()
+	b.ResetTimer()
+	for range b.N {
+		m := &BoxedMap{}
+		m.StoreMany(entries)
+	}
+}
+
+func BenchmarkBoxedMapStoreLoop(b *testing.B) {
+	entries := bulkEntries()
+	b.ResetTimer()
+	for range b.N {
+		m := &BoxedMap{}
+		for k, v := range entries {
+			m.Store(k, v)
+		}
+	}
+}
+
+// mostly loads, with one store in every sixteen operations, either all on
+// the same key, or spread over a thousand keys
+
+// Range copies into a new map every time, and RangeInto into a buffer
+// that's kept between calls
+
+func BenchmarkRangeInto(b *testing.B) {
+	maps := []interface {
+		Store(key, value any)
+		Range(func(key, value any) bool)
+		RangeInto([]KV, func(key, value any) bool) []KV
+	}{&LockedMap{}, &BoxedMap{}}
+
+	f := func(k, v any) bool { return true }
+	for _, m := range maps {
+		for i := range 10000 {
+			m.Store(i, i)
+		}
+		name := strings.TrimPrefix(fmt.Sprintf("%T", m), "*crow.")
+		b.Run(name+"/Range", func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				m.Range(f)
+			}
+		})
+		b.Run(name+"/RangeInto", func(b *testing.B) {
+			b.ReportAllocs()
+			var buf []KV
+			for range b.N {
+				buf = m.RangeInto(buf, f)
+			}
+		})
+	}
+}
+
+func BenchmarkLockedMapVsSyncMap(b *testing.B) {
+	maps := []struct {
+		name string
+		new  func() ConcurrentMap
+	}{
+		{"LockedMap", func() ConcurrentMap { return &LockedMap{} }},
+		{"BoxedMap", func() ConcurrentMap { return &BoxedMap{} }},
+		{"ReadWriteMap", func() ConcurrentMap { return &ReadWriteMap{} }},
+		{"sync.Map", func() ConcurrentMap { return &sync.Map{} }},
+		{"SyncMapAdapter", func() ConcurrentMap { return &SyncMapAdapter{} }},
+	}
+	keys := []struct {
+		name string
+		n    int
+	}{
+		{"same", 1},
+		{"spread", 1000},
+	}
 
+	for _, m := range maps {
+		for _, k := range keys {
+			b.Run(m.name+"/"+k.name, func(b *testing.B) {
+				c := m.new()
+				for i := range k.n {
+					c.Store(i, i)
+				}
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						i++
+						key := i % k.n
+						if i%16 == 0 {
+							c.Store(key, i)
+						} else {
+							c.Load(key)
+						}
+					}
+				})
+			})
+		}
 	}
-	// or b.RunParallel(func(pb *testing.PB) {})
 }
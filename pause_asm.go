@@ -0,0 +1,9 @@
+//go:build amd64 || arm64
+
+package crow
+
+// tell the cpu we're in a spin loop, with PAUSE on amd64 and YIELD on arm64,
+// which saves power and lets the other hyperthread get on with things
+
+//go:noescape
+func cpuPause()
@@ -0,0 +1,13 @@
+//go:build !amd64 && !arm64
+
+package crow
+
+import (
+	"runtime"
+)
+
+// there's no pause instruction we can get at, so we yield instead
+
+func cpuPause() {
+	runtime.Gosched()
+}
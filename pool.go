@@ -0,0 +1,33 @@
+package crow
+
+import (
+	"sync"
+)
+
+// A pool of roundabouts, for when they're short lived
+//
+// Get hands out a roundabout in its zero state, like new(Roundabout), so
+// Conflict, Stuck, and the like have to be set again each time. Put checks
+// that nothing is using the roundabout before resetting it, and panics if
+// anything is: reusing one with a cell or a fence still in it would have
+// the old owner and the new one waiting on each other. A closed roundabout
+// is fine to put back, closing is reset along with everything else.
+
+type RoundaboutPool struct {
+	pool sync.Pool
+}
+
+func (p *RoundaboutPool) Get() *Roundabout {
+	if rb, ok := p.pool.Get().(*Roundabout); ok {
+		return rb
+	}
+	return new(Roundabout)
+}
+
+func (p *RoundaboutPool) Put(rb *Roundabout) {
+	if !rb.idle() || rb.arrivals.Load() != rb.admitted.Load() || rb.guards.Load() != 0 {
+		panic("crow: putting a Roundabout in use back in the pool: " + rb.String())
+	}
+	*rb = Roundabout{}
+	p.pool.Put(rb)
+}
@@ -0,0 +1,74 @@
+package crow
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRoundaboutPool(t *testing.T) {
+	p := &RoundaboutPool{}
+	fn := func(uint16, uint16) error { return nil }
+
+	// the same operations, on a fresh roundabout and a pooled one
+	ops := func(rb *Roundabout) []uint16 {
+		var epochs []uint16
+		record := func(epoch uint16, flags uint16) error {
+			epochs = append(epochs, epoch, flags)
+			return nil
+		}
+		rb.LockRing(record)
+		rb.ShareLane(1, record)
+		rb.Fence(1, func(epoch uint16, flags uint16) error {
+			epochs = append(epochs, epoch, flags)
+			return nil
+		})
+		rb.OrderRing(record)
+		return epochs
+	}
+
+	rb := p.Get()
+	rb.Conflict = func(a, b uint32) bool { return true }
+	for range 40 {
+		rb.LockLane(7, fn)
+	}
+	rb.Close()
+	rb.Quiesce()
+	p.Put(rb)
+
+	pooled := p.Get()
+	fresh := &Roundabout{}
+	if pooled.String() != fresh.String() || pooled.IsClosed() || pooled.Conflict != nil {
+		t.Fatal("pooled roundabout wasn't reset", pooled.String())
+	}
+	a, b := ops(fresh), ops(pooled)
+	if len(a) != len(b) {
+		t.Fatal("different operations", a, b)
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Error("pooled roundabout behaved differently", a, b)
+			break
+		}
+	}
+}
+
+func TestRoundaboutPoolBusy(t *testing.T) {
+	p := &RoundaboutPool{}
+	rb := p.Get()
+	ticket, err := rb.AcquireRing(context.Background(), LockRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("put a busy roundabout")
+			}
+		}()
+		p.Put(rb)
+	}()
+
+	ticket.Release()
+	p.Put(rb)
+}
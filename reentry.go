@@ -0,0 +1,63 @@
+package crow
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+)
+
+// Some callbacks can't call back into the roundabout without deadlocking,
+// like a Range that iterates the live map while holding a cell. Rather than
+// hang, we note down the goroutine running the callback, and enter() will
+// panic if that goroutine tries to take another cell.
+//
+// Finding the goroutine is slow, but we only do it while a guarded callback
+// is running, the rest of the time it's one atomic load in enter()
+//
+// Any callback that holds a cell will deadlock if it takes another cell
+// that conflicts, but only some of the time, under load. So with -tags
+// crowdebug, every callback runs under a guard, and the first nested call
+// panics, even the ones that would have got away with it.
+
+func (rb *Roundabout) guard(name string, fn func()) {
+	g := goid()
+	prev, nested := rb.guarded.Load(g)
+	rb.guarded.Store(g, name)
+	rb.guards.Add(1)
+
+	defer func() {
+		rb.guards.Add(-1)
+		if nested {
+			// RangeSnapshot inside a guarded ShareRing
+			rb.guarded.Store(g, prev)
+		} else {
+			rb.guarded.Delete(g)
+		}
+	}()
+
+	fn()
+}
+
+// the panic names both sides, as the inner call is often a different kind,
+// in code that doesn't know it's being called from a callback, like a
+// ShareRing inside a LockRing, which waits behind its own caller
+
+func (rb *Roundabout) checkGuard(kind uint16) {
+	if name, ok := rb.guarded.Load(goid()); ok {
+		panic("crow: roundabout re-entered from inside " + name.(string) + " callback, by a " + kindName(kind))
+	}
+}
+
+// the goroutine id, from the first line of the stack trace:
+// "goroutine 123 [running]:"
+
+func goid() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	b := bytes.TrimPrefix(buf[:n], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
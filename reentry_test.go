@@ -0,0 +1,97 @@
+package crow
+
+import (
+	"strings"
+	"testing"
+)
+
+// the nesting checks are only compiled in with -tags crowdebug, and a test
+// that nests on purpose would deadlock without them, so it skips instead
+
+func checkNoNesting(t *testing.T) {
+	t.Helper()
+	if !checkNesting {
+		t.Skip("nesting checks need -tags crowdebug")
+	}
+}
+
+// run fn, and check it panicked about nesting
+
+func expectNested(t *testing.T, name string, fn func()) {
+	t.Helper()
+	defer func() {
+		t.Helper()
+		r := recover()
+		if s, ok := r.(string); !ok || !strings.Contains(s, "re-entered from inside "+name) {
+			t.Errorf("nested call inside %s wasn't caught: %v", name, r)
+		}
+	}()
+	fn()
+}
+
+func TestNesting(t *testing.T) {
+	checkNoNesting(t)
+	rb := &Roundabout{}
+	fn := func(uint16, uint16) error { return nil }
+
+	// this one always deadlocks
+	expectNested(t, "LockRing", func() {
+		rb.LockRing(func(uint16, uint16) error {
+			return rb.LockRing(fn)
+		})
+	})
+
+	// this one only deadlocks when a writer arrives in between
+	expectNested(t, "ShareRing", func() {
+		rb.ShareRing(func(uint16, uint16) error {
+			return rb.ShareLane(1, fn)
+		})
+	})
+
+	w := &WideRoundabout{}
+	expectNested(t, "OrderLane", func() {
+		w.OrderLane(1, func(uint16, uint16) error {
+			return w.ShareLane(2, fn)
+		})
+	})
+
+	// a different kind still waits on its caller, and the panic says which
+	func() {
+		defer func() {
+			s, _ := recover().(string)
+			if !strings.Contains(s, "inside LockRing callback, by a ShareRing") {
+				t.Error("cross-kind nesting not reported with both kinds:", s)
+			}
+		}()
+		rb.LockRing(func(uint16, uint16) error {
+			return rb.ShareRing(fn)
+		})
+	}()
+	expectNested(t, "LockLane", func() {
+		rb.LockLane(1, func(uint16, uint16) error {
+			return rb.OrderRing(fn)
+		})
+	})
+
+	// a barrier isn't a callback, but it's held by the goroutine all the same
+	b := rb.RaiseBarrier()
+	expectNested(t, "RaiseBarrier", func() {
+		rb.ShareLane(1, fn)
+	})
+	rb.LowerBarrier(b)
+
+	// a different roundabout is fine, and so is the same one afterwards
+	other := &Roundabout{}
+	err := rb.LockRing(func(uint16, uint16) error {
+		return other.LockRing(fn)
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if err := rb.LockRing(fn); err != nil {
+		t.Error(err)
+	}
+	if !rb.idle() || rb.guards.Load() != 0 {
+		t.Error("nested calls left the roundabout busy", rb.String())
+	}
+}
@@ -1,13 +1,28 @@
 package crow
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/bits"
 	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
-const width = 32
+// the top flag is reserved, and set by Close(). it's never cleared, and
+// it shouldn't be passed to Fence or Phase
+
+const FlagClosed uint16 = 1 << 15
+
+// the next flag down is set by Abort(). while it's set, anything that
+// would wait on another operation gives up with ErrAborted instead, and it
+// stays set until ClearAbort(). it can be passed to Fence too, to abort
+// the waiters, wait for the operations already running, and then run the
+// fence's callback, with the flag cleared afterwards
+
+const FlagAbort uint16 = 1 << 14
 
 /*
 A roundabout is effectively an in-memory write-ahead log:
@@ -40,7 +55,8 @@ with a bitfield free-list:
 
 - Insertion is
 	- Check epoch+1's bit in the bitfield
-	- If 0, CAS in a new header with epoch+1 and the bitfield updated
+	- If 0, CAS our item into the free entry, which claims it
+	- Then CAS in a new header with epoch+1 and the bitfield updated
 - Scanning is
 	- With the bitfield from allocation, scan the ring buffer
 	- If the epoch is what we expect for an earlier item, check it
@@ -70,6 +86,7 @@ This allows a roundabout to be used in a number of different ways:
 	- Can note down the epoch when a structure is retired
 	- Can check if epoch has advanced, or all earlier writers have exited
 	- Can be used to reclaim shared structures, or keep thread local free lists
+	- See DeferredFree for a free list
 
 Not bad for a ring buffer, frankly.
 
@@ -78,7 +95,8 @@ it might succeed, but under contention it will lock hard. The only way to safely
 acquire multiple entries on the ring buffer is atomically.
 
 This is why push/pop/etc aren't public methods. A thread shouldn't nest calls
-to SpinLock etc but our hands are tied in go, alas.
+to SpinLock etc but our hands are tied in go, alas. The best we can do is check
+in tests: building with -tags crowdebug makes a nested call panic, see reentry.go
 
 
 */
@@ -97,9 +115,12 @@ const (
 	LockLane // Blocks on any predecessors in lane
 	LockRing // Blocks on all predecessors in ring
 
+	LockLanePriority // A LockLane that other waiters back off for
+	LockLaneRange    // A LockLane over every lane from its own up to rb.ranges[n]
+
 	/*
-		There is room for other behaviours, but a user
-		can override lane matching behaviour with a function
+		There is room for other behaviours, see RegisterKind, and a
+		user can override lane matching behaviour with a function
 
 		In theory, we could make an entry that tells future
 		workers to abort, but flags already handle that case
@@ -124,7 +145,7 @@ func (h Header) pack() uint64 {
 func unpackHeader(h uint64) Header {
 	var epoch uint16 = uint16((h >> 48) & 65535)
 	var flags uint16 = uint16((h >> 32) & 65535)
-	var bitmap uint32 = uint32(h & 2147483647)
+	var bitmap uint32 = uint32(h & 4294967295)
 	return Header{epoch, flags, bitmap}
 }
 
@@ -143,18 +164,21 @@ func (c Cell) pack() uint64 {
 func unpackCell(h uint64) Cell {
 	var epoch uint16 = uint16((h >> 48) & 65535)
 	var kind uint16 = uint16((h >> 32) & 65535)
-	var lane uint32 = uint32(h & 2147483647)
+	var lane uint32 = uint32(h & 4294967295)
 	return Cell{epoch, kind, lane}
 }
 
 // a cell in use in the roundabout
 type rb_cell struct {
-	n      int
-	epoch  uint16
-	flags  uint16
-	kind   uint16
-	lane   uint32
-	bitmap uint32
+	n        int
+	epoch    uint16
+	flags    uint16
+	kind     uint16
+	lane     uint32
+	bitmap   uint32
+	conflict func(uint32, uint32) bool // overrides rb.Conflict when set
+	wide     *WideRoundabout           // set when the lane is a wide lane
+	wlane    uint64                    // the wide lane, or the top of a LockLaneRange
 }
 
 // a change to the headers
@@ -165,13 +189,91 @@ type rb_fence struct {
 	bitmap    uint32
 }
 
+// the policy for a roundabout, split out from the state, so that it can
+// be copied and shared between roundabouts, which can't be copied
+// themselves. it's embedded, so rb.Conflict and the rest still work, and
+// the zero value is the default for everything
+
+type Config struct {
+	// decides if two lanes conflict, rather than comparing them
+	Conflict func(uint32, uint32) bool
+
+	// lanes never conflict, so lane operations only wait on the ring
+	// operations, for when the lane is for ordering, not exclusion
+	NoLaneConflict bool
+
+	// called when a scan has spun StuckAfter times on a cell that's been
+	// allocated but never written, with the slot and the epoch it's
+	// waiting for, and again every StuckAfter spins after that. the
+	// pusher is only ever a few instructions away from writing the cell,
+	// so this means it's been lost. nil turns it off
+	Stuck      func(n int, epoch uint16)
+	StuckAfter int // defaults to stuckAfter
+
+	// sample how many cells are busy every OccupancyEvery pushes, for
+	// Stats(). zero turns it off, and it's one load when it's off
+	OccupancyEvery int
+
+	// time each wait, and use the average to decide how long to yield
+	// before parking, see parkAfter()
+	AdaptiveSpin bool
+
+	// when the ring is full, at most FullQueue goroutines wait in line for
+	// a cell, and any more get ErrRingFull straight away. zero doesn't
+	// limit the line
+	FullQueue int
+
+	// and each of them waits at most FullWait, before giving up with
+	// ErrRingFull. when it's set, the line parks until a pop, rather than
+	// spinning. zero waits for as long as it takes
+	FullWait time.Duration
+
+	// readers wait for every Lock ahead of them in the log, whatever the
+	// lane, rather than only the ones they conflict with, see conflicts()
+	WriterPreference bool
+
+	// called at the end of every pop, once the slot is free, with the
+	// epoch, kind, and lane of the cell, for cleaning up after it. the
+	// operations waiting on the cell may already be running by then. it
+	// runs on the goroutine that popped, so it should be quick, and a pop
+	// from inside it calls it again. nil turns it off
+	OnPop func(epoch uint16, kind uint16, lane uint32)
+}
+
 // and the actual structure itself:
 // a ring buffer of log entries, and a header including epoch and freelist
 
 type Roundabout struct {
-	header   atomic.Uint64     // <epoch:16> <flags:16> <bitmap: 32>
-	log      [32]atomic.Uint64 // <epoch:16> <kind:16> <lane: 32>
-	Conflict func(uint32, uint32) bool
+	header atomic.Uint64   // <epoch:16> <flags:16> <bitmap: 32>
+	log    [width]log_cell // <epoch:16> <kind:16> <lane: 32>
+
+	Config
+
+	guards  atomic.Int32 // callbacks that can't re-enter, see guard()
+	guarded sync.Map     // goroutine id -> name of callback
+
+	wake atomic.Pointer[chan struct{}] // closed to wake parked goroutines
+
+	arrivals atomic.Uint32 // tickets handed out while the ring is full
+	admitted atomic.Uint32 // tickets that have got a cell, see enterQueued()
+	skipped  sync.Map      // tickets given up while queued, see leaveQueue()
+
+	priority atomic.Int32 // LockLanePriority calls in progress
+
+	ranges [width]atomic.Uint32       // the top lane of a LockLaneRange in each slot
+	local  [width]atomic.Pointer[any] // see CellLocal, cleared by pop
+
+	faults atomic.Int32 // header CASes left to fail, see casHeader()
+
+	occupancy [width + 1]atomic.Uint64 // pushes that left n cells busy
+	waitAvg   atomic.Int64             // moving average of waits in ns, see sampleWait()
+	seqBase   atomic.Uint64            // the last quarter the epoch passed, see Sequence()
+}
+
+// a roundabout with its policy copied from cfg
+
+func NewRoundaboutFromConfig(cfg Config) *Roundabout {
+	return &Roundabout{Config: cfg}
 }
 
 // before you ask, yes, 32 isn't a lot of elements, but it is currently a lot of cpus
@@ -190,6 +292,39 @@ func (rb *Roundabout) Flags() uint16 {
 	return h.flags
 }
 
+// how many cells the ring has, and so how many operations can hold one at
+// once, counting the ones still waiting on others. it's width, 32 unless
+// built with crowwidth8 or crowwidth4.
+//
+// once every cell is taken, nothing new gets in until a pop: the next
+// operation waits for a cell, in line with any others, or returns
+// ErrRingFull if it was asked not to wait, by TryAcquireRing, FullQueue,
+// or FullWait. it never fails any other way, so an application that needs
+// more than Capacity operations in flight at once, each waiting for the
+// next, deadlocks rather than erroring
+
+func (rb *Roundabout) Capacity() int {
+	return width
+}
+
+// how many cells were free, from one load of the header. cells are taken
+// in order around the ring, so the next push needs the cell after the
+// last one, and it can still wait when Available is more than zero, if
+// the operation holding that cell is a slow one. zero means it will wait
+
+func (rb *Roundabout) Available() int {
+	h := unpackHeader(rb.header.Load())
+	return width - bits.OnesCount32(h.bitmap)
+}
+
+// the epoch and flags from one load of the header, so they're consistent
+// with each other, and whether any cell was active at that point
+
+func (rb *Roundabout) Header() (epoch uint16, flags uint16, busy bool) {
+	h := unpackHeader(rb.header.Load())
+	return h.epoch, h.flags, h.bitmap != 0
+}
+
 func (rb *Roundabout) String() string {
 	h := unpackHeader(rb.header.Load())
 	return fmt.Sprintf("%v [%v] %v",
@@ -199,437 +334,1790 @@ func (rb *Roundabout) String() string {
 	)
 }
 
-func (rb *Roundabout) Active(epoch uint16) bool {
-	h := unpackHeader(rb.header.Load())
-
-	if h.epoch == epoch {
-		return h.bitmap == 0
-	}
-
-	// if we're within width bits, epoch could have
-	// active predecessors
+// a cell in the log, as seen by Dump()
 
-	// XXX could create a 1111111 bit, << diff, then rot it by epoch
-	// and just AND it with header
+type CellInfo struct {
+	Slot  int
+	Epoch uint16
+	Kind  uint16
+	Lane  uint32
+}
 
-	diff := h.epoch - epoch
+var kindNames = map[uint16]string{
+	ZeroCell:         "ZeroCell",
+	PendingCell:      "PendingCell",
+	ShareLane:        "ShareLane",
+	ShareRing:        "ShareRing",
+	OrderLane:        "OrderLane",
+	OrderRing:        "OrderRing",
+	LockLane:         "LockLane",
+	LockRing:         "LockRing",
+	LockLanePriority: "LockLanePriority",
+	LockLaneRange:    "LockLaneRange",
+}
 
-	if diff < 0 || diff >= width {
-		return false
+func kindName(kind uint16) string {
+	if name, ok := kindNames[kind]; ok {
+		return name
 	}
+	return strconv.Itoa(int(kind))
+}
+
+func (c CellInfo) String() string {
+	return fmt.Sprintf("%d: [%d] %s %d", c.Slot, c.Epoch, kindName(c.Kind), c.Lane)
+}
 
-	// skim off all bits of jobs ahead of epoch given
-	bitmap := bits.RotateLeft32(h.bitmap, int(h.epoch-1)%width)
-	bitmap = bitmap >> diff
+// every cell allocated in the header, oldest first, for debugging. it
+// takes no locks, so it's a racy snapshot: a cell can be popped or
+// pushed while we look, and may show up as a PendingCell
 
-	for i := 0; i < width-int(diff); i++ {
-		if bitmap&1 == 1 {
-			return true
+func (rb *Roundabout) Dump() []CellInfo {
+	h := unpackHeader(rb.header.Load())
+	var cells []CellInfo
+	for i := range width {
+		// start from the oldest slot, the one after the next epoch's
+		epoch := h.epoch + uint16(i)
+		n := int(epoch) % width
+		if h.bitmap&(1<<n) == 0 {
+			continue
 		}
-		bitmap = bitmap >> 1
+		c := unpackCell(rb.log[n].Load())
+		cells = append(cells, CellInfo{n, c.epoch, c.kind, c.lane})
 	}
-	return false
-
+	return cells
 }
 
-// push a new item onto the log, with a given lane and kind
-// the kind is "Spin" or "SpinRing", and the lane is usually
-// some hash value
-
-func (rb *Roundabout) push(lane uint32, kind uint16) (rb_cell, bool) {
-	header := rb.header.Load()
-
-	h := unpackHeader(header)
-
-	n := int(h.epoch) % width
-	var b uint32 = 1 << n
+// check that the log matches the header: every slot in the bitmap holds a
+// cell from the last lap, and every other slot holds the free cell that
+// pop left behind, or nothing, if the ring hasn't got that far yet. the
+// first mismatch comes back wrapped in ErrInvalid.
+//
+// it takes no locks, so it's for looking at a roundabout that's idle, or
+// quiesced. on a busy one, a push or pop can be caught half done, so if
+// the header changes while we look, we look again, a few times, and then
+// give up and return what we found
+
+func (rb *Roundabout) Validate() error {
+	var err error
+	for range 3 {
+		header := rb.header.Load()
+		err = rb.validate(unpackHeader(header))
+		if err == nil || rb.header.Load() == header {
+			return err
+		}
+	}
+	return err
+}
 
-	if h.bitmap&b == 0 {
-		new_header := Header{h.epoch + 1, h.flags, h.bitmap | b}.pack()
-		item := Cell{h.epoch, kind, lane}.pack()
-
-		if rb.header.CompareAndSwap(header, new_header) {
-			rb.log[n].Store(item)
-			e := rb_cell{
-				n:      n,
-				epoch:  h.epoch,
-				flags:  h.flags,
-				kind:   kind,
-				lane:   lane,
-				bitmap: h.bitmap,
+func (rb *Roundabout) validate(h Header) error {
+	if extra := h.bitmap &^ (1<<width - 1); extra != 0 {
+		return fmt.Errorf("%w: bits %b are past the end of the ring", ErrInvalid, extra)
+	}
+	pushed := rb.Sequence()
+
+	for n := range width {
+		// the next epoch that lands on this slot, after the header's
+		next := h.epoch + uint16((n-int(h.epoch)%width+width)%width)
+		raw := rb.log[n].Load()
+		c := unpackCell(raw)
+
+		if h.bitmap&(1<<n) != 0 {
+			if c.epoch != next-width || c.kind == ZeroCell || c.kind == PendingCell {
+				return fmt.Errorf("%w: slot %d is in use, but holds %s from epoch %d, rather than a cell from epoch %d",
+					ErrInvalid, n, kindName(c.kind), c.epoch, next-width)
 			}
-			return e, true
+			continue
+		}
 
+		switch {
+		case c == Cell{next, PendingCell, 0}:
+			// popped
+		case raw == 0 && pushed <= uint64(n):
+			// never been used
+		case c.epoch == h.epoch && next == h.epoch:
+			// pushed, but the header isn't updated yet
+		default:
+			return fmt.Errorf("%w: slot %d is free, but holds %s from epoch %d, rather than a free cell for epoch %d",
+				ErrInvalid, n, kindName(c.kind), c.epoch, next)
 		}
 	}
-
-	return rb_cell{}, false
+	return nil
 }
 
-// after allocating a rb_cell on the roundabout, we scan predecessors
-// to find conflicts
+// how many cells of each kind are in the log, for picking between a read
+// heavy and a write heavy strategy. like Dump, it's a racy snapshot, and
+// cells that haven't been written yet aren't counted
 
-func (rb *Roundabout) wait(r rb_cell) {
-	// n.b we will never scan epoch -32 to 0 for the first cycle
-	// as the bitmap in the header is all zeros
+func (rb *Roundabout) Counts() (shared, order, lock int) {
+	h := unpackHeader(rb.header.Load())
+	oldest := h.epoch - width
 
-	if r.bitmap == 0 {
-		return
+	for n := range width {
+		if h.bitmap&(1<<n) == 0 {
+			continue
+		}
+		item := unpackCell(rb.log[n].Load())
+		if item.epoch-oldest >= width {
+			// it's been popped since the snapshot
+			continue
+		}
+
+		switch item.kind {
+		case ShareLane, ShareRing:
+			shared++
+		case OrderLane, OrderRing:
+			order++
+		case LockLane, LockRing, LockLanePriority, LockLaneRange:
+			lock++
+		}
 	}
+	return
+}
 
-	// we check from epoch-31 to epoch-1
-	epoch := r.epoch - uint16(32)
+// counters for deciding if the ring is big enough. Occupancy[n] is how
+// many of the sampled pushes left n cells busy, counting their own, so
+// Occupancy[0] is always zero, and a ring that's always full shows up at
+// the end. it's only filled in when OccupancyEvery is set
 
-	// we shift the free bitmap so that our cell is in the lsb
-	bitmap := bits.RotateLeft32(r.bitmap, -r.n)
+type RoundaboutStats struct {
+	Occupancy []uint64
+}
 
-	// the free bitmap is a snapshot of where we were on allocation
-	// so will not include any items ahead of us
+// a snapshot of the stats. each counter is read on its own, so the
+// snapshot can be torn while pushes are going on
 
-	for i := 0; i < 31; i++ {
-		epoch++
-		bitmap = bitmap >> 1
-		if bitmap&1 == 0 { // free space
-			continue
-		}
-		// fmt.Println(r.epoch,":", epoch, bitmap&1)
+func (rb *Roundabout) Stats() RoundaboutStats {
+	s := RoundaboutStats{Occupancy: make([]uint64, width+1)}
+	for i := range s.Occupancy {
+		s.Occupancy[i] = rb.occupancy[i].Load()
+	}
+	return s
+}
 
-		n := int(epoch) % width
-		for true {
-			item := unpackCell(rb.log[n].Load())
-			if item.kind == ZeroCell {
-				// spin, uninitialised memory
-				continue
-			} else if item.epoch == epoch {
-				// item has expected epoch of item in past
-				// has been allocated on bitmap
-				// check cell has been written
+// returns true if any cell allocated before the epoch is still in the log
 
-				if item.kind == PendingCell {
-					// the log cell has been allocated in the bitmap
-					// but the thread has yet to write to it, so spin
-					continue
-				}
+func (rb *Roundabout) Active(epoch uint16) bool {
+	h := unpackHeader(rb.header.Load())
+	return h.active(epoch)
+}
 
-				if r.kind == LockRing || item.kind == LockRing {
-					// we wait for all predecessors
-					continue
-				} else if r.kind == OrderRing {
-					// atomics not blocked by reads
-					if item.kind == ShareLane || item.kind == ShareRing {
-						break
-					}
-					// we block on all Lock, Order predecessors
-					// and atomics
-					continue
+// like calling Active for each epoch, but against one load of the header,
+// so the answers are all from the same moment
 
-				} else if r.kind == ShareRing {
-					// we block when we see a Lock, but not Share or Atomics
-					if item.kind == LockLane || item.kind == LockRing {
-						continue
-					}
-					break
-				} else if r.kind == LockLane {
-					// block on all wide actions
-					if item.kind == LockRing || item.kind == OrderRing || item.kind == ShareRing {
-						continue
-					}
-					// check lane below for LockLane, OrderLane, ShareLane
+func (rb *Roundabout) ActiveSet(epochs []uint16) []bool {
+	h := unpackHeader(rb.header.Load())
+	out := make([]bool, len(epochs))
+	for i, epoch := range epochs {
+		out[i] = h.active(epoch)
+	}
+	return out
+}
 
-				} else if r.kind == OrderLane {
-					// block on all wide actions, except reads
-					if item.kind == LockRing || item.kind == OrderRing {
-						continue
-					}
-					// ignore reads
-					if item.kind == ShareLane || item.kind == ShareRing {
-						break
-					}
-					// check lane for LockLane, OrderLane
+// the epoch, extended to 64 bits so it doesn't wrap, for logging and for
+// comparing across long spans. it's the sequence number the next push
+// will get, like Epoch() is the epoch it will get.
+//
+// we keep the full epoch of the last quarter of the ring we passed in
+// seqBase, and add 1<<14 to it as the push that reaches the next one.
+// that push holds its cell until it's done, so the epoch can't get more
+// than width past a quarter before seqBase catches up, and it always
+// knows which quarter it's in: the pushes for each quarter happen in
+// order, and a single Add is enough.
+//
+// to read it, we load seqBase, then the header, then seqBase again. if it
+// didn't change, the epoch is less than a quarter and width ahead of
+// it, and the low bits tell us exactly how far
+
+const seqQuarter = 1 << 14
+
+func (rb *Roundabout) Sequence() uint64 {
+	for true {
+		base := rb.seqBase.Load()
+		h := unpackHeader(rb.header.Load())
+		if rb.seqBase.Load() == base {
+			return base + uint64(h.epoch-uint16(base))
+		}
+	}
+	// huh
+	panic(unreachable("Sequence"))
+}
 
-				} else if r.kind == ShareLane {
-					// blocked by any Lock
-					if item.kind == LockRing {
-						continue
-					}
-					// ignores atomics, reads
-					if item.kind == OrderLane || item.kind == OrderRing {
-						break
-					}
-					if item.kind == ShareLane || item.kind == ShareRing {
-						break
-					}
-					// check lane for LockLane below
-				}
-				// if we're a Lock lane, we chec Lock, atomic, read lane here
-				// if we're an atomic lane, we chec Lock, atomic lane here
-				// if we're a read lane, we chec Lock lane here
+// the sequence number of an epoch from a callback, or a Ticket, for as
+// long as it's held. an epoch is taken to be the most recent one with
+// those bits, so older ones come out 1<<16 too high
 
-				if rb.Conflict == nil {
-					if r.lane == item.lane {
-						continue
-					}
-				} else if rb.Conflict(r.lane, item.lane) {
-					continue
-				}
-			}
+func (rb *Roundabout) SequenceOf(epoch uint16) uint64 {
+	seq := rb.Sequence()
+	return seq - uint64(uint16(seq)-epoch)
+}
 
-			break
-		}
+// called after a push moves the header to epoch+1
+
+func (rb *Roundabout) passed(epoch uint16) {
+	if (epoch+1)%seqQuarter == 0 {
+		rb.seqBase.Add(seqQuarter)
 	}
 }
 
-// mark our work as complete, updating the item in the buffer
-// before updating the header
-func (rb *Roundabout) pop(r rb_cell) {
-	next_item := Cell{r.epoch + width, PendingCell, 0}.pack()
-	rb.log[r.n].Store(next_item)
+// rotate the bitmap right by n within the width of the ring, so that slot
+// n ends up in the lsb. for a 32 wide ring, this is just RotateLeft32
 
-	var b uint64 = 1 << r.n
-	rb.header.And(^b) // go 1.23 needed
+func rotateBitmap(bitmap uint32, n int) uint32 {
+	n %= width
+	return (bitmap>>n | bitmap<<(width-n)) & (1<<width - 1)
 }
 
-// update the header in the buffer, so that all
-// new mutators see flags
+func (h Header) active(epoch uint16) bool {
+	// if we're within width cells, epoch could have
+	// active predecessors
 
-func (rb *Roundabout) setFence(flags uint16) (rb_fence, bool) {
-	header := rb.header.Load()
-	h := unpackHeader(header)
+	diff := h.epoch - epoch
 
-	if h.flags&flags != 0 {
-		// can't set flags, already set
-		return rb_fence{}, false
+	if diff >= width {
+		return false
 	}
 
-	new_header := Header{h.epoch, h.flags | flags, h.bitmap}.pack()
+	// rotate the bitmap so that the oldest possible cell, h.epoch-width,
+	// is in the lsb, and then skim off all the cells from epoch onwards
+	bitmap := rotateBitmap(h.bitmap, int(h.epoch%width))
+	mask := uint32(1)<<(width-diff) - 1
 
-	if rb.header.CompareAndSwap(header, new_header) {
-		s := rb_fence{
-			epoch:     h.epoch,
-			flags:     flags,
-			new_flags: h.flags | flags,
-			bitmap:    h.bitmap,
-		}
-		return s, true
-	}
-	return rb_fence{}, false
+	return bitmap&mask != 0
 }
 
-// now that we've update the header, we wait for
-// all earlier work to complete
+// for reclaiming memory: unlink something, then take a marker, and once
+// CanReclaim(marker) is true, every operation that could have seen it has
+// finished, and it can be freed. the marker is the epoch of the last cell
+// allocated, so it covers everything that started before we took it.
+//
+// this is Active() the other way round. once the header has moved 32
+// epochs past the marker, nothing that old can be left, as its slot would
+// still be taken, but after 65536 epochs, the marker wraps around and
+// CanReclaim goes back to looking at the bitmap. that errs on the side of
+// waiting, so check the marker before it's that stale
+
+func (rb *Roundabout) RetireEpoch() uint16 {
+	return rb.Epoch() - 1
+}
 
-func (rb *Roundabout) spinFence(s rb_fence) {
-	if s.bitmap == 0 {
-		return
-	}
+// true once no cell allocated at or before the marker is still in the log
 
-	// there's no allocation made for flag changes
-	// so we check from epoch-32 to epoch-1
+func (rb *Roundabout) CanReclaim(marker uint16) bool {
+	return !rb.Active(marker + 1)
+}
 
-	epoch := s.epoch - uint16(32)
-	n := int(s.epoch) % width
+// block until every ShareRing and ShareLane cell allocated at or before
+// the marker has been popped, for swapping out something readers hold on
+// to: stop new readers finding the old one, take the marker with
+// RetireEpoch(), and drain. we don't take a cell, and ignore writers, so
+// writers carry on as normal, and so do readers that start after the
+// marker. like CanReclaim, a marker more than width epochs old has
+// nothing left to wait for
 
-	// we shift the free bitmap so that epoch's cell is in the lsb
-	// and epoch +1 is in next larger bit.
-	bitmap := bits.RotateLeft32(s.bitmap, -n)
+func (rb *Roundabout) DrainReaders(marker uint16) {
+	h := unpackHeader(rb.header.Load())
 
-	// the free bitmap is a snapshot of where we were on header update
-	// so will not include any items ahead of us
+	// the bitmap is rotated so that h.epoch-width is in the lsb, like
+	// spinFence, and we skip the free slots a run at a time
+	bitmap := rotateBitmap(h.bitmap, int(h.epoch)%width)
+	epoch := h.epoch - width
+	for ; bitmap != 0; epoch, bitmap = epoch+1, bitmap>>1 {
+		skip := bits.TrailingZeros32(bitmap)
+		epoch += uint16(skip)
+		bitmap >>= skip
+		if int16(marker-epoch) < 0 {
+			// everything from here on started after the marker
+			return
+		}
+		rb.drainReader(int(epoch)%width, epoch)
+	}
+}
 
-	for i := 0; i < 32; i++ {
-		if bitmap&1 == 0 { // free space
-			epoch++
-			bitmap = bitmap >> 1
+// wait for the cell at epoch to go, if it's a reader
+
+func (rb *Roundabout) drainReader(n int, epoch uint16) {
+	var b rb_backoff
+	for true {
+		raw := rb.log[n].Load()
+		item := unpackCell(raw)
+		if item.kind == ZeroCell || item.epoch == epoch && item.kind == PendingCell {
+			// allocated but not written yet, so we can't tell
+			rb.spinUnwritten(&b, n, epoch)
 			continue
 		}
-		// fmt.Println(s.epoch,":", epoch, bitmap&1)
-
-		n := int(epoch) % width
-		for true {
-			item := unpackCell(rb.log[n].Load())
-			if item.kind == ZeroCell {
-				// spin, uninitialised memory
-				continue
-			} else if item.epoch == epoch {
-				// spin, predecessor still active
-				// unless it's a read, which we can ignore
-				// may want to have diff fence or spinWriters
-				// but cant think of why we'd need a fence that waits
-				// for old readers that wouldn't be a LockRing
+		if item.epoch == epoch && (item.kind == ShareLane || item.kind == ShareRing) {
+			b.park(rb, &rb.log[n].Uint64, raw)
+			continue
+		}
+		return
+	}
+	// huh
+	panic(unreachable("drainReader"))
+}
 
-				if item.kind == ShareLane || item.kind == ShareRing {
-					break
-				}
-				continue
-			}
+// block until the epoch has reached or passed the target, i.e until that
+// many operations have started. epochs wrap, so "passed" means less than
+// half the epoch space ahead of the target
 
-			break
-		}
-		epoch++
-		bitmap = bitmap >> 1
+func (rb *Roundabout) WaitForEpoch(target uint16) {
+	var b rb_backoff
+	for int16(rb.Epoch()-target) < 0 {
+		b.wait()
 	}
 }
 
-// clear out flags, OR'ing out our changes
-// and again, only affecting new threads
+// stop letting new operations in. every operation that hasn't got a cell
+// yet returns ErrClosed, and so do fences that haven't set their flags,
+// but anything already in the log carries on. closing is sticky, and
+// closing twice is harmless. Quiesce() waits for the stragglers
 
-func (rb *Roundabout) clearFence(s rb_fence) uint16 {
+func (rb *Roundabout) Close() {
 	for true {
 		header := rb.header.Load()
 		h := unpackHeader(header)
-
-		new_header := Header{h.epoch, h.flags ^ s.flags, h.bitmap}.pack()
-
-		if rb.header.CompareAndSwap(header, new_header) {
-			return h.epoch
+		if h.flags&FlagClosed != 0 {
+			return
+		}
+		if rb.casHeader(header, header|uint64(FlagClosed)<<32) {
+			// anyone parked in line for a cell can give up now
+			rb.wakeup()
+			return
 		}
 	}
-	return 0
+}
 
+func (rb *Roundabout) IsClosed() bool {
+	return rb.Flags()&FlagClosed != 0
 }
 
-// run the callback once all other callbacks have ended, regardless of lane
-func (rb *Roundabout) LockRing(fn func(uint16, uint16) error) error {
+// drop everything: every operation waiting on another, or waiting for
+// room in the ring, stops and returns ErrAborted, without running its
+// callback, and so does every operation that would wait until the flag is
+// cleared. operations that don't have to wait carry on as normal, and
+// so do the callbacks already running. returns false if it was already set
+
+func (rb *Roundabout) Abort() bool {
 	for true {
-		rb_cell, ok := rb.push(0, LockRing)
-		if !ok {
-			continue
+		header := rb.header.Load()
+		h := unpackHeader(header)
+		if h.flags&FlagAbort != 0 {
+			return false
+		}
+		if rb.casHeader(header, header|uint64(FlagAbort)<<32) {
+			// parked waiters check the flag before they block, see park()
+			rb.wakeup()
+			return true
 		}
-
-		rb.wait(rb_cell)
-		defer rb.pop(rb_cell)
-		// maybe think about passing in epoch and flags
-		return fn(rb_cell.epoch, rb_cell.flags)
 	}
 	// huh
-	return nil
+	panic(unreachable("Abort"))
 }
 
-// run the callback once all Locked, Order callbacks have ended, regardless of lane
-func (rb *Roundabout) OrderRing(fn func(uint16, uint16) error) error {
+// let operations wait on each other again, returns false if it wasn't set
+
+func (rb *Roundabout) ClearAbort() bool {
 	for true {
-		rb_cell, ok := rb.push(0, OrderRing)
-		if !ok {
-			continue
+		header := rb.header.Load()
+		h := unpackHeader(header)
+		if h.flags&FlagAbort == 0 {
+			return false
+		}
+		if rb.casHeader(header, header&^(uint64(FlagAbort)<<32)) {
+			return true
 		}
-
-		rb.wait(rb_cell)
-		defer rb.pop(rb_cell)
-		// maybe think about passing in epoch and flags
-		return fn(rb_cell.epoch, rb_cell.flags)
 	}
 	// huh
-	return nil
+	panic(unreachable("ClearAbort"))
 }
 
-// run the callback once all Locked callbacks are over, whatever lane
-func (rb *Roundabout) ShareRing(fn func(uint16, uint16) error) error {
-	for true {
-		rb_cell, ok := rb.push(0, ShareRing)
-		if !ok {
-			continue
-		}
+func (rb *Roundabout) IsAborted() bool {
+	return rb.Flags()&FlagAbort != 0
+}
+
+func (rb *Roundabout) aborting() bool {
+	return rb.header.Load()&(uint64(FlagAbort)<<32) != 0
+}
+
+// block until every cell has been popped and no fences are set. unlike
+// WaitForEpoch, this waits for everything, even operations that start
+// while we're waiting, so it's for shutting down once nothing new starts
 
-		rb.wait(rb_cell)
-		defer rb.pop(rb_cell)
+func (rb *Roundabout) Quiesce() {
+	rb.QuiesceContext(context.Background())
+}
+
+// like Quiesce, but gives up with ctx.Err() when ctx is done
 
-		return fn(rb_cell.epoch, rb_cell.flags)
+func (rb *Roundabout) QuiesceContext(ctx context.Context) error {
+	var b rb_backoff
+	for !rb.idle() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b.wait()
 	}
-	// huh
 	return nil
 }
 
-// run the callback once all other callbacks with the same lane are over
-func (rb *Roundabout) LockLane(lane uint32, fn func(uint16, uint16) error) error {
-	for true {
-		rb_cell, ok := rb.push(lane, LockLane)
-		// XXX could count the spins here
-		// and park the thread
+// the flags and the bitmap are both zero, checked on the packed header.
+// the closed and abort flags don't count. closed, so that Close() then
+// Quiesce() works, and abort, as it stays up until it's cleared, and
+// Abort() then Quiesce() should wait for the cells to drain, which they
+// do, as the waiters bail out and pop, rather than for the flag
 
-		if !ok {
+func (rb *Roundabout) idle() bool {
+	return rb.header.Load()&(1<<48-1)&^(uint64(FlagClosed|FlagAbort)<<32) == 0
+}
+
+// run the callback without taking a cell, retrying it if any other
+// operation was in flight, or started, while it was running.
+//
+// the roundabout can't tell readers from writers once they've left
+// the log, so any operation counts as a write here. the callback must
+// only read, and should expect to see torn values that it discards.
+// a read that spans 65536 operations will be fooled by the epoch wrapping
+
+func (rb *Roundabout) OptimisticRead(fn func() error) error {
+	for true {
+		start := rb.Epoch()
+		if rb.Active(start) {
+			// someone's already in there, wait for them to leave
+			continue
+		}
+
+		err := fn()
+
+		// nobody was active when we started, so if nobody
+		// arrived while we were reading, the read is good
+		if rb.Epoch() == start {
+			return err
+		}
+	}
+	// huh
+	panic(unreachable("OptimisticRead"))
+}
+
+// run the callback straight away, without taking a cell or waiting on
+// anyone. the callback is passed the epoch and flags from the header, and
+// Peek returns true if a writer on the same lane was in the log when it
+// started, i.e the callback may have seen a write in progress.
+//
+// nothing stops a writer arriving while the callback runs, so anything it
+// reads may already be stale. a caller that cares can hold on to the epoch
+// and check Epoch() or Active() afterwards, like OptimisticRead does
+
+func (rb *Roundabout) Peek(lane uint32, fn func(uint16, uint16)) (busy bool) {
+	h := unpackHeader(rb.header.Load())
+	busy = rb.writing(h, lane)
+	fn(h.epoch, h.flags)
+	return
+}
+
+// scan the log for a Lock or Order that conflicts with the lane,
+// given a snapshot of the header. cells that haven't been written
+// yet count as writers, as we can't tell what they'll be
+
+func (rb *Roundabout) writing(h Header, lane uint32) bool {
+	oldest := h.epoch - width
+
+	for n := 0; n < width; n++ {
+		if h.bitmap&(1<<n) == 0 {
 			continue
 		}
+		item := unpackCell(rb.log[n].Load())
+
+		if item.kind != ZeroCell && item.epoch-oldest >= width {
+			// it's been popped since the snapshot
+			continue
+		}
+
+		switch item.kind {
+		case ZeroCell, PendingCell:
+			// allocated, but yet to be written
+			return true
+		case LockRing, OrderRing:
+			return true
+		case LockLane, LockLanePriority, OrderLane:
+			if rb.lanesConflict(lane, item.lane) {
+				return true
+			}
+		case LockLaneRange:
+			if !rb.NoLaneConflict && lane >= item.lane && lane <= rb.ranges[n].Load() {
+				return true
+			}
+		default:
+			if item.kind > LockLaneRange && customConflicts(OrderLane, item.kind) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// an OrderLane for a callback that only reads. if the header shows no
+// Lock or Order on the lane, and no ring writes, we run the callback
+// straight away, without a cell, and then check nothing that conflicts
+// arrived while it ran. otherwise, or if the check fails, we throw away
+// what it returned and run it again as an OrderLane, so the callback may
+// run twice, and must only read.
+//
+// unlike OptimisticRead, operations on other lanes, and shares, that are
+// still in the log don't force a retry, but anything that came and went
+// does, as its cell no longer says what it was. like a ShareLane, a fence
+// doesn't wait for the callback when it runs without a cell
+
+func (rb *Roundabout) OrderLaneRead(lane uint32, fn func(uint16, uint16) error) error {
+	h := unpackHeader(rb.header.Load())
+	if h.flags&FlagClosed == 0 && !rb.writing(h, lane) {
+		err := fn(h.epoch, h.flags)
+
+		if !rb.arrived(h.epoch, rb.Epoch(), lane) {
+			return err
+		}
+	}
+	return rb.run(lane, OrderLane, nil, fn)
+}
+
+// did anything that would conflict with an OrderLane on the lane get a
+// cell between the two epochs? a cell that's been popped, or not written
+// yet, might have, and so does anything more than a lap ago
+
+func (rb *Roundabout) arrived(start, end uint16, lane uint32) bool {
+	if end-start >= width {
+		return true
+	}
+	for epoch := start; epoch != end; epoch++ {
+		n := int(epoch) % width
+		item := unpackCell(rb.log[n].Load())
+		if item.epoch != epoch {
+			return true
+		}
+
+		switch item.kind {
+		case ZeroCell, PendingCell, LockRing, OrderRing:
+			return true
+		case LockLane, LockLanePriority, OrderLane:
+			if rb.lanesConflict(lane, item.lane) {
+				return true
+			}
+		case LockLaneRange:
+			if !rb.NoLaneConflict && lane >= item.lane && lane <= rb.ranges[n].Load() {
+				return true
+			}
+		default:
+			if item.kind > LockLaneRange && customConflicts(OrderLane, item.kind) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// if we've been at it for too long
+
+const stuckAfter = 1 << 20
+
+func (rb *Roundabout) spinUnwritten(b *rb_backoff, n int, epoch uint16) {
+	b.spin()
+	if rb.Stuck == nil {
+		return
+	}
+	after := rb.StuckAfter
+	if after <= 0 {
+		after = stuckAfter
+	}
+	if b.n%after == 0 {
+		rb.Stuck(n, epoch)
+	}
+}
+
+// every CAS on the header goes through here, so that tests can make the
+// next few fail, and check that the retry loops recover. it costs one
+// load when there's no fault to inject
+
+func (rb *Roundabout) casHeader(old, new uint64) bool {
+	if rb.faults.Load() > 0 && rb.faults.Add(-1) >= 0 {
+		return false
+	}
+	return rb.header.CompareAndSwap(old, new)
+}
+
+// the outcome of trying to push an item onto the log
+
+type rb_push int
+
+const (
+	pushInserted rb_push = iota // we have a cell
+	pushSlotBusy                // the next slot is still in use, the ring is full
+	pushCASLost                 // another thread claimed the cell first, try again
+	pushClosed                  // the roundabout has been closed
+)
+
+// push a new item onto the log, with a given lane and kind
+// the kind is "Spin" or "SpinRing", and the lane is usually
+// some hash value
+
+func (rb *Roundabout) push(lane uint32, kind uint16) (rb_cell, rb_push) {
+	return rb.pushWide(lane, kind, nil, 0)
+}
+
+// we claim the cell before we publish it in the header, so that anyone
+// who sees our bit in the header will also see our cell. the other way
+// around, a scanner could find the bit set and the cell not yet written,
+// and spin for as long as we're preempted.
+//
+// a free cell holds (epoch, PendingCell, 0) from the last pop, or all
+// zeros on the first lap, and only one thread can CAS it from that to
+// its item. once we have it, no-one else can take this epoch, so the
+// header can only change under us from pops and fences, and we retry
+// until we get our CAS in. if the roundabout closes in the meantime, we
+// put the free cell back, as no-one has been able to see it.
+//
+// a WideRoundabout writes the wide lane in between, once it owns the slot,
+// and so does a LockLaneRange, with the top of its range in wlane
+
+func (rb *Roundabout) pushWide(lane uint32, kind uint16, w *WideRoundabout, wlane uint64) (rb_cell, rb_push) {
+	header := rb.header.Load()
+
+	h := unpackHeader(header)
+
+	if h.flags&FlagClosed != 0 {
+		return rb_cell{}, pushClosed
+	}
+
+	n := int(h.epoch) % width
+	var b uint32 = 1 << n
+
+	if h.bitmap&b != 0 {
+		return rb_cell{}, pushSlotBusy
+	}
+
+	free := rb.log[n].Load()
+	if f := unpackCell(free); free != 0 && (f.kind != PendingCell || f.epoch != h.epoch) {
+		// someone else got here first, or our header is stale
+		return rb_cell{}, pushCASLost
+	}
+
+	item := Cell{h.epoch, kind, lane}.pack()
+	if !rb.log[n].CompareAndSwap(free, item) {
+		return rb_cell{}, pushCASLost
+	}
+
+	if w != nil {
+		w.lanes[n].Store(wlane)
+	} else if kind == LockLaneRange {
+		rb.ranges[n].Store(uint32(wlane))
+	}
+
+	for true {
+		new_header := Header{h.epoch + 1, h.flags, h.bitmap | b}.pack()
+		if rb.casHeader(header, new_header) {
+			break
+		}
+
+		header = rb.header.Load()
+		h = unpackHeader(header)
+		if h.flags&FlagClosed != 0 {
+			rb.log[n].Store(free)
+			return rb_cell{}, pushClosed
+		}
+	}
+	rb.passed(h.epoch)
+
+	// the epoch counts pushes for us, so sampling needs no counter
+	if every := rb.OccupancyEvery; every > 0 && int(h.epoch)%every == 0 {
+		rb.occupancy[bits.OnesCount32(h.bitmap|b)].Add(1)
+	}
+
+	e := rb_cell{
+		n:      n,
+		epoch:  h.epoch,
+		flags:  h.flags,
+		kind:   kind,
+		lane:   lane,
+		bitmap: h.bitmap,
+		wide:   w,
+		wlane:  wlane,
+	}
+	return e, pushInserted
+}
+
+// push a cell, but only onto an empty ring with no flags set, trying once.
+// we claim the cell like pushWide, and then the header CAS from the idle
+// header we saw is the one place we decide: if anything has changed, we
+// put the cell back, as no-one can have seen it, and give up
+
+func (rb *Roundabout) pushIdle(kind uint16) (rb_cell, rb_push) {
+	header := rb.header.Load()
+	h := unpackHeader(header)
+
+	if h.flags&FlagClosed != 0 {
+		return rb_cell{}, pushClosed
+	} else if h.flags != 0 || h.bitmap != 0 {
+		return rb_cell{}, pushSlotBusy
+	}
+
+	n := int(h.epoch) % width
+	free := rb.log[n].Load()
+	if f := unpackCell(free); free != 0 && (f.kind != PendingCell || f.epoch != h.epoch) {
+		return rb_cell{}, pushCASLost
+	}
+	if !rb.log[n].CompareAndSwap(free, Cell{h.epoch, kind, 0}.pack()) {
+		return rb_cell{}, pushCASLost
+	}
+
+	if !rb.casHeader(header, Header{h.epoch + 1, 0, 1 << n}.pack()) {
+		rb.log[n].Store(free)
+		return rb_cell{}, pushCASLost
+	}
+	rb.passed(h.epoch)
+	return rb_cell{n: n, epoch: h.epoch, kind: kind}, pushInserted
+}
+
+// after allocating a rb_cell on the roundabout, we scan predecessors
+// to find conflicts
+
+func (rb *Roundabout) wait(r rb_cell) error {
+	return rb.waitDone(r, nil)
+}
+
+// like wait, but gives up and returns errDone if done closes while we're
+// parked on a predecessor. either way, if the abort flag goes up while
+// we're waiting, we give up with ErrAborted, and the cell is still ours
+// to pop
+
+func (rb *Roundabout) waitDone(r rb_cell, done <-chan struct{}) error {
+	_, err := rb.waitCount(r, done)
+	return err
+}
+
+// like waitDone, but also counts the predecessors we waited for, the ones
+// that conflicted with us when we got to them, rather than the cells we
+// scanned, or the times we spun
+
+func (rb *Roundabout) waitCount(r rb_cell, done <-chan struct{}) (waited int, err error) {
+	// n.b we will never scan epoch -width to 0 for the first cycle
+	// as the bitmap in the header is all zeros
+
+	if r.bitmap == 0 {
+		return 0, nil
+	}
+
+	// we check from epoch-width+1 to epoch-1, so we shift the free bitmap
+	// so that our cell is in the lsb, and then drop it
+	bitmap := rotateBitmap(r.bitmap, r.n) &^ 1
+
+	// the free bitmap is a snapshot of where we were on allocation
+	// so will not include any items ahead of us
+
+	// with AdaptiveSpin, we time from the first conflict we see, so
+	// uncontended waits don't call time.Now()
+	yields := rb.parkAfter()
+	var started time.Time
+	if rb.AdaptiveSpin {
+		defer func() {
+			if !started.IsZero() {
+				rb.sampleWait(time.Since(started))
+			}
+		}()
+	}
+
+	// we jump over each run of free space in one go, rather than a slot
+	// at a time, as most of the bitmap is free most of the time
+	epoch := r.epoch - width
+	for ; bitmap != 0; epoch, bitmap = epoch+1, bitmap>>1 {
+		skip := bits.TrailingZeros32(bitmap)
+		epoch += uint16(skip)
+		bitmap >>= skip
+		n := int(epoch) % width
+		b := rb_backoff{priority: r.kind == LockLanePriority, done: done, yields: yields}
+		blocked := false
+		for true {
+			raw := rb.log[n].Load()
+			item := unpackCell(raw)
+			if item.kind == ZeroCell {
+				// spin, uninitialised memory
+				rb.spinUnwritten(&b, n, epoch)
+				continue
+			} else if item.epoch == epoch {
+				// item has expected epoch of item in past
+				// has been allocated on bitmap
+				// check cell has been written
+
+				if item.kind == PendingCell {
+					// the log cell has been allocated in the bitmap
+					// but the thread has yet to write to it, so spin.
+					// push writes the cell first, so this means the
+					// cell was lost, see Stuck
+					rb.spinUnwritten(&b, n, epoch)
+					continue
+				}
+
+				if rb.conflicts(r, n, item) {
+					if !blocked {
+						blocked = true
+						waited++
+					}
+					if rb.aborting() {
+						return waited, ErrAborted
+					}
+					if rb.AdaptiveSpin && started.IsZero() {
+						started = time.Now()
+					}
+					// spin, and then park until the cell changes
+					b.park(rb, &rb.log[n].Uint64, raw)
+					if b.cancelled() {
+						return waited, errDone
+					}
+					continue
+				}
+			}
+
+			break
+		}
+	}
+	return waited, nil
+}
+
+// does an earlier item block the cell? we check the kinds first,
+// then fall through to checking the lanes
+
+func (rb *Roundabout) conflicts(r rb_cell, n int, item Cell) bool {
+	// priority only changes how we wait, not who we wait for
+	if r.kind == LockLanePriority {
+		r.kind = LockLane
+	}
+	if item.kind == LockLanePriority {
+		item.kind = LockLane
+	}
+
+	// the log is in order, so a reader never gets in ahead of a writer
+	// that arrived first, and the writer only waits for the readers that
+	// were there before it. but readers on other lanes still run while
+	// it waits, and with WriterPreference, they queue up behind it too
+	if rb.WriterPreference && (r.kind == ShareLane || r.kind == ShareRing) {
+		switch item.kind {
+		case LockLane, LockRing, LockLaneRange:
+			return true
+		}
+	}
+
+	if r.kind > LockLaneRange || item.kind > LockLaneRange {
+		return customConflicts(r.kind, item.kind)
+	}
+	if r.kind == LockLaneRange || item.kind == LockLaneRange {
+		return rb.rangeConflicts(r, n, item)
+	}
+
+	if r.kind == LockRing || item.kind == LockRing {
+		// we wait for all predecessors
+		return true
+	} else if r.kind == OrderRing {
+		// atomics not blocked by reads
+		if item.kind == ShareLane || item.kind == ShareRing {
+			return false
+		}
+		// we block on all Lock, Order predecessors
+		// and atomics
+		return true
+
+	} else if r.kind == ShareRing {
+		// we block when we see a Lock, but not Share or Atomics
+		return item.kind == LockLane || item.kind == LockRing
+
+	} else if r.kind == LockLane {
+		// block on all wide actions
+		if item.kind == LockRing || item.kind == OrderRing || item.kind == ShareRing {
+			return true
+		}
+		// check lane below for LockLane, OrderLane, ShareLane
+
+	} else if r.kind == OrderLane {
+		// block on all wide actions, except reads
+		if item.kind == LockRing || item.kind == OrderRing {
+			return true
+		}
+		// ignore reads
+		if item.kind == ShareLane || item.kind == ShareRing {
+			return false
+		}
+		// check lane for LockLane, OrderLane
+
+	} else if r.kind == ShareLane {
+		// blocked by any Lock
+		if item.kind == LockRing {
+			return true
+		}
+		// ignores atomics, reads
+		if item.kind == OrderLane || item.kind == OrderRing {
+			return false
+		}
+		if item.kind == ShareLane || item.kind == ShareRing {
+			return false
+		}
+		// check lane for LockLane below
+	}
+	// if we're a Lock lane, we chec Lock, atomic, read lane here
+	// if we're an atomic lane, we chec Lock, atomic lane here
+	// if we're a read lane, we chec Lock lane here
+
+	if r.wide != nil {
+		return r.wide.conflicts(r, n, item)
+	} else if r.conflict != nil {
+		return callConflict(r.conflict, r.lane, item.lane, r, item)
+	} else if rb.Conflict != nil && !rb.NoLaneConflict {
+		return callConflict(rb.Conflict, r.lane, item.lane, r, item)
+	}
+	return rb.lanesConflict(r.lane, item.lane)
+}
+
+// a panic in a conflict function, re-raised with the two operations it
+// was comparing, as the stack alone only says we were in wait(). the cell
+// is still popped on the way out. it unwraps to the original panic, if
+// that was an error
+
+type ConflictPanic struct {
+	Lane, Other     uint64 // the waiter's lane, and the lane it was checking
+	Kind, OtherKind uint16
+	Value           any // what the conflict function panicked with
+}
+
+func (p ConflictPanic) Error() string {
+	return fmt.Sprintf("crow: conflict function panicked comparing %s on lane %d with %s on lane %d: %v",
+		kindName(p.Kind), p.Lane, kindName(p.OtherKind), p.Other, p.Value)
+}
+
+func (p ConflictPanic) Unwrap() error {
+	err, _ := p.Value.(error)
+	return err
+}
+
+func callConflict[L uint32 | uint64](fn func(L, L) bool, a, b L, r rb_cell, item Cell) bool {
+	defer func() {
+		if p := recover(); p != nil {
+			panic(ConflictPanic{uint64(a), uint64(b), r.kind, item.kind, p})
+		}
+	}()
+	return fn(a, b)
+}
+
+// when either cell is a LockLaneRange, it's a LockLane over more than one
+// lane. every ring operation conflicts with a LockLane, either way round,
+// and every lane operation checks a LockLane's lane, so it's down to
+// whether the lanes overlap. ranges are numeric, so rb.Conflict and the
+// *With functions don't apply to them. we read the top of the item's range
+// like a wide lane, see WideRoundabout
+
+func (rb *Roundabout) rangeConflicts(r rb_cell, n int, item Cell) bool {
+	switch {
+	case r.kind == LockRing || r.kind == OrderRing || r.kind == ShareRing:
+		return true
+	case item.kind == LockRing || item.kind == OrderRing || item.kind == ShareRing:
+		return true
+	case rb.NoLaneConflict:
+		return false
+	}
+
+	lo, hi := r.lane, r.lane
+	if r.kind == LockLaneRange {
+		hi = uint32(r.wlane)
+	}
+	ilo, ihi := item.lane, item.lane
+	if item.kind == LockLaneRange {
+		ihi = rb.ranges[n].Load()
+		if rb.log[n].Load() != item.pack() {
+			// the cell has moved on, so we can't trust the range, and
+			// we say it conflicts so that wait() looks at the cell again
+			return true
+		}
+	}
+	return lo <= ihi && ilo <= hi
+}
+
+// the default for two lanes, when the operation doesn't bring its own
+
+func (rb *Roundabout) lanesConflict(a, b uint32) bool {
+	if rb.NoLaneConflict {
+		return false
+	} else if rb.Conflict == nil {
+		return a == b
+	}
+	return rb.Conflict(a, b)
+}
+
+// mark our work as complete, updating the item in the buffer
+// before updating the header. the store to the log is what hands our
+// writes on: anyone waiting on us loads this cell before they run, and
+// go's atomics are sequentially consistent, so no fence is needed
+func (rb *Roundabout) pop(r rb_cell) {
+	if checkPops {
+		rb.checkPop(r)
+	}
+	if rb.local[r.n].Load() != nil {
+		rb.local[r.n].Store(nil)
+	}
+	next_item := Cell{r.epoch + width, PendingCell, 0}.pack()
+	rb.log[r.n].Store(next_item)
+
+	var b uint64 = 1 << r.n
+	rb.header.And(^b) // go 1.23 needed
+
+	rb.wakeup()
+	if rb.OnPop != nil {
+		rb.OnPop(r.epoch, r.kind, r.lane)
+	}
+}
+
+// pop clears the bit for the slot without looking, so a stale rb_cell, or
+// one from another roundabout, frees whoever has the slot now, and they
+// carry on with their bit gone. with -tags crowdebug, we check the slot
+// still holds our epoch first, and panic if it doesn't. a cell that was
+// never written still has our epoch, so a lost cell can be popped
+
+func (rb *Roundabout) checkPop(r rb_cell) {
+	if c := unpackCell(rb.log[r.n].Load()); c.epoch != r.epoch {
+		panic(fmt.Sprintf("crow: popping a cell we don't hold: slot %d has %s from epoch %d, not epoch %d",
+			r.n, kindName(c.kind), c.epoch, r.epoch))
+	}
+}
+
+// update the header in the buffer, so that all
+// new mutators see flags
+
+func (rb *Roundabout) setFence(flags uint16) (rb_fence, bool) {
+	header := rb.header.Load()
+	h := unpackHeader(header)
+
+	if h.flags&(flags|FlagClosed) != 0 {
+		// can't set flags, already set, or we're closed
+		return rb_fence{}, false
+	}
+
+	new_header := Header{h.epoch, h.flags | flags, h.bitmap}.pack()
+
+	if rb.casHeader(header, new_header) {
+		if flags&FlagAbort != 0 {
+			rb.wakeup()
+		}
+		s := rb_fence{
+			epoch:     h.epoch,
+			flags:     flags,
+			new_flags: h.flags | flags,
+			bitmap:    h.bitmap,
+		}
+		return s, true
+	}
+	return rb_fence{}, false
+}
+
+// now that we've update the header, we wait for
+// all earlier work to complete
+
+func (rb *Roundabout) spinFence(s rb_fence) {
+	if s.bitmap == 0 {
+		return
+	}
+
+	// there's no allocation made for flag changes
+	// so we check from epoch-width to epoch-1
+
+	// we shift the free bitmap so that epoch's cell is in the lsb
+	// and epoch +1 is in next larger bit.
+	bitmap := rotateBitmap(s.bitmap, int(s.epoch)%width)
+
+	// the free bitmap is a snapshot of where we were on header update
+	// so will not include any items ahead of us. like waitCount, we
+	// skip over the free space a run at a time
+
+	epoch := s.epoch - width
+	for ; bitmap != 0; epoch, bitmap = epoch+1, bitmap>>1 {
+		skip := bits.TrailingZeros32(bitmap)
+		epoch += uint16(skip)
+		bitmap >>= skip
+		n := int(epoch) % width
+		var b rb_backoff
+		for true {
+			raw := rb.log[n].Load()
+			item := unpackCell(raw)
+			if item.kind == ZeroCell {
+				// spin, uninitialised memory
+				rb.spinUnwritten(&b, n, epoch)
+				continue
+			} else if item.epoch == epoch {
+				// spin, predecessor still active
+				// unless it's a read, which we can ignore
+				// may want to have diff fence or spinWriters
+				// but cant think of why we'd need a fence that waits
+				// for old readers that wouldn't be a LockRing
+
+				if item.kind == ShareLane || item.kind == ShareRing {
+					break
+				}
+				if item.kind == PendingCell {
+					rb.spinUnwritten(&b, n, epoch)
+				} else {
+					b.park(rb, &rb.log[n].Uint64, raw)
+				}
+				continue
+			}
+
+			break
+		}
+	}
+}
+
+// clear out flags, OR'ing out our changes
+// and again, only affecting new threads
+
+func (rb *Roundabout) clearFence(s rb_fence) uint16 {
+	for true {
+		header := rb.header.Load()
+		h := unpackHeader(header)
 
-		rb.wait(rb_cell)
-		defer rb.pop(rb_cell)
+		new_header := Header{h.epoch, h.flags ^ s.flags, h.bitmap}.pack()
 
-		return fn(rb_cell.epoch, rb_cell.flags)
+		if rb.casHeader(header, new_header) {
+			rb.wakeup()
+			return h.epoch
+		}
 	}
 	// huh
-	return nil
+	panic(unreachable("clearFence"))
 }
 
-// run the callback when no other Locked, Order callbacks with the same lane are active
-func (rb *Roundabout) OrderLane(lane uint32, fn func(uint16, uint16) error) error {
+// allocate a cell on the log for want, which has the lane, kind, and
+// conflict function set, and for a WideRoundabout, the wide lane, see
+// pushWide(). if done closes while we're queued for a cell, we give up
+// with errDone, and if try is set, we don't queue at all, and return
+// ErrRingFull instead
+
+func (rb *Roundabout) enter(want rb_cell, done <-chan struct{}, try bool) (rb_cell, error) {
+	if rb.guards.Load() != 0 {
+		rb.checkGuard(want.kind)
+	}
+
+	var b rb_backoff
+	priority := want.kind == LockLanePriority
 	for true {
-		rb_cell, ok := rb.push(lane, OrderLane)
-		// XXX could count the spins here
-		// and park the thread
+		if !priority && rb.arrivals.Load() != rb.admitted.Load() {
+			// someone's waiting for the ring, get in line
+			if try {
+				return rb_cell{}, ErrRingFull
+			}
+			return rb.enterQueued(want, done)
+		}
 
-		if !ok {
+		rb_cell, r := rb.pushWide(want.lane, want.kind, want.wide, want.wlane)
+
+		if r == pushClosed {
+			return rb_cell, ErrClosed
+		} else if r == pushSlotBusy && try {
+			return rb_cell, ErrRingFull
+		} else if r == pushSlotBusy && !priority {
+			return rb.enterQueued(want, done)
+		} else if r != pushInserted {
+			b.spin()
 			continue
 		}
 
-		rb.wait(rb_cell)
-		defer rb.pop(rb_cell)
-
-		return fn(rb_cell.epoch, rb_cell.flags)
+		rb_cell.conflict = want.conflict
+		return rb_cell, nil
 	}
 	// huh
-	return nil
+	panic(unreachable("enter"))
 }
 
-// run the callback when no Locked with the same lane are active
-func (rb *Roundabout) ShareLane(lane uint32, fn func(uint16, uint16) error) error {
+// once we have a cell, the epochs put us in order, and we never wait on
+// anyone who came after us. before that, we're either racing on the CAS
+// in push, which only loses to someone who pushed while we were trying,
+// or we're waiting for the ring to have room, and then it's whoever looks
+// first after a pop, which can starve a goroutine under load.
+//
+// so when the ring is full, we take a ticket and wait for our turn to
+// push, and anyone arriving while there's a queue joins the back of it.
+//
+// with FullQueue set, we turn away anyone who'd be too far back, and with
+// FullWait set, we park rather than spin, and give up when it runs out
+
+func (rb *Roundabout) enterQueued(want rb_cell, done <-chan struct{}) (rb_cell, error) {
+	ticket := rb.arrivals.Add(1) - 1
+	if limit := rb.FullQueue; limit > 0 && int(ticket-rb.admitted.Load()) >= limit {
+		rb.leaveQueue(ticket)
+		return rb_cell{}, ErrRingFull
+	}
+
+	var expired <-chan time.Time
+	if rb.FullWait > 0 {
+		t := time.NewTimer(rb.FullWait)
+		defer t.Stop()
+		expired = t.C
+	}
+	turn := func() bool { return rb.admitted.Load() == ticket }
+
+	b := rb_backoff{done: done}
+	for !turn() {
+		if b.cancelled() {
+			rb.leaveQueue(ticket)
+			return rb_cell{}, errDone
+		} else if rb.aborting() {
+			rb.leaveQueue(ticket)
+			return rb_cell{}, ErrAborted
+		} else if expired == nil {
+			b.spin()
+		} else if rb.parkQueued(turn, done, expired) {
+			rb.leaveQueue(ticket)
+			return rb_cell{}, ErrRingFull
+		}
+	}
+	defer rb.admit(ticket)
+
+	b = rb_backoff{done: done}
 	for true {
-		rb_cell, ok := rb.push(lane, ShareLane)
-		if !ok {
+		rb_cell, r := rb.pushWide(want.lane, want.kind, want.wide, want.wlane)
+
+		if r == pushClosed {
+			return rb_cell, ErrClosed
+		} else if r == pushSlotBusy && rb.aborting() {
+			return rb_cell, ErrAborted
+		} else if r == pushSlotBusy && expired != nil {
+			if b.cancelled() {
+				return rb_cell, errDone
+			} else if rb.parkQueued(rb.roomy, done, expired) {
+				return rb_cell, ErrRingFull
+			}
+			continue
+		} else if r != pushInserted {
+			b.spin()
 			continue
 		}
 
-		rb.wait(rb_cell)
-		defer rb.pop(rb_cell)
+		rb_cell.conflict = want.conflict
+		return rb_cell, nil
+	}
+	// huh
+	panic(unreachable("enterQueued"))
+}
+
+// is there room for the next push, or a reason to stop waiting for it?
+
+func (rb *Roundabout) roomy() bool {
+	h := unpackHeader(rb.header.Load())
+	return h.bitmap&(1<<(int(h.epoch)%width)) == 0 || h.flags&(FlagClosed|FlagAbort) != 0
+}
+
+// hand the turn on from ticket, skipping over anyone who's given up, and
+// wake the next in line if it's parked
+
+func (rb *Roundabout) admit(ticket uint32) {
+	for true {
+		ticket = rb.admitted.Add(1)
+		if _, ok := rb.skipped.LoadAndDelete(ticket); !ok {
+			rb.wakeup()
+			return
+		}
+	}
+	// huh
+	panic(unreachable("admit"))
+}
+
+// give up a ticket before its turn. whoever admits it will skip over it,
+// unless it became our turn while we were leaving, in which case one of
+// us finds the ticket in skipped and hands the turn on, and the other
+// doesn't
+
+func (rb *Roundabout) leaveQueue(ticket uint32) {
+	rb.skipped.Store(ticket, struct{}{})
+	if rb.admitted.Load() != ticket {
+		return
+	}
+	if _, ok := rb.skipped.LoadAndDelete(ticket); ok {
+		rb.admit(ticket)
+	}
+}
+
+// run the callback inside a cell, popping it afterwards. we defer the pop
+// before we wait, so that a panic in a conflict function can't leak the
+// cell, and outside of a loop, so that the defer is open coded, which
+// matters on the idle path
+
+func (rb *Roundabout) once(want rb_cell, fn func(uint16, uint16) error) error {
+	rb_cell, err := rb.enter(want, nil, false)
+	if err != nil {
+		return err
+	}
+	defer rb.pop(rb_cell)
+	if err = rb.wait(rb_cell); err != nil {
+		return err
+	}
+
+	if checkNesting {
+		rb.guard(kindName(want.kind), func() {
+			err = fn(rb_cell.epoch, rb_cell.flags)
+		})
+		return err
+	}
+	return fn(rb_cell.epoch, rb_cell.flags)
+}
+
+// run the callback, and if it returns ErrRetry, run it again in a new cell
+
+func (rb *Roundabout) run(lane uint32, kind uint16, conflict func(uint32, uint32) bool, fn func(uint16, uint16) error) error {
+	return rb.runCell(rb_cell{lane: lane, kind: kind, conflict: conflict}, fn)
+}
+
+// like run, with the count from waitCount, see ShareRingWithWaitCount
+
+func (rb *Roundabout) runCounted(kind uint16, fn func(uint16, uint16, int) error) error {
+	for true {
+		err := rb.onceCounted(rb_cell{kind: kind}, fn)
+		if !errors.Is(err, ErrRetry) {
+			return err
+		}
+	}
+	// huh
+	panic(unreachable("runCounted"))
+}
+
+func (rb *Roundabout) onceCounted(want rb_cell, fn func(uint16, uint16, int) error) error {
+	rb_cell, err := rb.enter(want, nil, false)
+	if err != nil {
+		return err
+	}
+	defer rb.pop(rb_cell)
+	waited, err := rb.waitCount(rb_cell, nil)
+	if err != nil {
+		return err
+	}
+
+	if checkNesting {
+		rb.guard(kindName(want.kind), func() {
+			err = fn(rb_cell.epoch, rb_cell.flags, waited)
+		})
+		return err
+	}
+	return fn(rb_cell.epoch, rb_cell.flags, waited)
+}
+
+func (rb *Roundabout) runCell(want rb_cell, fn func(uint16, uint16) error) error {
+	for true {
+		err := rb.once(want, fn)
+		if !errors.Is(err, ErrRetry) {
+			return err
+		}
+	}
+	// huh
+	panic(unreachable("runCell"))
+}
+
+// the ring operations take their cell the way acquire does, but with
+// no context there's nothing to give up on, so they skip it, and the
+// ticket and the deferred closure that come with it. an ErrRetry runs
+// the callback again in a new cell
+
+func (rb *Roundabout) runRing(kind uint16, fn func(uint16, uint16) error) error {
+	for true {
+		err := rb.ringOnce(kind, fn)
+		if !errors.Is(err, ErrRetry) {
+			return err
+		}
+	}
+	// huh
+	panic(unreachable("runRing"))
+}
+
+// enter and waitDone with a nil done channel, like acquire with a
+// background context. the pop is deferred before we wait, so a panic in
+// a conflict function can't leak the cell, and outside of a loop, so
+// that it's open coded, as in once
 
-		return fn(rb_cell.epoch, rb_cell.flags)
+func (rb *Roundabout) ringOnce(kind uint16, fn func(uint16, uint16) error) error {
+	rb_cell, err := rb.enter(rb_cell{kind: kind}, nil, false)
+	if err != nil {
+		return err
+	}
+	defer rb.pop(rb_cell)
+	if err = rb.waitDone(rb_cell, nil); err != nil {
+		return err
+	}
+
+	if checkNesting {
+		rb.guard(kindName(kind), func() {
+			err = fn(rb_cell.epoch, rb_cell.flags)
+		})
+		return err
+	}
+	return fn(rb_cell.epoch, rb_cell.flags)
+}
+
+// run the callback once all other callbacks have ended, regardless of lane
+func (rb *Roundabout) LockRing(fn func(uint16, uint16) error) error {
+	return rb.runRing(LockRing, fn)
+}
+
+// run the callback like LockRing, but only if nothing else is in the
+// roundabout, and no fence is running. it doesn't wait or spin: if the
+// ring is in use, or someone beats us to it, it returns false without
+// running the callback. an ErrRetry from the callback is returned as is,
+// as there's no second try
+
+func (rb *Roundabout) IfIdle(fn func(uint16, uint16) error) (ran bool, err error) {
+	rb_cell, r := rb.pushIdle(LockRing)
+	if r == pushClosed {
+		return false, ErrClosed
+	} else if r != pushInserted {
+		return false, nil
+	}
+	defer rb.pop(rb_cell)
+
+	if checkNesting {
+		rb.guard("IfIdle", func() {
+			err = fn(rb_cell.epoch, rb_cell.flags)
+		})
+		return true, err
+	}
+	return true, fn(rb_cell.epoch, rb_cell.flags)
+}
+
+// run the callback like LockRing, but the callback can downgrade to a ShareRing
+// part way through, letting readers in while keeping Locks out. downgrading
+// rewrites the kind of our cell in the log, and any readers spinning on it
+// will see the change and carry on
+
+func (rb *Roundabout) LockRingDowngrade(fn func(epoch uint16, flags uint16, downgrade func()) error) error {
+	for true {
+		err := rb.downgradeOnce(fn)
+		if !errors.Is(err, ErrRetry) {
+			return err
+		}
 	}
 	// huh
+	panic(unreachable("LockRingDowngrade"))
+}
+
+func (rb *Roundabout) downgradeOnce(fn func(uint16, uint16, func()) error) error {
+	rb_cell, err := rb.enter(rb_cell{kind: LockRing}, nil, false)
+	if err != nil {
+		return err
+	}
+	defer rb.pop(rb_cell)
+	if err = rb.wait(rb_cell); err != nil {
+		return err
+	}
+
+	downgrade := func() {
+		rb.log[rb_cell.n].Store(Cell{rb_cell.epoch, ShareRing, rb_cell.lane}.pack())
+		rb.wakeup()
+	}
+	if checkNesting {
+		rb.guard("LockRingDowngrade", func() {
+			err = fn(rb_cell.epoch, rb_cell.flags, downgrade)
+		})
+		return err
+	}
+	return fn(rb_cell.epoch, rb_cell.flags, downgrade)
+}
+
+// run the callback once all Locked, Order callbacks have ended, regardless of lane
+func (rb *Roundabout) OrderRing(fn func(uint16, uint16) error) error {
+	return rb.runRing(OrderRing, fn)
+}
+
+// run the callback once all Locked callbacks are over, whatever lane
+func (rb *Roundabout) ShareRing(fn func(uint16, uint16) error) error {
+	return rb.runRing(ShareRing, fn)
+}
+
+// like LockRing, OrderRing, and ShareRing, but the callback is also told
+// how many of the operations before it we had to wait for, for working
+// out why a call was slow. it's the number of earlier cells that blocked
+// us, however long each one took
+
+func (rb *Roundabout) LockRingWithWaitCount(fn func(epoch uint16, flags uint16, waited int) error) error {
+	return rb.runCounted(LockRing, fn)
+}
+
+func (rb *Roundabout) OrderRingWithWaitCount(fn func(epoch uint16, flags uint16, waited int) error) error {
+	return rb.runCounted(OrderRing, fn)
+}
+
+func (rb *Roundabout) ShareRingWithWaitCount(fn func(epoch uint16, flags uint16, waited int) error) error {
+	return rb.runCounted(ShareRing, fn)
+}
+
+// run the callback once all other callbacks with the same lane are over
+func (rb *Roundabout) LockLane(lane uint32, fn func(uint16, uint16) error) error {
+	return rb.run(lane, LockLane, nil, fn)
+}
+
+// like LockLane, but over every lane from lo to hi, inclusive. it waits for
+// any lane operation on a lane in the range, and any other range that
+// overlaps it, and they wait for it in turn. lanes are compared as numbers,
+// so rb.Conflict doesn't apply, see rangeConflicts
+
+func (rb *Roundabout) LockLaneRange(lo, hi uint32, fn func(uint16, uint16) error) error {
+	if lo > hi {
+		panic(fmt.Sprintf("crow: LockLaneRange from %d down to %d", lo, hi))
+	}
+	return rb.runCell(rb_cell{lane: lo, kind: LockLaneRange, wlane: uint64(hi)}, fn)
+}
+
+// like LockLane, but while it's in progress, other waiters park rather than
+// spin, and if the ring is full, it skips the queue for a cell. it still
+// waits for everything before it in the lane, so it's no less safe, it
+// just gets more of the cpu, and gets in sooner
+
+func (rb *Roundabout) LockLanePriority(lane uint32, fn func(uint16, uint16) error) error {
+	rb.priority.Add(1)
+	defer rb.priority.Add(-1)
+	return rb.run(lane, LockLanePriority, nil, fn)
+}
+
+// run the callback when no other Locked, Order callbacks with the same lane are active
+func (rb *Roundabout) OrderLane(lane uint32, fn func(uint16, uint16) error) error {
+	return rb.run(lane, OrderLane, nil, fn)
+}
+
+// run the callback when no Locked with the same lane are active
+func (rb *Roundabout) ShareLane(lane uint32, fn func(uint16, uint16) error) error {
+	return rb.run(lane, ShareLane, nil, fn)
+}
+
+// the *Range variants also return the epoch when the callback finished.
+// start is our own epoch, and everything between start and end started
+// while we ran. the operations before start were waited for, and the
+// ones after didn't start until we'd finished, unless they don't
+// conflict with us
+
+func (rb *Roundabout) runRange(kind uint16, fn func(uint16, uint16) error) (start, end uint16, err error) {
+	err = rb.run(0, kind, nil, func(epoch uint16, flags uint16) error {
+		start = epoch
+		err := fn(epoch, flags)
+		end = rb.Epoch()
+		return err
+	})
+	return
+}
+
+// like LockRing, returning the epochs it ran between
+func (rb *Roundabout) LockRingRange(fn func(uint16, uint16) error) (start, end uint16, err error) {
+	return rb.runRange(LockRing, fn)
+}
+
+// like OrderRing, returning the epochs it ran between
+func (rb *Roundabout) OrderRingRange(fn func(uint16, uint16) error) (start, end uint16, err error) {
+	return rb.runRange(OrderRing, fn)
+}
+
+// like ShareRing, returning the epochs it ran between
+func (rb *Roundabout) ShareRingRange(fn func(uint16, uint16) error) (start, end uint16, err error) {
+	return rb.runRange(ShareRing, fn)
+}
+
+// the *Live variants pass the callback a function that reads the current
+// flags, as the flags argument is a snapshot from when we got our cell.
+// fences don't wait for readers, so a long read can use it to notice a
+// fence that started after it did
+
+// like ShareRing, with a function to read the current flags
+func (rb *Roundabout) ShareRingLive(fn func(epoch uint16, flags uint16, live func() uint16) error) error {
+	return rb.run(0, ShareRing, nil, func(epoch uint16, flags uint16) error {
+		return fn(epoch, flags, rb.Flags)
+	})
+}
+
+// like ShareLane, with a function to read the current flags
+func (rb *Roundabout) ShareLaneLive(lane uint32, fn func(epoch uint16, flags uint16, live func() uint16) error) error {
+	return rb.run(lane, ShareLane, nil, func(epoch uint16, flags uint16) error {
+		return fn(epoch, flags, rb.Flags)
+	})
+}
+
+// the *Local variants pass the callback a CellLocal, a slot for one value
+// kept alongside the cell, for scratch state that lives as long as the
+// callback, like a list of things to free afterwards. it's cleared when the
+// cell is popped, so nothing carries over to the next cell in the slot,
+// or to a retry
+
+type CellLocal struct {
+	p *atomic.Pointer[any]
+}
+
+func (c CellLocal) Load() any {
+	if p := c.p.Load(); p != nil {
+		return *p
+	}
 	return nil
 }
 
+func (c CellLocal) Store(v any) {
+	c.p.Store(&v)
+}
+
+func (rb *Roundabout) runLocal(lane uint32, kind uint16, fn func(uint16, uint16, CellLocal) error) error {
+	return rb.run(lane, kind, nil, func(epoch uint16, flags uint16) error {
+		return fn(epoch, flags, CellLocal{&rb.local[int(epoch)%width]})
+	})
+}
+
+// like LockRing, with a CellLocal
+func (rb *Roundabout) LockRingLocal(fn func(epoch uint16, flags uint16, local CellLocal) error) error {
+	return rb.runLocal(0, LockRing, fn)
+}
+
+// like LockLane, with a CellLocal
+func (rb *Roundabout) LockLaneLocal(lane uint32, fn func(epoch uint16, flags uint16, local CellLocal) error) error {
+	return rb.runLocal(lane, LockLane, fn)
+}
+
+// the *With variants take a conflict function to use in place of rb.Conflict,
+// for this operation only. it decides if this operation waits on an earlier
+// one in another lane, and later operations will use their own function
+// to decide if they wait on this one
+
+// like LockLane, but with a conflict function for this call
+func (rb *Roundabout) LockLaneWith(lane uint32, conflict func(uint32, uint32) bool, fn func(uint16, uint16) error) error {
+	return rb.run(lane, LockLane, conflict, fn)
+}
+
+// like OrderLane, but with a conflict function for this call
+func (rb *Roundabout) OrderLaneWith(lane uint32, conflict func(uint32, uint32) bool, fn func(uint16, uint16) error) error {
+	return rb.run(lane, OrderLane, conflict, fn)
+}
+
+// like ShareLane, but with a conflict function for this call
+func (rb *Roundabout) ShareLaneWith(lane uint32, conflict func(uint32, uint32) bool, fn func(uint16, uint16) error) error {
+	return rb.run(lane, ShareLane, conflict, fn)
+}
+
+// what an operation sees of a fence
+//
+// an operation's epoch and flags come from the same header, in the same
+// CAS that allocates its cell, and a fence sets and clears its flags with
+// a CAS on that header too, so every operation is either before or after
+// each change of flags, and its flags say which:
+//
+// - if the flag is set in an operation's flags, it got its cell after the
+//   fence set the flag, and anything the fence did before setting the flag
+//   happens-before the operation's callback
+// - if the flag isn't set, it got its cell before the fence, or after the
+//   fence cleared it. if it's before, the fence waits for it to finish,
+//   unless it's a ShareLane or ShareRing, which fences don't wait for
+// - a flag raised after we got our cell won't show up in our flags, but
+//   a *Live callback can see it, see ShareRingLive
+//
+// so a reader that doesn't see a flag can't assume the fence hasn't
+// started, but a reader that does see it knows the fence is underway
+
 // update these flags, run the callback, clear the flags
 func (rb *Roundabout) Fence(flags uint16, fn func(uint16, uint16) error) error {
+	var b rb_backoff
 	for true {
 		rb_fence, ok := rb.setFence(flags) // spins until flags are set
 		if !ok {
+			if rb.IsClosed() {
+				return ErrClosed
+			}
+			b.spin()
 			continue
 		}
 
+		defer rb.clearFence(rb_fence)
 		rb.spinFence(rb_fence)
 
-		defer rb.clearFence(rb_fence)
 		return fn(rb_fence.epoch, rb_fence.new_flags)
 	}
-	return nil
+	// huh
+	panic(unreachable("Fence"))
+}
+
+// like Fence, but the callback gets a context that's cancelled when ctx is
+// done, so that a long running callback can check if it should give up.
+// if ctx is done before we can set the flags, we return ctx.Err() without
+// running the callback
+
+func (rb *Roundabout) FenceContext(ctx context.Context, flags uint16, fn func(context.Context, uint16, uint16) error) error {
+	var b rb_backoff
+	for true {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rb_fence, ok := rb.setFence(flags) // spins until flags are set
+		if !ok {
+			if rb.IsClosed() {
+				return ErrClosed
+			}
+			b.spin()
+			continue
+		}
+
+		defer rb.clearFence(rb_fence)
+		rb.spinFence(rb_fence)
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		return fn(ctx, rb_fence.epoch, rb_fence.new_flags)
+	}
+	// huh
+	panic(unreachable("FenceContext"))
 }
 
 // update the flags, run the first callback,
 // clear the flags, run the second callback
 
 func (rb *Roundabout) Phase(flags uint16, fn func(uint16, uint16) error, after func(uint16, uint16) error) error {
+	var b rb_backoff
 	for true {
 		rb_fence, ok := rb.setFence(flags) // spins until flags are set
 		if !ok {
+			if rb.IsClosed() {
+				return ErrClosed
+			}
+			b.spin()
 			continue
 		}
 
+		// clear the flags if we panic before we get to do it ourselves
+		cleared := false
+		defer func() {
+			if !cleared {
+				rb.clearFence(rb_fence)
+			}
+		}()
 		rb.spinFence(rb_fence)
 
 		err := fn(rb_fence.epoch, rb_fence.new_flags)
 		end := rb.clearFence(rb_fence)
+		cleared = true
 		if err != nil {
 			return err
 		}
 		return after(rb_fence.epoch, end)
 	}
+	// huh
+	panic(unreachable("Phase"))
+}
+
+// one step of a Pipeline, the flags to raise and the callback to run
+
+type PhaseStep struct {
+	Flags uint16
+	Fn    func(epoch uint16, flags uint16) error
+}
+
+// run each step like a Fence, in order. a step raises its flags once the
+// step before has cleared its own, and waits for the writers that started
+// before that, including any that arrived during the step before, so each
+// step starts once the last one has drained.
+//
+// the first error stops the pipeline, and is returned once that step's
+// flags are cleared, so the steps after it never run. the flags aren't
+// held between steps, so another fence can get in between
+
+func (rb *Roundabout) Pipeline(steps []PhaseStep) error {
+	for _, step := range steps {
+		if err := rb.Fence(step.Flags, step.Fn); err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -1,13 +1,53 @@
 package crow
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // t.Log / t.Logf("%v", err)
 // t.Error / t.Errorf,  mark fail and continue
 // t.Fatal /  t.FatalF,  mark fail, exit
 
+// runConcurrent runs every op on each of the workers, in a random
+// order, against a shared roundabout. it's meant to be run with -race
+// and checks that every cell has been freed afterwards
+
+func runConcurrent(t *testing.T, workers int, ops []func(*Roundabout)) *Roundabout {
+	t.Helper()
+	rb := &Roundabout{}
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, i := range rand.Perm(len(ops)) {
+				ops[i](rb)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if h := unpackHeader(rb.header.Load()); h.bitmap != 0 || h.flags != 0 {
+		t.Error("roundabout not idle after run", rb.String())
+	}
+	if err := rb.Validate(); err != nil {
+		t.Error(err)
+	}
+	return rb
+}
+
 func TestRoundabout(t *testing.T) {
 	b2 := Roundabout{}
 	start, _ := b2.push(1001, LockLane)
@@ -57,78 +97,2628 @@ func TestRoundabout(t *testing.T) {
 }
 
 func TestWriteLock(t *testing.T) {
-	b := Roundabout{}
-	r1, _ := b.push(1, LockLane)
-	rX, _ := b.push(10, LockLane)
-	rY, _ := b.push(10, LockLane)
-	var r3 rb_cell
+	// writers on the same lane must never overlap
+	var inside [2]atomic.Int32
+	var count [2]int
 
-	var done bool
+	lock := func(lane uint32) func(*Roundabout) {
+		return func(rb *Roundabout) {
+			rb.LockLane(lane, func(uint16, uint16) error {
+				if inside[lane].Add(1) != 1 {
+					t.Error("two writers in lane", lane)
+				}
+				count[lane]++
+				inside[lane].Add(-1)
+				return nil
+			})
+		}
+	}
+
+	rounds, workers := stressed(10), stressedWorkers(8)
+	var ops []func(*Roundabout)
+	for range rounds {
+		ops = append(ops, lock(0), lock(1))
+	}
+	runConcurrent(t, workers, ops)
+
+	if want := rounds * workers; count[0] != want || count[1] != want {
+		t.Error("missing writes", count, want)
+	}
+}
+
+func TestSpinLockAll(t *testing.T) {
+	// a LockRing excludes everyone, whatever the lane
+	var ring, lanes atomic.Int32
+	var count int
+
+	lockRing := func(rb *Roundabout) {
+		rb.LockRing(func(uint16, uint16) error {
+			ring.Add(1)
+			if lanes.Load() != 0 || ring.Load() != 1 {
+				t.Error("LockRing overlapped")
+			}
+			count++
+			ring.Add(-1)
+			return nil
+		})
+	}
+	lockLane := func(lane uint32) func(*Roundabout) {
+		return func(rb *Roundabout) {
+			rb.LockLane(lane, func(uint16, uint16) error {
+				lanes.Add(1)
+				if ring.Load() != 0 {
+					t.Error("LockLane overlapped LockRing")
+				}
+				lanes.Add(-1)
+				return nil
+			})
+		}
+	}
+
+	rounds, workers := stressed(10), stressedWorkers(8)
+	var ops []func(*Roundabout)
+	for i := range rounds {
+		ops = append(ops, lockRing, lockLane(uint32(i)))
+	}
+	runConcurrent(t, workers, ops)
+
+	if count != rounds*workers {
+		t.Error("missing writes", count, rounds*workers)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	rb := &Roundabout{}
+	var epochs []uint16
+
+	err := rb.LockLane(1, func(epoch uint16, flags uint16) error {
+		epochs = append(epochs, epoch)
+		if len(epochs) < 3 {
+			return ErrRetry
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Error("unexpected error", err)
+	}
+	if len(epochs) != 3 {
+		t.Fatal("callback not retried", epochs)
+	}
+	if epochs[0] == epochs[1] || epochs[1] == epochs[2] {
+		t.Error("retry reused a cell", epochs)
+	}
+	if h := unpackHeader(rb.header.Load()); h.bitmap != 0 {
+		t.Error("retry leaked a cell", rb.String())
+	}
+}
+
+func TestHeader(t *testing.T) {
+	rb := &Roundabout{}
+	if epoch, flags, busy := rb.Header(); epoch != 0 || flags != 0 || busy {
+		t.Error("fresh roundabout", epoch, flags, busy)
+	}
+
+	// the flag is only ever raised while the epoch is odd
+	done := make(chan bool)
+	go func() {
+		for range 1000 {
+			rb.ShareRing(func(uint16, uint16) error { return nil })
+			if rb.Epoch()%2 == 1 {
+				rb.Fence(1, func(uint16, uint16) error { return nil })
+			}
+		}
+		close(done)
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		epoch, flags, _ := rb.Header()
+		if flags == 1 && epoch%2 == 0 {
+			t.Fatal("torn header", epoch, flags)
+		}
+	}
+
+	rb.LockRing(func(epoch uint16, flags uint16) error {
+		if _, _, busy := rb.Header(); !busy {
+			t.Error("not busy inside a LockRing")
+		}
+		return nil
+	})
+}
+
+func TestActive(t *testing.T) {
+	rb := &Roundabout{}
+	if rb.Active(rb.Epoch()) {
+		t.Error("idle roundabout active")
+	}
+
+	r1, _ := rb.push(1, LockLane)
+	r2, _ := rb.push(2, LockLane)
+	epoch := rb.Epoch()
+
+	if !rb.Active(epoch) || !rb.Active(r2.epoch) {
+		t.Error("r1 not seen as active")
+	}
+	if rb.Active(r1.epoch) {
+		t.Error("nothing before r1 should be active")
+	}
+
+	rb.pop(r1)
+	if rb.Active(r2.epoch) {
+		t.Error("r1 still active after pop")
+	}
+	if !rb.Active(epoch) {
+		t.Error("r2 not seen as active")
+	}
+	rb.pop(r2)
+	if rb.Active(epoch) {
+		t.Error("r2 still active after pop")
+	}
+}
+
+func TestOccupancy(t *testing.T) {
+	rb := &Roundabout{}
+	fn := func(uint16, uint16) error { return nil }
+	rb.LockRing(fn)
+	if s := rb.Stats(); len(s.Occupancy) != width+1 || slices.Max(s.Occupancy) != 0 {
+		t.Error("sampled when turned off", s)
+	}
+
+	// one at a time, only our own cell is busy
+	rb.OccupancyEvery = 1
+	for range 100 {
+		rb.LockRing(fn)
+	}
+	if s := rb.Stats(); s.Occupancy[1] != 100 {
+		t.Error("wrong occupancy for single pushes", s.Occupancy)
+	}
+
+	// keep the ring as full as it can be while still moving, popping the
+	// oldest cell before each push
+	var held []rb_cell
+	for range width - 1 {
+		c, _ := rb.push(0, ShareRing)
+		held = append(held, c)
+	}
+	for range 100 {
+		rb.pop(held[0])
+		c, _ := rb.push(0, ShareRing)
+		held = append(held[1:], c)
+	}
+	for _, c := range held {
+		rb.pop(c)
+	}
+
+	s := rb.Stats()
+	if s.Occupancy[0] != 0 || s.Occupancy[width-1] < 100 {
+		t.Error("a busy ring didn't shift the occupancy", s.Occupancy)
+	}
+
+	// sampling every fourth push, by epoch
+	rb = NewRoundaboutFromConfig(Config{OccupancyEvery: 4})
+	for range 100 {
+		rb.LockRing(fn)
+	}
+	if s := rb.Stats(); s.Occupancy[1] != 25 {
+		t.Error("wrong number of samples", s.Occupancy[1])
+	}
+}
+
+func TestCounts(t *testing.T) {
+	if width < 8 {
+		t.Skip("needs eight cells, the ring has", width)
+	}
+	rb := &Roundabout{}
+	if s, o, l := rb.Counts(); s+o+l != 0 {
+		t.Error("idle roundabout has cells", s, o, l)
+	}
+
+	var cells []rb_cell
+	for i, kind := range []uint16{ShareLane, ShareRing, ShareLane, OrderLane, OrderRing, LockLane, LockRing, LockLanePriority} {
+		c, _ := rb.push(uint32(i), kind)
+		cells = append(cells, c)
+	}
+	if s, o, l := rb.Counts(); s != 3 || o != 2 || l != 3 {
+		t.Error("wrong counts", s, o, l)
+	}
+
+	// popped cells drop out, and pending ones aren't counted
+	rb.pop(cells[0])
+	rb.pop(cells[5])
+	rb.log[cells[3].n].Store(Cell{cells[3].epoch, PendingCell, 0}.pack())
+	if s, o, l := rb.Counts(); s != 2 || o != 1 || l != 2 {
+		t.Error("wrong counts after pop", s, o, l)
+	}
+	for i, c := range cells {
+		if i != 0 && i != 5 {
+			rb.pop(c)
+		}
+	}
+	if s, o, l := rb.Counts(); s+o+l != 0 {
+		t.Error("cells left after pop", s, o, l)
+	}
+}
+
+func TestActiveSet(t *testing.T) {
+	rb := &Roundabout{}
+	if got := rb.ActiveSet(nil); len(got) != 0 {
+		t.Error("empty set", got)
+	}
+
+	// cells at 0, 1, 2, 3, with 1 popped. everything after 0 still has
+	// something before it, and nothing is before 0
+	cells := make([]rb_cell, 4)
+	for i := range cells {
+		cells[i], _ = rb.push(uint32(i), LockLane)
+	}
+	rb.pop(cells[1])
+
+	epochs := []uint16{0, 1, 2, 3, 4, 60, 0xFFFF}
+	got := rb.ActiveSet(epochs)
+	for i, epoch := range epochs {
+		if got[i] != rb.Active(epoch) {
+			t.Error("ActiveSet disagrees with Active", epoch, got[i])
+		}
+	}
+	want := []bool{false, true, true, true, true, false, false}
+	if !slices.Equal(got, want) {
+		t.Error("wrong active set", got, want)
+	}
+
+	rb.pop(cells[0])
+	rb.pop(cells[2])
+	rb.pop(cells[3])
+	for i, active := range rb.ActiveSet(epochs) {
+		if active {
+			t.Error("still active after pop", epochs[i])
+		}
+	}
+}
+
+func TestConflictWith(t *testing.T) {
+	rb := &Roundabout{}
+	sameTen := func(a, b uint32) bool { return a/10 == b/10 }
+
+	held := make(chan bool)
+	release := make(chan bool)
+	go rb.LockLane(7, func(uint16, uint16) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+
+	// the default only conflicts on the same lane
+	rb.LockLane(5, func(uint16, uint16) error { return nil })
+
+	var ran atomic.Bool
+	done := make(chan bool)
 	go func() {
-		b.LockLane(1, func(uint16, uint16) error {
-			r3, _ = b.push(1, LockLane)
-			b.pop(rX)
-			done = true
+		rb.LockLaneWith(5, sameTen, func(uint16, uint16) error {
+			ran.Store(true)
 			return nil
 		})
+		close(done)
+	}()
+
+	// and lanes in a different ten are still fine with the predicate
+	rb.LockLaneWith(15, sameTen, func(uint16, uint16) error { return nil })
+
+	time.Sleep(10 * time.Millisecond)
+	if ran.Load() {
+		t.Error("LockLaneWith didn't wait for a conflicting lane")
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("LockLaneWith never ran")
+	}
+}
+
+func TestLockLaneRange(t *testing.T) {
+	if width < 8 {
+		// a full ring would queue the ones we expect to get in
+		t.Skip("needs eight cells, the ring has", width)
+	}
+	rb := &Roundabout{}
+	fn := func(uint16, uint16) error { return nil }
+
+	held := make(chan bool)
+	release := make(chan bool)
+	go rb.LockLaneRange(10, 20, func(uint16, uint16) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+
+	var blocked []chan bool
+	check := func(name string, wait bool, op func() error) {
+		done := make(chan bool)
+		go func() {
+			op()
+			close(done)
+		}()
+		select {
+		case <-done:
+			if wait {
+				t.Error(name, "didn't wait for the range")
+			}
+		case <-time.After(20 * time.Millisecond):
+			if !wait {
+				t.Error(name, "waited for the range", rb.String())
+			}
+			blocked = append(blocked, done)
+		}
+	}
+
+	check("lane inside", true, func() error { return rb.LockLane(15, fn) })
+	check("lane at the top", true, func() error { return rb.ShareLane(20, fn) })
+	check("lane above", false, func() error { return rb.LockLane(21, fn) })
+	check("range above", false, func() error { return rb.LockLaneRange(21, 30, fn) })
+	check("range below", false, func() error { return rb.LockLaneRange(0, 9, fn) })
+	// this one waits on us, and everything after that overlaps it waits too
+	check("overlapping range", true, func() error { return rb.LockLaneRange(20, 30, fn) })
+	check("ring", true, func() error { return rb.ShareRing(fn) })
+
+	if !rb.Peek(12, func(uint16, uint16) {}) || rb.Peek(40, func(uint16, uint16) {}) {
+		t.Error("peek didn't see the range")
+	}
+
+	close(release)
+	for _, done := range blocked {
+		<-done
+	}
+
+}
+
+func TestLockLaneRangeConcurrent(t *testing.T) {
+	// ranges and single lanes over 16 lanes, checking that no two
+	// operations are ever inside the same lane at once
+	rb := &Roundabout{}
+	var inside [16]atomic.Int32
+	enter := func(lo, hi uint32) func(uint16, uint16) error {
+		return func(uint16, uint16) error {
+			for l := lo; l <= hi; l++ {
+				if inside[l].Add(1) != 1 {
+					t.Error("two operations in lane", l)
+				}
+			}
+			runtime.Gosched()
+			for l := lo; l <= hi; l++ {
+				inside[l].Add(-1)
+			}
+			return nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				lo := rand.Uint32N(16)
+				hi := lo + rand.Uint32N(16-lo)
+				if rand.IntN(2) == 0 {
+					rb.LockLane(lo, enter(lo, lo))
+				} else {
+					rb.LockLaneRange(lo, hi, enter(lo, hi))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestNoLaneConflict(t *testing.T) {
+	rb := NewRoundaboutFromConfig(Config{NoLaneConflict: true})
 
+	held := make(chan bool)
+	release := make(chan bool)
+	go rb.LockLane(1, func(uint16, uint16) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+
+	done := make(chan bool)
+	go func() {
+		rb.LockLane(1, func(uint16, uint16) error { return nil })
+		close(done)
 	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("same lane conflicted", rb.String())
+	}
+	if rb.Peek(1, func(uint16, uint16) {}) {
+		t.Error("peek saw a conflicting lane")
+	}
 
-	b.wait(r1)
-	b.pop(r1)
+	// the ring still waits for lanes
+	ring := make(chan bool)
+	go func() {
+		rb.LockRing(func(uint16, uint16) error { return nil })
+		close(ring)
+	}()
+	select {
+	case <-ring:
+		t.Fatal("LockRing didn't wait for the lane")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	<-ring
+}
 
-	// enqueue should run, setting r3,
-	// clearing rX, which blocks rY
-	b.wait(rY)
-	b.pop(rY)
+func TestStuck(t *testing.T) {
+	// allocate slot 0 in the header, but never write the cell
+	rb := NewRoundaboutFromConfig(Config{StuckAfter: 100})
+	rb.header.Store(Header{1, 0, 1}.pack())
 
-	b.wait(r3)
-	b.pop(r3)
-	if !done {
-		t.Error("r2 not complete")
+	stuck := make(chan [2]int, 1)
+	rb.Stuck = func(n int, epoch uint16) {
+		select {
+		case stuck <- [2]int{n, int(epoch)}:
+		default:
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		rb.LockRing(func(uint16, uint16) error { return nil })
+		close(done)
+	}()
+
+	select {
+	case got := <-stuck:
+		if got != [2]int{0, 0} {
+			t.Error("wrong slot or epoch", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchdog never fired", rb.String())
+	}
+
+	// pop the lost cell for it, and the scan carries on
+	rb.pop(rb_cell{n: 0, epoch: 0})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan didn't carry on", rb.String())
 	}
 }
 
-func TestSpinLockAll(t *testing.T) {
-	rb := Roundabout{}
+func TestStalePop(t *testing.T) {
+	if !checkPops {
+		t.Skip("pop checks need -tags crowdebug")
+	}
+	stale := func(name string, rb *Roundabout, c rb_cell) {
+		t.Helper()
+		defer func() {
+			t.Helper()
+			if s, _ := recover().(string); !strings.Contains(s, "popping a cell we don't hold") {
+				t.Error(name, "wasn't caught:", s)
+			}
+		}()
+		rb.pop(c)
+	}
 
-	rb1, _ := rb.push(1, LockLane)
-	rb2, _ := rb.push(1, LockLane)
+	rb := &Roundabout{}
+	c, _ := rb.push(1, LockLane)
+	rb.pop(c)
+	stale("popping twice", rb, c)
 
-	b := Roundabout{}
-	r1, _ := b.push(1, LockLane)
-	r2, _ := b.push(2, LockLane)
+	// once the slot's been reused, the stale pop would free someone else
+	for range width - 1 {
+		d, _ := rb.push(2, LockLane)
+		rb.pop(d)
+	}
+	d, _ := rb.push(3, LockLane)
+	if d.n != c.n {
+		t.Fatal("slot not reused", c.n, d.n)
+	}
+	stale("popping a reused slot", rb, c)
 
-	var done bool
+	// and a cell from another roundabout
+	other := &Roundabout{}
+	e, _ := other.push(4, LockLane)
+	stale("popping another roundabout's cell", rb, e)
+
+	other.pop(e)
+	rb.pop(d)
+	if !rb.idle() || !other.idle() {
+		t.Error("checks changed the roundabouts", rb.String(), other.String())
+	}
+}
+
+func TestPushPublishesCell(t *testing.T) {
+	// push claims the cell before the header, so a scan never finds
+	// a cell that's allocated but unwritten
+	rb := NewRoundaboutFromConfig(Config{StuckAfter: 1})
+	var unwritten atomic.Int32
+	rb.Stuck = func(int, uint16) {
+		unwritten.Add(1)
+	}
+
+	fn := func(uint16, uint16) error { return nil }
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				switch (w + i) % 4 {
+				case 0:
+					rb.LockRing(fn)
+				case 1:
+					rb.ShareRing(fn)
+				case 2:
+					rb.LockLane(uint32(i%3), fn)
+				case 3:
+					rb.Fence(1, fn)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := unwritten.Load(); n != 0 {
+		t.Error("scans saw unwritten cells", n)
+	}
+
+	// a stale header can't claim a cell that's been used since
+	rb = &Roundabout{}
+	rb.log[0].Store(Cell{32, LockLane, 1}.pack())
+	if _, r := rb.push(1, LockLane); r != pushCASLost {
+		t.Error("claimed a cell in use", r)
+	}
+	if rb.header.Load() != 0 {
+		t.Error("header changed by a failed push", rb.String())
+	}
+}
+
+func TestCASFaults(t *testing.T) {
+	rb := &Roundabout{}
+
+	// push loses five races, and retries until it gets in
+	rb.faults.Store(5)
+	r, result := rb.push(1, LockLane)
+	if result != pushInserted || rb.faults.Load() != 0 {
+		t.Fatal("push didn't recover", result, rb.faults.Load())
+	}
+	if h := unpackHeader(rb.header.Load()); h.epoch != 1 || h.bitmap != 1 {
+		t.Error("wrong header after push", rb.String())
+	}
+	rb.pop(r)
+
+	rb.faults.Store(5)
+	if err := rb.LockRing(func(uint16, uint16) error { return nil }); err != nil {
+		t.Error(err)
+	}
+	rb.faults.Store(5)
+	rb.Fence(1, func(uint16, uint16) error { return nil })
+	if rb.Flags() != 0 {
+		t.Error("fence left flags behind", rb.Flags())
+	}
+	m := &LockedMap{}
+	m.rb.faults.Store(5)
+	m.Store("a", 1)
+	if v, ok := m.Load("a"); !ok || v != 1 {
+		t.Error("map store lost", v)
+	}
+
+	rb.faults.Store(5)
+	rb.Close()
+	if !rb.IsClosed() || rb.faults.Load() != 0 {
+		t.Error("close didn't recover", rb.faults.Load())
+	}
+}
+
+func TestDump(t *testing.T) {
+	rb := &Roundabout{}
+	if cells := rb.Dump(); len(cells) != 0 {
+		t.Error("empty roundabout has cells", cells)
+	}
+
+	rb.header.Store(Header{30, 0, 0}.pack())
+	r1, _ := rb.push(7, LockLane)
+	r2, _ := rb.push(0, ShareRing)
+	r3, _ := rb.push(9, OrderLane)
+	rb.pop(r2)
+
+	want := []CellInfo{
+		{30 % width, 30, LockLane, 7},
+		{32 % width, 32, OrderLane, 9},
+	}
+	cells := rb.Dump()
+	if !slices.Equal(cells, want) {
+		t.Error("wrong cells", cells)
+	}
+	if s := cells[0].String(); s != strconv.Itoa(30%width)+": [30] LockLane 7" {
+		t.Error("wrong string", s)
+	}
+	rb.pop(r1)
+	rb.pop(r3)
+}
+
+func TestPanicInWait(t *testing.T) {
+	rb := &Roundabout{}
+	rb.Conflict = func(a, b uint32) bool {
+		if a == 666 {
+			panic("bad lane")
+		}
+		return a == b
+	}
+
+	held := make(chan bool)
+	release := make(chan bool)
+	go rb.LockLane(1, func(uint16, uint16) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+
+	func() {
+		defer func() {
+			p, ok := recover().(ConflictPanic)
+			if !ok {
+				t.Fatal("conflict didn't panic with a ConflictPanic")
+			}
+			want := ConflictPanic{666, 1, LockLane, LockLane, "bad lane"}
+			if p != want {
+				t.Error("wrong context", p)
+			}
+			msg := "crow: conflict function panicked comparing LockLane on lane 666 with LockLane on lane 1: bad lane"
+			if p.Error() != msg {
+				t.Error("wrong message", p.Error())
+			}
+		}()
+		// we scan the held cell, and the conflict function panics
+		rb.LockLane(666, func(uint16, uint16) error {
+			t.Error("callback ran")
+			return nil
+		})
+	}()
+
+	// a *With function, panicking with an error, which we unwrap to
+	bad := errors.New("bad lane")
+	func() {
+		defer func() {
+			p, _ := recover().(ConflictPanic)
+			if !errors.Is(p, bad) || p.Lane != 7 || p.Kind != OrderLane {
+				t.Error("wrong panic from a With conflict", p)
+			}
+		}()
+		rb.OrderLaneWith(7, func(a, b uint32) bool { panic(bad) }, func(uint16, uint16) error {
+			t.Error("callback ran")
+			return nil
+		})
+	}()
+	close(release)
+
+	// the panicking cell was popped, so the ring still works
+	if err := rb.LockRing(func(uint16, uint16) error { return nil }); err != nil {
+		t.Error(err)
+	}
+	if h := unpackHeader(rb.header.Load()); h.bitmap != 0 {
+		t.Error("cell leaked after panic", rb.String())
+	}
+}
+
+func TestFenceContext(t *testing.T) {
+	rb := &Roundabout{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	started := make(chan bool)
+	done := make(chan error)
 	go func() {
-		b.LockLane(1, func(uint16, uint16) error {
-			t.Log("in lock")
-			done = true
-			rb.pop(rb1)
+		done <- rb.FenceContext(ctx, 1, func(ctx context.Context, epoch uint16, flags uint16) error {
+			if flags&1 == 0 {
+				t.Error("flags not set in fence", flags)
+			}
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}()
+
+	<-started
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Error("wrong error from cancelled fence", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fence callback never saw the cancel")
+	}
+	if rb.Flags() != 0 {
+		t.Error("flags left set after fence", rb.Flags())
+	}
+
+	// a cancelled context doesn't wait for the flags, or run the callback
+	held := make(chan bool)
+	release := make(chan bool)
+	go rb.Fence(1, func(uint16, uint16) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+	err := rb.FenceContext(ctx, 1, func(context.Context, uint16, uint16) error {
+		t.Error("callback ran with a cancelled context")
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Error("wrong error from cancelled context", err)
+	}
+	close(release)
+}
+
+func TestPipeline(t *testing.T) {
+	rb := &Roundabout{}
+
+	// a writer that starts during the first step holds on for a while,
+	// and the second step mustn't start until it's done
+	var wrote atomic.Bool
+	var ran []uint16
+	step := func(epoch uint16, flags uint16) error {
+		ran = append(ran, flags)
+		return nil
+	}
+	err := rb.Pipeline([]PhaseStep{
+		{Flags: 1, Fn: func(epoch uint16, flags uint16) error {
+			started := make(chan bool)
+			go rb.LockLane(1, func(epoch uint16, flags uint16) error {
+				if flags&1 == 0 {
+					t.Error("writer didn't see the first step's flags", flags)
+				}
+				close(started)
+				time.Sleep(20 * time.Millisecond)
+				wrote.Store(true)
+				return nil
+			})
+			<-started
+			return step(epoch, flags)
+		}},
+		{Flags: 2, Fn: func(epoch uint16, flags uint16) error {
+			if !wrote.Load() {
+				t.Error("second step started before the first step's writer finished")
+			}
+			return step(epoch, flags)
+		}},
+		{Flags: 4, Fn: step},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if !slices.Equal(ran, []uint16{1, 2, 4}) {
+		t.Error("steps ran with the wrong flags", ran)
+	}
+
+	// an error in the middle stops the pipeline, and clears the flags
+	ran = nil
+	bad := errors.New("commit failed")
+	err = rb.Pipeline([]PhaseStep{
+		{Flags: 1, Fn: step},
+		{Flags: 2, Fn: func(epoch uint16, flags uint16) error {
+			step(epoch, flags)
+			return bad
+		}},
+		{Flags: 4, Fn: step},
+	})
+	if !errors.Is(err, bad) {
+		t.Error("wrong error from pipeline", err)
+	}
+	if !slices.Equal(ran, []uint16{1, 2}) {
+		t.Error("wrong steps ran", ran)
+	}
+	if rb.Flags() != 0 {
+		t.Error("flags left set after an error", rb.Flags())
+	}
+}
+
+func TestCellLocal(t *testing.T) {
+	rb := &Roundabout{}
+
+	// a list built up in the callback, and handed over at the end
+	var freed []int
+	rb.LockRingLocal(func(epoch uint16, flags uint16, local CellLocal) error {
+		if local.Load() != nil {
+			t.Error("fresh cell has a value", local.Load())
+		}
+		for i := range 3 {
+			list, _ := local.Load().([]int)
+			local.Store(append(list, i))
+		}
+		freed = local.Load().([]int)
+		return nil
+	})
+	if len(freed) != 3 {
+		t.Error("lost the list", freed)
+	}
+
+	// every slot gets a value, and every reuse of a slot, and every retry,
+	// starts empty
+	retried := false
+	for i := range 3 * width {
+		rb.LockLaneLocal(uint32(i), func(epoch uint16, flags uint16, local CellLocal) error {
+			if v := local.Load(); v != nil {
+				t.Fatal("value carried over into slot", int(epoch)%width, v)
+			}
+			local.Store(i)
+			if i == width && !retried {
+				retried = true
+				return ErrRetry
+			}
 			return nil
 		})
+	}
+	if !retried {
+		t.Error("never retried")
+	}
+
+	// and a panic still clears it
+	func() {
+		defer func() { recover() }()
+		rb.LockRingLocal(func(epoch uint16, flags uint16, local CellLocal) error {
+			local.Store("left behind")
+			panic("oops")
+		})
+	}()
+	for n := range rb.local {
+		if rb.local[n].Load() != nil {
+			t.Error("slot not cleared", n)
+		}
+	}
+}
 
+func TestShareRingLive(t *testing.T) {
+	rb := &Roundabout{}
+
+	started := make(chan bool)
+	fenced := make(chan bool)
+	done := make(chan bool)
+
+	go func() {
+		rb.ShareRingLive(func(epoch uint16, flags uint16, live func() uint16) error {
+			if live()&2 != 0 {
+				t.Error("flag raised before the fence")
+			}
+			close(started)
+			<-fenced
+			if flags&2 != 0 {
+				t.Error("snapshot changed", flags)
+			}
+			if live()&2 == 0 {
+				t.Error("reader didn't see the fence", live())
+			}
+			return nil
+		})
+		close(done)
 	}()
+	<-started
 
-	b.wait(r1)
-	b.pop(r1)
-	b.wait(r2)
-	b.pop(r2)
-	t.Log("waiting on rb2")
+	// a fence doesn't wait for readers, so it runs while we're reading
+	go rb.Fence(2, func(uint16, uint16) error {
+		close(fenced)
+		<-done
+		return nil
+	})
+	<-done
+
+	rb.ShareLaneLive(1, func(epoch uint16, flags uint16, live func() uint16) error {
+		if live() != rb.Flags() {
+			t.Error("live flags don't match", live(), rb.Flags())
+		}
+		return nil
+	})
+}
 
-	rb.wait(rb2)
-	rb.pop(rb2)
+func TestEnterFIFO(t *testing.T) {
+	// fill the ring, then queue up goroutines one at a time, and
+	// check they get in in the order they arrived as cells are freed
 
-	if !done {
-		t.Error("r2 not complete")
+	rb := &Roundabout{}
+	cells := make([]rb_cell, width)
+	for i := range cells {
+		cells[i], _ = rb.push(uint32(i), LockLane)
+	}
+
+	queued := min(8, width)
+	order := make(chan int, queued)
+	for i := range queued {
+		go rb.LockLane(uint32(100+i), func(uint16, uint16) error {
+			order <- i
+			return nil
+		})
+		for rb.arrivals.Load() != uint32(i+1) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for i := range queued {
+		rb.pop(cells[i])
+		select {
+		case got := <-order:
+			if got != i {
+				t.Error("got in out of order", got, "expected", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("queued goroutine never got in", rb.String())
+		}
+	}
+	for _, c := range cells[queued:] {
+		rb.pop(c)
+	}
+	rb.Quiesce()
+
+	if rb.arrivals.Load() != rb.admitted.Load() {
+		t.Error("queue not empty", rb.arrivals.Load(), rb.admitted.Load())
 	}
 }
 
-func BenchRoundabout(b *testing.B) {
-	// setup
-	b.ResetTimer()
-	for range b.N {
+func TestFullWait(t *testing.T) {
+	queued := min(4, width)
+	rb := NewRoundaboutFromConfig(Config{FullWait: 20 * time.Millisecond, FullQueue: queued})
+	cells := make([]rb_cell, width)
+	for i := range cells {
+		cells[i], _ = rb.push(uint32(i), LockLane)
+	}
+	fn := func(uint16, uint16) error { return nil }
+
+	// nothing's popped, so we give up
+	start := time.Now()
+	if err := rb.LockLane(100, fn); !errors.Is(err, ErrRingFull) {
+		t.Error("wrong error on a full ring", err)
+	}
+	if d := time.Since(start); d < rb.FullWait {
+		t.Error("gave up too soon", d)
+	}
 
+	// the line is still first come, first served, and each pop wakes
+	// the next one in
+	rb.FullWait = 5 * time.Second
+	order := make(chan int, queued)
+	for i := range queued {
+		go rb.LockLane(uint32(100+i), func(uint16, uint16) error {
+			order <- i
+			return nil
+		})
+		for rb.arrivals.Load() != uint32(i+2) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// with the line at its limit, anyone else is turned away at once
+	start = time.Now()
+	if err := rb.LockLane(200, fn); !errors.Is(err, ErrRingFull) {
+		t.Error("wrong error with the line full", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("waited with the line full", d)
+	}
+
+	for i := range queued {
+		rb.pop(cells[i])
+		select {
+		case got := <-order:
+			if got != i {
+				t.Error("got in out of order", got, "expected", i)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("parked goroutine never got in", rb.String())
+		}
+	}
+	for _, c := range cells[queued:] {
+		rb.pop(c)
+	}
+	rb.Quiesce()
+
+	if rb.arrivals.Load() != rb.admitted.Load() {
+		t.Error("queue not empty", rb.arrivals.Load(), rb.admitted.Load())
+	}
+	if !rb.idle() {
+		t.Error("cells leaked", rb.String())
+	}
+}
+
+func TestFullWaitClose(t *testing.T) {
+	// a close wakes the line, rather than leaving it parked till it times out
+	rb := NewRoundaboutFromConfig(Config{FullWait: time.Minute})
+	cells := make([]rb_cell, width)
+	for i := range cells {
+		cells[i], _ = rb.push(uint32(i), LockLane)
+	}
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			errs <- rb.LockRing(func(uint16, uint16) error { return nil })
+		}()
+	}
+	for rb.arrivals.Load() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	rb.Close()
+	for range 2 {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrClosed) {
+				t.Error("wrong error after close", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("close didn't wake the line", rb.String())
+		}
+	}
+	for _, c := range cells {
+		rb.pop(c)
+	}
+}
+
+func TestWaitCount(t *testing.T) {
+	rb := &Roundabout{}
+	rb.ShareRingWithWaitCount(func(epoch uint16, flags uint16, waited int) error {
+		if waited != 0 {
+			t.Error("waited on an empty ring", waited)
+		}
+		return nil
+	})
+
+	// parked is set by the waiter, and cleared by each pop
+	parked := func() {
+		t.Helper()
+		for start := time.Now(); rb.wake.Load() == nil; time.Sleep(time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("waiter never parked", rb.String())
+			}
+		}
+	}
+
+	// two writers and a reader ahead of us, and a ShareRing only waits
+	// for the writers. we free them one at a time, after the waiter has
+	// got to each, so that every one of them is still there when it looks
+	held := []rb_cell{}
+	for _, kind := range []uint16{LockLane, ShareLane, LockLane} {
+		c, _ := rb.push(uint32(len(held)), kind)
+		held = append(held, c)
+	}
+	for _, tc := range []struct {
+		run  func(func(uint16, uint16, int) error) error
+		want int
+	}{
+		{rb.ShareRingWithWaitCount, 2},
+		{rb.OrderRingWithWaitCount, 2},
+		{rb.LockRingWithWaitCount, 3},
+	} {
+		got := make(chan int, 1)
+		go tc.run(func(epoch uint16, flags uint16, waited int) error {
+			got <- waited
+			return nil
+		})
+		for _, c := range held {
+			if tc.want == 3 || c.kind != ShareLane {
+				parked()
+			}
+			rb.pop(c)
+		}
+		if n := <-got; n != tc.want {
+			t.Error("wrong wait count", n, "want", tc.want)
+		}
+
+		held = held[:0]
+		for _, kind := range []uint16{LockLane, ShareLane, LockLane} {
+			c, _ := rb.push(uint32(len(held)), kind)
+			held = append(held, c)
+		}
+	}
+	for _, c := range held {
+		rb.pop(c)
+	}
+	rb.Quiesce()
+}
+
+func TestValidate(t *testing.T) {
+	rb := &Roundabout{}
+	if err := rb.Validate(); err != nil {
+		t.Error("new roundabout isn't valid", err)
+	}
+
+	// part way round, all the way round, and with cells held
+	fn := func(uint16, uint16) error { return nil }
+	for i := range 3*width + 3 {
+		rb.LockLane(uint32(i), fn)
+		if err := rb.Validate(); err != nil {
+			t.Fatal("invalid after", i, "pushes:", err)
+		}
+	}
+	var held []rb_cell
+	for i := range width / 2 {
+		c, _ := rb.push(uint32(i), ShareLane)
+		held = append(held, c)
+	}
+	if err := rb.Validate(); err != nil {
+		t.Error("invalid with cells held", err)
+	}
+
+	// a bit for a free slot
+	free := unpackHeader(rb.header.Load()).epoch % width
+	rb.header.Or(1 << free)
+	if err := rb.Validate(); !errors.Is(err, ErrInvalid) {
+		t.Error("missed a bit set for a free cell", err)
+	}
+	rb.header.And(^uint64(1 << free))
+
+	// a held cell missing from the bitmap
+	rb.header.And(^uint64(1 << held[0].n))
+	if err := rb.Validate(); !errors.Is(err, ErrInvalid) {
+		t.Error("missed a held cell missing from the bitmap", err)
+	}
+	rb.header.Or(1 << held[0].n)
+
+	// a cell from the wrong lap
+	raw := rb.log[held[1].n].Load()
+	rb.log[held[1].n].Store(Cell{held[1].epoch - width, ShareLane, 0}.pack())
+	if err := rb.Validate(); !errors.Is(err, ErrInvalid) {
+		t.Error("missed a stale cell", err)
+	}
+	rb.log[held[1].n].Store(raw)
+
+	if err := rb.Validate(); err != nil {
+		t.Error("invalid after undoing the damage", err)
+	}
+	for _, c := range held {
+		rb.pop(c)
+	}
+	if err := rb.Validate(); err != nil {
+		t.Error("invalid after popping", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	// lanes conflict when they're the same mod 4
+	var stuck atomic.Int32
+	cfg := Config{
+		Conflict:   func(a, b uint32) bool { return a%4 == b%4 },
+		Stuck:      func(int, uint16) { stuck.Add(1) },
+		StuckAfter: 10,
+	}
+	a, b := NewRoundaboutFromConfig(cfg), NewRoundaboutFromConfig(cfg)
+	if a == b || a.StuckAfter != 10 || b.Conflict == nil {
+		t.Fatal("config not copied")
+	}
+
+	// the same policy on both
+	for _, rb := range []*Roundabout{a, b} {
+		c, _ := rb.push(1, LockLane)
+		d, _ := rb.push(5, LockLane)
+		e, _ := rb.push(2, LockLane)
+		if !rb.conflicts(d, d.n, unpackCell(rb.log[c.n].Load())) {
+			t.Error("lanes 1 and 5 should conflict")
+		}
+		if rb.conflicts(e, e.n, unpackCell(rb.log[c.n].Load())) {
+			t.Error("lanes 1 and 2 shouldn't conflict")
+		}
+		rb.pop(c)
+		rb.pop(d)
+		rb.pop(e)
+	}
+
+	// but not the same state: a held lock on one doesn't block the other
+	lock, _ := a.AcquireRing(context.Background(), LockRing)
+	if err := b.LockRing(func(uint16, uint16) error { return nil }); err != nil {
+		t.Error(err)
+	}
+	if a.Epoch() != 4 || b.Epoch() != 4 {
+		t.Error("epochs shared", a.Epoch(), b.Epoch())
+	}
+	lock.Release()
+
+	// and changing one doesn't change the other, or the config
+	a.NoLaneConflict = true
+	if b.NoLaneConflict || cfg.NoLaneConflict {
+		t.Error("config shared between roundabouts")
+	}
+	if stuck.Load() != 0 {
+		t.Error("stuck hook called", stuck.Load())
+	}
+}
+
+func TestWriterPreference(t *testing.T) {
+	for _, prefer := range []bool{false, true} {
+		rb := NewRoundaboutFromConfig(Config{WriterPreference: prefer})
+		reader := func(lane uint32) func(func(uint16, uint16) error) error {
+			return func(fn func(uint16, uint16) error) error { return rb.ShareLane(lane, fn) }
+		}
+		writer := func(fn func(uint16, uint16) error) error { return rb.LockLane(1, fn) }
+
+		// a writer on lane 1, waiting for a reader on lane 1
+		release := holdOp(reader(1))
+		ran, waitWriter := runsNow(writer)
+		if ran {
+			t.Fatal("writer didn't wait for the reader")
+		}
+
+		// a reader on lane 1 always waits for the writer, one on lane 2
+		// only does when writers are preferred
+		ran, waitSame := runsNow(reader(1))
+		if ran {
+			t.Error("reader got in ahead of a waiting writer")
+		}
+		ran, waitOther := runsNow(reader(2))
+		if ran == prefer {
+			t.Error("reader on another lane ran:", ran, "with WriterPreference:", prefer)
+		}
+		release()
+		waitWriter()
+		waitSame()
+		waitOther()
+	}
+}
+
+// a stream of readers never keeps a writer out for long, as the readers
+// that arrive after it wait for it
+
+func TestWriterStarvation(t *testing.T) {
+	for _, prefer := range []bool{false, true} {
+		rb := NewRoundaboutFromConfig(Config{WriterPreference: prefer})
+		var stop atomic.Bool
+		var wg sync.WaitGroup
+		for i := 0; i < stressedWorkers(4); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for !stop.Load() {
+					rb.ShareRing(func(uint16, uint16) error {
+						time.Sleep(10 * time.Microsecond)
+						return nil
+					})
+				}
+			}()
+		}
+
+		var worst time.Duration
+		for i := 0; i < stressed(20); i++ {
+			time.Sleep(time.Millisecond)
+			start := time.Now()
+			rb.LockRing(func(uint16, uint16) error { return nil })
+			worst = max(worst, time.Since(start))
+		}
+		stop.Store(true)
+		wg.Wait()
+		if worst > time.Second {
+			t.Error("writer starved for", worst, "with WriterPreference:", prefer)
+		}
+	}
+}
+
+func TestOnPop(t *testing.T) {
+	type popped struct {
+		epoch, kind uint16
+		lane        uint32
+	}
+	var got []popped
+	var rb *Roundabout
+	rb = NewRoundaboutFromConfig(Config{
+		OnPop: func(epoch uint16, kind uint16, lane uint32) {
+			// the slot is free by the time we're called
+			if h := unpackHeader(rb.header.Load()); h.bitmap != 0 {
+				t.Errorf("OnPop called with the slot still in use: %032b", h.bitmap)
+			}
+			got = append(got, popped{epoch, kind, lane})
+		},
+	})
+
+	ops := []struct {
+		kind uint16
+		lane uint32
+		op   func(fn func(uint16, uint16) error) error
+	}{
+		{LockRing, 0, rb.LockRing},
+		{OrderRing, 0, rb.OrderRing},
+		{ShareRing, 0, rb.ShareRing},
+		{LockLane, 5, func(fn func(uint16, uint16) error) error { return rb.LockLane(5, fn) }},
+		{OrderLane, 6, func(fn func(uint16, uint16) error) error { return rb.OrderLane(6, fn) }},
+		{ShareLane, 7, func(fn func(uint16, uint16) error) error { return rb.ShareLane(7, fn) }},
+		{LockLanePriority, 8, func(fn func(uint16, uint16) error) error { return rb.LockLanePriority(8, fn) }},
+		{LockLaneRange, 2, func(fn func(uint16, uint16) error) error { return rb.LockLaneRange(2, 4, fn) }},
+	}
+	for _, o := range ops {
+		got = got[:0]
+		var epoch uint16
+		o.op(func(e uint16, flags uint16) error {
+			epoch = e
+			if len(got) != 0 {
+				t.Error(kindName(o.kind), "OnPop called before the callback finished")
+			}
+			return nil
+		})
+		if want := (popped{epoch, o.kind, o.lane}); len(got) != 1 || got[0] != want {
+			t.Errorf("%s: got %v, want %v", kindName(o.kind), got, want)
+		}
+	}
+
+	// a Ticket pops when it's released
+	got = got[:0]
+	ticket, _ := rb.AcquireRing(context.Background(), ShareRing)
+	if len(got) != 0 {
+		t.Error("OnPop called while the ticket was held")
+	}
+	ticket.Release()
+	if want := (popped{ticket.Epoch(), ShareRing, 0}); len(got) != 1 || got[0] != want {
+		t.Errorf("Release: got %v, want %v", got, want)
+	}
+}
+
+func TestRingRange(t *testing.T) {
+	rb := &Roundabout{}
+	rb.LockRing(func(uint16, uint16) error { return nil })
+
+	value := 0
+	var wg sync.WaitGroup
+	start, end, err := rb.LockRingRange(func(epoch uint16, flags uint16) error {
+		// three writers start while we run, and wait for us
+		for range 3 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rb.LockRing(func(uint16, uint16) error {
+					if value != 1 {
+						t.Error("writer ran before the range ended")
+					}
+					return nil
+				})
+			}()
+		}
+		rb.WaitForEpoch(epoch + 4)
+		value = 1
+		return nil
+	})
+	wg.Wait()
+
+	if err != nil || start != 1 || end != 5 {
+		t.Error("wrong range", start, end, err)
+	}
+
+	// a reader's range doesn't include writers that ran before it
+	start, end, _ = rb.ShareRingRange(func(uint16, uint16) error { return nil })
+	if start != 5 || end != 6 {
+		t.Error("wrong range for reader", start, end)
+	}
+}
+
+func TestFenceHappensBefore(t *testing.T) {
+	rb := &Roundabout{}
+	data := 0
+
+	// a reader that starts before the fence doesn't see the flag, and
+	// the fence doesn't wait for it
+	early := make(chan bool)
+	release := make(chan bool)
+	go rb.ShareRing(func(epoch uint16, flags uint16) error {
+		if flags&4 != 0 {
+			t.Error("early reader saw the flag")
+		}
+		close(early)
+		<-release
+		return nil
+	})
+	<-early
+
+	fenced := make(chan uint16)
+	done := make(chan bool)
+	go rb.Fence(4, func(epoch uint16, flags uint16) error {
+		fenced <- epoch
+		<-done
+		return nil
+	})
+
+	// the write before the flag is visible to anyone who sees the flag.
+	// Fence doesn't let us write before setting the flag, so we do it by
+	// hand, the same way it does
+	data = 1
+	f, _ := rb.setFence(8)
+	start := <-fenced
+
+	// the early reader still holds its slot, so the ring can't lap it
+	var wg sync.WaitGroup
+	for range min(4, width-1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rb.ShareRing(func(epoch uint16, flags uint16) error {
+				if int16(epoch-start) < 0 || flags&4 == 0 {
+					t.Error("late reader didn't see the fence", epoch, start, flags)
+				}
+				if flags&8 != 0 && data != 1 {
+					t.Error("reader saw the flag, but not the write before it")
+				}
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	rb.clearFence(f)
+	close(done)
+	close(release)
+	rb.Quiesce()
+
+	rb.ShareRing(func(epoch uint16, flags uint16) error {
+		if flags != 0 {
+			t.Error("reader saw a cleared flag", flags)
+		}
+		return nil
+	})
+}
+
+// the writes inside a lock happen before the next lock on that lane
+// starts: pop stores to the log after the callback returns, and the next
+// waiter loads that cell before it runs. go's atomics are sequentially
+// consistent, so that's enough for -race to see the edge, and for the
+// plain ints below to never tear or lose an update
+
+func TestHappensBefore(t *testing.T) {
+	const lanes = 4
+	workers := stressedWorkers(8)
+	rounds := stressed(500)
+
+	rb := &Roundabout{}
+	counts := make([]int, lanes)
+	seen := 0
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rounds {
+				lane := uint32((w + i) % lanes)
+				switch i % 10 {
+				case 0:
+					// a ring lock sees every lane at once, and never
+					// less than the last ring lock did
+					rb.LockRing(func(uint16, uint16) error {
+						sum := 0
+						for _, c := range counts {
+							sum += c
+						}
+						if sum < seen {
+							t.Error("ring lock went backwards", sum, seen)
+						}
+						seen = sum
+						return nil
+					})
+				case 1:
+					rb.ShareLane(lane, func(uint16, uint16) error {
+						_ = counts[lane]
+						return nil
+					})
+				default:
+					rb.LockLane(lane, func(uint16, uint16) error {
+						counts[lane]++
+						return nil
+					})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := 0
+	for i := range workers * rounds {
+		if i%rounds%10 > 1 {
+			want++
+		}
+	}
+	sum := 0
+	for _, c := range counts {
+		sum += c
+	}
+	if sum != want {
+		t.Error("lost an update", sum, want)
+	}
+	if !rb.idle() {
+		t.Error("cells leaked", rb.String())
+	}
+}
+
+func TestWaitForEpoch(t *testing.T) {
+	rb := &Roundabout{}
+	target := rb.Epoch() + 10
+
+	var started atomic.Int32
+	go func() {
+		for range 10 {
+			time.Sleep(time.Millisecond)
+			started.Add(1)
+			rb.ShareRing(func(uint16, uint16) error { return nil })
+		}
+	}()
+
+	rb.WaitForEpoch(target)
+	if started.Load() != 10 || rb.Epoch() != target {
+		t.Error("returned early", started.Load(), rb.Epoch())
+	}
+
+	// already passed
+	rb.WaitForEpoch(target - 5)
+}
+
+func TestIfIdle(t *testing.T) {
+	rb := &Roundabout{}
+	calls := 0
+	fn := func(uint16, uint16) error {
+		calls++
+		if !rb.Active(rb.Epoch()) {
+			t.Error("ran without a cell")
+		}
+		return nil
+	}
+	expect := func(name string, want bool) {
+		t.Helper()
+		before := calls
+		ran, err := rb.IfIdle(fn)
+		if err != nil || ran != want || (calls != before) != want {
+			t.Error(name, "ran", ran, err, calls-before)
+		}
+	}
+
+	expect("idle", true)
+	if !rb.idle() {
+		t.Error("cell leaked", rb.String())
+	}
+
+	for _, kind := range []uint16{ShareLane, ShareRing, OrderLane, LockLane} {
+		c, _ := rb.push(1, kind)
+		expect(kindNames[kind]+" in flight", false)
+		rb.pop(c)
+	}
+	f, _ := rb.setFence(4)
+	expect("fence", false)
+	rb.clearFence(f)
+
+	// losing the header CAS puts the cell back
+	rb.faults.Store(1)
+	expect("lost cas", false)
+	if !rb.idle() || rb.Epoch() != 5 {
+		t.Error("lost cas left a cell behind", rb.String())
+	}
+	expect("idle again", true)
+
+	// racing callers never overlap, and never wait
+	var inside atomic.Int32
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				rb.IfIdle(func(uint16, uint16) error {
+					if inside.Add(1) != 1 {
+						t.Error("two callbacks at once")
+					}
+					runtime.Gosched()
+					inside.Add(-1)
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	rb.Close()
+	if ran, err := rb.IfIdle(fn); ran || !errors.Is(err, ErrClosed) {
+		t.Error("ran when closed", ran, err)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	rb := &Roundabout{}
+	lock, _ := rb.push(0, LockRing)
+
+	ops := []func(fn func(uint16, uint16) error) error{
+		func(fn func(uint16, uint16) error) error { return rb.LockLane(1, fn) },
+		func(fn func(uint16, uint16) error) error { return rb.OrderLane(2, fn) },
+		func(fn func(uint16, uint16) error) error { return rb.ShareRing(fn) },
+		func(fn func(uint16, uint16) error) error { return rb.LockRing(fn) },
+		func(fn func(uint16, uint16) error) error {
+			_, err := rb.AcquireRing(context.Background(), OrderRing)
+			return err
+		},
+	}
+	errs := make(chan error, len(ops))
+	for _, op := range ops {
+		go func() {
+			errs <- op(func(uint16, uint16) error {
+				t.Error("callback ran after abort")
+				return nil
+			})
+		}()
+	}
+	// long enough that some of them have parked
+	time.Sleep(20 * time.Millisecond)
+
+	if !rb.Abort() || rb.Abort() || !rb.IsAborted() {
+		t.Error("abort flag not raised once")
+	}
+	for range ops {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrAborted) {
+				t.Error("wrong error", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiter didn't abort", rb.String())
+		}
+	}
+
+	// anything that would wait gives up straight away, anything that
+	// wouldn't carries on
+	if err := rb.ShareLane(1, func(uint16, uint16) error { return nil }); !errors.Is(err, ErrAborted) {
+		t.Error("waited while aborted", err)
+	}
+	rb.pop(lock)
+	if err := rb.ShareLane(1, func(uint16, uint16) error { return nil }); err != nil {
+		t.Error("aborted without waiting", err)
+	}
+	rb.Quiesce()
+
+	if !rb.ClearAbort() || rb.ClearAbort() || rb.IsAborted() {
+		t.Error("abort flag not cleared once")
+	}
+	lock, _ = rb.push(0, LockRing)
+	done := make(chan error)
+	go func() { done <- rb.LockRing(func(uint16, uint16) error { return nil }) }()
+	time.Sleep(10 * time.Millisecond)
+	rb.pop(lock)
+	if err := <-done; err != nil {
+		t.Error("waiting broken after clearing abort", err)
+	}
+
+	// a waiter queued for room in the ring gives up too
+	var cells []rb_cell
+	for range width {
+		c, _ := rb.push(0, ShareRing)
+		cells = append(cells, c)
+	}
+	go func() { done <- rb.ShareRing(func(uint16, uint16) error { return nil }) }()
+	for rb.arrivals.Load() == rb.admitted.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	rb.Abort()
+	if err := <-done; !errors.Is(err, ErrAborted) {
+		t.Error("queued waiter didn't abort", err)
+	}
+	for _, c := range cells {
+		rb.pop(c)
+	}
+	rb.ClearAbort()
+	if rb.arrivals.Load() != rb.admitted.Load() || !rb.idle() {
+		t.Error("abort left the queue or the ring behind", rb.String())
+	}
+}
+
+func TestAbortFence(t *testing.T) {
+	// a fence with the abort flag throws out the waiters, waits for what's
+	// running, and then runs
+	rb := &Roundabout{}
+	held, _ := rb.push(1, LockLane)
+
+	waiter := make(chan error)
+	go func() { waiter <- rb.LockLane(1, func(uint16, uint16) error { return nil }) }()
+	time.Sleep(20 * time.Millisecond)
+
+	fenced := make(chan error)
+	go func() {
+		fenced <- rb.Fence(FlagAbort, func(epoch uint16, flags uint16) error {
+			if flags&FlagAbort == 0 {
+				t.Error("fence didn't see its flag")
+			}
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-waiter:
+		if !errors.Is(err, ErrAborted) {
+			t.Error("wrong error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter didn't abort", rb.String())
+	}
+	select {
+	case <-fenced:
+		t.Error("fence didn't wait for the running operation")
+	case <-time.After(10 * time.Millisecond):
+	}
+	rb.pop(held)
+	if err := <-fenced; err != nil {
+		t.Error(err)
+	}
+	if rb.IsAborted() || !rb.idle() {
+		t.Error("fence left the flag behind", rb.String())
+	}
+}
+
+func TestDrainReaders(t *testing.T) {
+	rb := &Roundabout{}
+	rb.DrainReaders(rb.RetireEpoch())
+
+	// two readers and a writer before the marker, and a reader after it,
+	// which is as many cells as a ring of 4 can hold while leaving
+	// room for another writer once the first reader goes
+	orderLane := func(lane uint32) func(func(uint16, uint16) error) error {
+		return func(fn func(uint16, uint16) error) error { return rb.OrderLane(lane, fn) }
+	}
+	ring := holdOp(rb.ShareRing)
+	lane := holdOp(func(fn func(uint16, uint16) error) error { return rb.ShareLane(1, fn) })
+	writer := holdOp(orderLane(5))
+	marker := rb.RetireEpoch()
+	later := holdOp(rb.ShareRing)
+
+	drained := make(chan bool)
+	go func() {
+		rb.DrainReaders(marker)
+		close(drained)
+	}()
+	isDrained := func() bool {
+		select {
+		case <-drained:
+			return true
+		case <-time.After(20 * time.Millisecond):
+			return false
+		}
+	}
+
+	if isDrained() {
+		t.Fatal("returned with readers still in")
+	}
+	ring()
+	if isDrained() {
+		t.Fatal("returned with a reader still in")
+	}
+
+	// new writers aren't held up by it
+	if ran, wait := runsNow(orderLane(2)); !ran {
+		t.Error("writer waited for DrainReaders")
+		wait()
+	}
+
+	// the writer from before, and the reader from after, are still held
+	lane()
+	if !isDrained() {
+		t.Fatal("still waiting once the readers had gone")
+	}
+	writer()
+	later()
+	if err := rb.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	rb := &Roundabout{}
+	if rb.Capacity() != width || rb.Available() != width {
+		t.Fatal("wrong capacity:", rb.Capacity(), rb.Available())
+	}
+
+	// fill the ring with readers, which don't wait on each other
+	var held []Ticket
+	for i := range rb.Capacity() {
+		ticket, err := rb.TryAcquireRing(context.Background(), ShareRing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, ticket)
+		if rb.Available() != width-i-1 {
+			t.Error("wrong count with", i+1, "held:", rb.Available())
+		}
+	}
+
+	// at capacity, asking not to wait fails, and waiting waits
+	if _, err := rb.TryAcquireRing(context.Background(), ShareRing); !errors.Is(err, ErrRingFull) {
+		t.Error("no error when full:", err)
+	}
+	ran, wait := runsNow(rb.ShareRing)
+	if ran {
+		t.Fatal("ran with every cell taken")
+	}
+
+	// a pop lets it in, and it gives the cell back when it's done
+	held[0].Release()
+	wait()
+	if rb.Available() != 1 {
+		t.Error("wrong count after a pop:", rb.Available())
+	}
+	for _, ticket := range held[1:] {
+		ticket.Release()
+	}
+	if rb.Available() != width {
+		t.Error("cells left behind:", rb.Available())
+	}
+}
+
+func TestQuiesce(t *testing.T) {
+	rb := &Roundabout{}
+	rb.Quiesce() // already idle
+
+	held := make(chan bool, 2)
+	release := make(chan bool)
+	go rb.ShareLane(1, func(uint16, uint16) error {
+		held <- true
+		<-release
+		return nil
+	})
+	go rb.Fence(1, func(uint16, uint16) error {
+		held <- true
+		<-release
+		return nil
+	})
+	<-held
+	<-held
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := rb.QuiesceContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("quiesced while busy", err, rb.String())
+	}
+
+	done := make(chan bool)
+	go func() {
+		rb.Quiesce()
+		close(done)
+	}()
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("quiesce didn't return once idle", rb.String())
+	}
+	if rb.Flags() != 0 || rb.header.Load()&0xFFFFFFFF != 0 {
+		t.Error("quiesce returned early", rb.String())
+	}
+}
+
+func TestClose(t *testing.T) {
+	rb := &Roundabout{}
+
+	held := make(chan bool)
+	release := make(chan bool)
+	done := make(chan error)
+	go func() {
+		done <- rb.LockRing(func(uint16, uint16) error {
+			close(held)
+			<-release
+			return nil
+		})
+	}()
+	<-held
+
+	rb.Close()
+	rb.Close()
+	if !rb.IsClosed() {
+		t.Error("not closed")
+	}
+
+	fn := func(uint16, uint16) error {
+		t.Error("callback ran after close")
+		return nil
+	}
+	errs := []error{
+		rb.LockRing(fn),
+		rb.ShareRing(fn),
+		rb.LockLane(1, fn),
+		rb.OrderLaneWith(1, nil, fn),
+		rb.Fence(1, fn),
+		rb.LockRingDowngrade(func(uint16, uint16, func()) error { return nil }),
+	}
+	for i, err := range errs {
+		if !errors.Is(err, ErrClosed) {
+			t.Error("operation", i, "didn't fail after close", err)
+		}
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Error("holder from before close failed", err)
+	}
+	rb.Quiesce()
+	if rb.Flags() != FlagClosed {
+		t.Error("wrong flags after close", rb.Flags())
+	}
+
+	w := &WideRoundabout{}
+	w.Close()
+	if err := w.LockLane(1, fn); !errors.Is(err, ErrClosed) {
+		t.Error("wide lane didn't fail after close", err)
+	}
+}
+
+func TestWaitForEpochWrap(t *testing.T) {
+	rb := &Roundabout{}
+	rb.header.Store(Header{65530, 0, 0}.pack())
+	target := rb.Epoch() + 10 // wraps to 4
+
+	done := make(chan bool)
+	go func() {
+		rb.WaitForEpoch(target)
+		close(done)
+	}()
+
+	for range 9 {
+		rb.ShareRing(func(uint16, uint16) error { return nil })
+	}
+	select {
+	case <-done:
+		t.Fatal("returned before the epoch wrapped to the target", rb.Epoch())
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	rb.ShareRing(func(uint16, uint16) error { return nil })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't return after the epoch wrapped", rb.Epoch())
+	}
+}
+
+// 65536 is a multiple of the width, so slot n is still epoch % width
+// after the epoch wraps, but nothing else checks that a push, pop, and
+// wait all agree on it across the boundary, so we take the ring all the
+// way around, twice
+
+func TestEpochWrap(t *testing.T) {
+	rb := &Roundabout{}
+	var held []rb_cell
+	var bitmap uint32
+	epoch := uint16(0)
+
+	// a sliding window of held cells, growing and shrinking as we go, so
+	// the bitmap crosses the boundary in every shape
+	for i := range 2*65536 + width {
+		window := i%(width-1) + 1
+		for len(held) >= window {
+			c := held[0]
+			rb.pop(c)
+			bitmap &^= 1 << c.n
+			if raw := rb.log[c.n].Load(); raw != (Cell{c.epoch + width, PendingCell, 0}).pack() {
+				t.Fatal("pop left the wrong free cell", c.epoch, unpackCell(raw))
+			}
+			held = held[1:]
+		}
+
+		c, r := rb.push(uint32(i), LockLane)
+		if r != pushInserted {
+			t.Fatal("push failed", i, r, rb.String())
+		}
+		if c.epoch != epoch || c.n != int(epoch)%width || c.bitmap != bitmap {
+			t.Fatalf("wrong cell at %d: epoch %d slot %d bitmap %b, want %d %d %b",
+				i, c.epoch, c.n, c.bitmap, epoch, int(epoch)%width, bitmap)
+		}
+		if got := unpackHeader(rb.header.Load()); got.epoch != epoch+1 || got.bitmap != bitmap|1<<c.n {
+			t.Fatal("wrong header after push", i, got)
+		}
+		if !rb.Active(epoch + 1) {
+			t.Fatal("our own cell isn't active", epoch)
+		}
+		if seq := rb.Sequence(); seq != uint64(i)+1 {
+			t.Fatal("wrong sequence after push", i, seq)
+		}
+		held = append(held, c)
+		bitmap |= 1 << c.n
+		epoch++
+	}
+	for _, c := range held {
+		rb.pop(c)
+	}
+	if !rb.idle() || rb.Epoch() != width {
+		t.Fatal("ring not idle after wrapping", rb.String())
+	}
+
+	// a lock held on one side of the boundary blocks the same lane on the
+	// other side, and only that lane
+	for rb.Epoch() != 65535 {
+		rb.ShareRing(func(uint16, uint16) error { return nil })
+	}
+	held = held[:0]
+	for lane := range uint32(2) {
+		c, _ := rb.push(lane, LockLane)
+		held = append(held, c)
+	}
+	if held[0].epoch != 65535 || held[1].epoch != 0 {
+		t.Fatal("didn't straddle the boundary", held[0].epoch, held[1].epoch)
+	}
+
+	waited := func(lane uint32) bool {
+		done := make(chan bool)
+		go func() {
+			rb.LockLane(lane, func(uint16, uint16) error { return nil })
+			close(done)
+		}()
+		select {
+		case <-done:
+			return false
+		case <-time.After(20 * time.Millisecond):
+			return true
+		}
+	}
+	if waited(2) {
+		t.Error("free lane waited across the boundary", rb.String())
+	}
+	if !waited(0) {
+		t.Error("lane held before the boundary didn't block", rb.String())
+	}
+	rb.pop(held[0])
+	if !waited(1) {
+		t.Error("lane held after the boundary didn't block", rb.String())
+	}
+	rb.pop(held[1])
+	rb.Quiesce()
+
+	// and lots of goroutines taking locks over the boundary
+	for rb.Epoch() != 65536-200 {
+		rb.ShareRing(func(uint16, uint16) error { return nil })
+	}
+	counts := make([]int, 4)
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				lane := uint32(w+i) % 4
+				rb.LockLane(lane, func(uint16, uint16) error {
+					counts[lane]++
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if sum := counts[0] + counts[1] + counts[2] + counts[3]; sum != 400 {
+		t.Error("lost an update across the boundary", sum)
+	}
+	if e := rb.Epoch(); e != 200 || !rb.idle() {
+		t.Error("wrong state after the boundary", e, rb.String())
+	}
+}
+
+func TestSequence(t *testing.T) {
+	rb := &Roundabout{}
+	workers, rounds := stressedWorkers(4), stressed(65536)
+
+	// pushers on lanes and the ring, and readers checking that neither
+	// Sequence nor SequenceOf ever goes backwards, over a few wraps
+	var wg sync.WaitGroup
+	var last uint64
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prev := uint64(0)
+			for i := range rounds {
+				seq := rb.Sequence()
+				if seq < prev {
+					t.Errorf("sequence went backwards: %d after %d", seq, prev)
+					return
+				}
+				prev = seq
+
+				if i%8 != 0 {
+					rb.LockLane(uint32(w), func(uint16, uint16) error { return nil })
+					continue
+				}
+				rb.LockRing(func(epoch uint16, flags uint16) error {
+					seq := rb.SequenceOf(epoch)
+					if seq < last || seq > rb.Sequence() {
+						t.Errorf("wrong sequence for epoch %d: %d, last %d", epoch, seq, last)
+					}
+					last = seq
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if seq := rb.Sequence(); seq != uint64(workers*rounds) {
+		t.Error("sequence doesn't count pushes", seq, workers*rounds)
+	}
+	if uint16(rb.Sequence()) != rb.Epoch() {
+		t.Error("sequence doesn't match epoch", rb.Sequence(), rb.Epoch())
+	}
+}
+
+func TestRetireEpoch(t *testing.T) {
+	rb := &Roundabout{}
+	if !rb.CanReclaim(rb.RetireEpoch()) {
+		t.Error("can't reclaim on an idle roundabout")
+	}
+
+	// a reader that's in the log holds up the marker, one that starts
+	// afterwards doesn't
+	held := make(chan bool)
+	release := make(chan bool)
+	go rb.ShareRing(func(uint16, uint16) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+	marker := rb.RetireEpoch()
+	rb.ShareRing(func(uint16, uint16) error {
+		if rb.CanReclaim(marker) {
+			t.Error("reclaimed while an older reader was in the log")
+		}
+		return nil
+	})
+	close(release)
+	for !rb.CanReclaim(marker) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// and again across the wrap
+	rb = &Roundabout{}
+	rb.header.Store(Header{65534, 0, 0}.pack())
+	held = make(chan bool)
+	release = make(chan bool)
+	go rb.ShareRing(func(uint16, uint16) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+	marker = rb.RetireEpoch()
+	if marker != 65534 || rb.CanReclaim(marker) {
+		t.Error("reclaimed across the wrap", marker, rb.String())
+	}
+	for range 3 {
+		rb.ShareRing(func(uint16, uint16) error { return nil })
+	}
+	if rb.CanReclaim(marker) {
+		t.Error("reclaimed across the wrap", marker, rb.String())
+	}
+	close(release)
+	for !rb.CanReclaim(marker) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRetireReclaim(t *testing.T) {
+	type node struct {
+		freed atomic.Bool
+	}
+	var current atomic.Pointer[node]
+	current.Store(&node{})
+	rb := &Roundabout{}
+
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				rb.ShareRing(func(uint16, uint16) error {
+					n := current.Load()
+					runtime.Gosched()
+					if n.freed.Load() {
+						t.Error("reader saw a freed node")
+					}
+					return nil
+				})
+			}
+		}()
+	}
+
+	for range 200 {
+		old := current.Swap(&node{})
+		marker := rb.RetireEpoch()
+		for !rb.CanReclaim(marker) {
+			runtime.Gosched()
+		}
+		old.freed.Store(true)
+	}
+	stop.Store(true)
+	wg.Wait()
+}
+
+func TestOptimisticRead(t *testing.T) {
+	// a and b are guarded by convention, the writer always sets both
+	var a, b atomic.Int64
+	rb := &Roundabout{}
+
+	done := make(chan bool)
+	go func() {
+		for i := range int64(1000) {
+			rb.LockRing(func(uint16, uint16) error {
+				a.Store(i)
+				b.Store(i)
+				return nil
+			})
+		}
+		close(done)
+	}()
+
+	reads := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		var x, y int64
+		rb.OptimisticRead(func() error {
+			x = a.Load()
+			y = b.Load()
+			return nil
+		})
+		if x != y {
+			t.Fatal("torn read", x, y)
+		}
+		reads++
+	}
+	t.Log("reads", reads)
+}
+
+func TestOrderLaneRead(t *testing.T) {
+	rb := &Roundabout{}
+	calls := 0
+	read := func(race func()) error {
+		calls = 0
+		return rb.OrderLaneRead(1, func(uint16, uint16) error {
+			calls++
+			if calls == 1 && race != nil {
+				race()
+			}
+			return errors.New("read")
+		})
+	}
+	expect := func(name string, push bool, race func()) {
+		t.Helper()
+		epoch := rb.Epoch()
+		if err := read(race); err == nil || err.Error() != "read" {
+			t.Error(name, "lost the callback's error", err)
+		}
+		if pushed := calls == 2 || rb.Epoch() != epoch && race == nil; pushed != push {
+			t.Error(name, "wrong path, calls", calls, "epochs", epoch, rb.Epoch())
+		}
+	}
+
+	expect("idle", false, nil)
+
+	// something in the log that doesn't conflict, or something that
+	// arrives while we read and doesn't conflict, doesn't stop us
+	var held []rb_cell
+	arrive := func(lane uint32, kind uint16) func() {
+		return func() {
+			c, _ := rb.push(lane, kind)
+			held = append(held, c)
+		}
+	}
+	other, _ := rb.push(2, LockLane)
+	expect("lock on another lane", false, nil)
+	expect("share arriving", false, arrive(1, ShareLane))
+	expect("order on another lane arriving", false, arrive(3, OrderLane))
+	rb.pop(other)
+	for _, c := range held {
+		rb.pop(c)
+	}
+	held = held[:0]
+
+	// but anything that conflicts, or that came and went, is a retry. the
+	// retry waits on anything that conflicts, so we let it go shortly after
+	conflict := func(lane uint32, kind uint16) func() {
+		return func() {
+			c, _ := rb.push(lane, kind)
+			time.AfterFunc(10*time.Millisecond, func() { rb.pop(c) })
+		}
+	}
+	expect("lock arriving", true, conflict(1, LockLane))
+	expect("ring order arriving", true, conflict(0, OrderRing))
+	expect("share came and went", true, func() {
+		rb.ShareLane(1, func(uint16, uint16) error { return nil })
+	})
+	expect("lock came and went", true, func() {
+		rb.LockLane(1, func(uint16, uint16) error { return nil })
+	})
+
+	// and a lock that's still there makes us wait for it, as a cell
+	lock, _ := rb.push(1, LockLane)
+	done := make(chan bool)
+	go func() {
+		read(nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Error("read didn't wait for a lock on its lane")
+	case <-time.After(20 * time.Millisecond):
+	}
+	rb.pop(lock)
+	<-done
+
+	if !rb.idle() {
+		t.Error("cells leaked", rb.String())
+	}
+}
+
+func TestOrderLaneReadTorn(t *testing.T) {
+	// a and b are guarded by lane 1, the writer always sets both
+	var a, b atomic.Int64
+	rb := &Roundabout{}
+
+	done := make(chan bool)
+	go func() {
+		for i := range int64(1000) {
+			rb.LockLane(1, func(uint16, uint16) error {
+				a.Store(i)
+				runtime.Gosched()
+				b.Store(i)
+				return nil
+			})
+		}
+		close(done)
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		var x, y int64
+		rb.OrderLaneRead(1, func(uint16, uint16) error {
+			x = a.Load()
+			runtime.Gosched()
+			y = b.Load()
+			return nil
+		})
+		if x != y {
+			t.Fatal("torn read", x, y)
+		}
+	}
+}
+
+func TestPeek(t *testing.T) {
+	rb := &Roundabout{}
+
+	held := make(chan bool)
+	release := make(chan bool)
+	go rb.LockLane(1, func(uint16, uint16) error {
+		held <- true
+		<-release
+		return nil
+	})
+	<-held
+
+	ran := false
+	busy := rb.Peek(1, func(epoch uint16, flags uint16) {
+		if epoch != rb.Epoch() {
+			t.Error("wrong epoch", epoch)
+		}
+		ran = true
+	})
+	if !ran || !busy {
+		t.Error("peek didn't see the writer on lane 1")
+	}
+	if rb.Peek(2, func(uint16, uint16) {}) {
+		t.Error("peek saw a writer on lane 2")
+	}
+
+	close(release)
+	rb.ShareRing(func(uint16, uint16) error { return nil })
+
+	if rb.Peek(1, func(uint16, uint16) {}) {
+		t.Error("peek saw a writer after it left")
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	rb := &Roundabout{}
+
+	locked := make(chan bool)
+	read := make(chan bool)
+	var reading atomic.Bool
+
+	go func() {
+		<-locked
+		rb.ShareRing(func(uint16, uint16) error {
+			reading.Store(true)
+			return nil
+		})
+		close(read)
+	}()
+
+	rb.LockRingDowngrade(func(epoch uint16, flags uint16, downgrade func()) error {
+		close(locked)
+		// give the reader a chance to be let in, which it shouldn't be
+		time.Sleep(10 * time.Millisecond)
+		if reading.Load() {
+			t.Error("reader ran during lock")
+		}
+
+		downgrade()
+		select {
+		case <-read:
+		case <-time.After(5 * time.Second):
+			t.Error("reader still blocked after downgrade")
+		}
+		return nil
+	})
+
+	if h := unpackHeader(rb.header.Load()); h.bitmap != 0 {
+		t.Error("cells left allocated", rb.String())
+	}
+}
+
+// the scans in waitCount and spinFence, over a log where every slot the
+// bitmap says is in use holds an old epoch, so nothing is waited for, at
+// a range of occupancies
+
+func BenchmarkBitmapScan(b *testing.B) {
+	rb := &Roundabout{}
+	for range width {
+		rb.LockRing(func(uint16, uint16) error { return nil })
+	}
+	for _, used := range slices.Compact([]int{1, min(4, width-1), min(16, width-1), width - 1}) {
+		var bitmap uint32
+		for i := range used {
+			bitmap |= 1 << (1 + i*(width-1)/used)
+		}
+		b.Run(fmt.Sprintf("wait/%d", used), func(b *testing.B) {
+			r := rb_cell{epoch: 3 * width, kind: LockRing, bitmap: bitmap}
+			for range b.N {
+				rb.waitCount(r, nil)
+			}
+		})
+		b.Run(fmt.Sprintf("fence/%d", used), func(b *testing.B) {
+			s := rb_fence{epoch: 3 * width, bitmap: bitmap}
+			for range b.N {
+				rb.spinFence(s)
+			}
+		})
+	}
+}
+
+func BenchmarkLockRingUncontended(b *testing.B) {
+	rb := &Roundabout{}
+	fn := func(uint16, uint16) error { return nil }
+	b.ResetTimer()
+	for range b.N {
+		rb.LockRing(fn)
+	}
+}
+
+// more goroutines than cells, all on one lane, reporting how long each
+// one waited to get in, to catch unfairness in the tail
+
+func BenchmarkLockLaneLatency(b *testing.B) {
+	rb := &Roundabout{}
+	fn := func(uint16, uint16) error { return nil }
+	workers := 2 * width
+
+	waits := make([][]time.Duration, workers)
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; i < b.N; i += workers {
+				start := time.Now()
+				rb.LockLane(1, fn)
+				waits[w] = append(waits[w], time.Since(start))
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	var all []time.Duration
+	for _, w := range waits {
+		all = append(all, w...)
+	}
+	if len(all) == 0 {
+		return
+	}
+	slices.Sort(all)
+	b.ReportMetric(float64(all[len(all)/2]), "p50-ns")
+	b.ReportMetric(float64(all[len(all)*99/100]), "p99-ns")
+	b.ReportMetric(float64(all[len(all)-1]), "max-ns")
+}
+
+func BenchmarkLockLaneIdle(b *testing.B) {
+	rb := &Roundabout{}
+	fn := func(uint16, uint16) error { return nil }
+	b.ResetTimer()
+	for range b.N {
+		rb.LockLane(1, fn)
+	}
+}
+
+// every goroutine on one lane, so they all wait on each other, or every
+// goroutine on its own lane, so they only wait for the ring to have room
+
+func BenchmarkLockLaneContended(b *testing.B) {
+	fn := func(uint16, uint16) error { return nil }
+	b.Run("same", func(b *testing.B) {
+		rb := &Roundabout{}
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				rb.LockLane(1, fn)
+			}
+		})
+	})
+	b.Run("spread", func(b *testing.B) {
+		rb := &Roundabout{}
+		var next atomic.Uint32
+		b.RunParallel(func(pb *testing.PB) {
+			lane := next.Add(1)
+			for pb.Next() {
+				rb.LockLane(lane, fn)
+			}
+		})
+	})
+}
+
+// one write in every sixteen operations
+
+func BenchmarkShareRingReadMostly(b *testing.B) {
+	rb := &Roundabout{}
+	counter := 0
+	read := func(uint16, uint16) error {
+		_ = counter
+		return nil
+	}
+	write := func(uint16, uint16) error {
+		counter++
+		return nil
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			i++
+			if i%16 == 0 {
+				rb.LockRing(write)
+			} else {
+				rb.ShareRing(read)
+			}
+		}
+	})
+}
+
+// 32 goroutines, each storing to and loading from its own slot in the log,
+// the way push and pop do. compare against -tags crowpadded to see what
+// false sharing costs
+
+func BenchmarkLogFalseSharing(b *testing.B) {
+	rb := &Roundabout{}
+	var wg sync.WaitGroup
+	per := b.N/width + 1
+	b.ResetTimer()
+	for n := range width {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cell := &rb.log[n]
+			for i := range per {
+				cell.Store(uint64(i))
+				if cell.Load() != uint64(i) {
+					b.Error("slot changed under us", n)
+					return
+				}
+			}
+		}()
 	}
-	// or b.RunParallel(func(pb *testing.PB) {})
+	wg.Wait()
 }
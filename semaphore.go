@@ -0,0 +1,128 @@
+package crow
+
+import (
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+)
+
+// A Weighted Semaphore
+//
+// Up to 32 permits, kept as a bitmap like the roundabout's header, and
+// acquiring takes all of the bits it needs in one CAS, so a job never
+// holds half of its permits while waiting for the rest. Waiters park
+// on the bitmap, and releases wake them up.
+//
+// The permits have a bitmap of their own, rather than claiming cells in
+// the roundabout's header. a push takes one cell, the next in epoch
+// order, and holds up everything after it until it's popped, so a job
+// can't take weight cells in one go, and a long job would stall every
+// other cell behind it. the roundabout is only used for parking.
+//
+// There's no queue, so a job wanting lots of permits can be starved by
+// a steady stream of small ones.
+
+type WeightedSemaphore struct {
+	Size int // how many permits, from 1 to 32, zero means 32
+
+	permits atomic.Uint64 // bitmap of permits in use
+	rb      Roundabout    // for parking
+}
+
+func (s *WeightedSemaphore) mask() uint32 {
+	if s.Size <= 0 || s.Size >= 32 {
+		return 0xFFFFFFFF
+	}
+	return 1<<s.Size - 1
+}
+
+// claim the lowest free bits, returning the old and new bitmaps
+func (s *WeightedSemaphore) claim(weight int) (old uint64, new uint64, ok bool) {
+	old = s.permits.Load()
+	free := ^uint32(old) & s.mask()
+	if bits.OnesCount32(free) < weight {
+		return old, old, false
+	}
+	claimed := uint32(old)
+	for range weight {
+		b := free & -free
+		claimed |= b
+		free &^= b
+	}
+	return old, uint64(claimed), true
+}
+
+// a weight of zero takes nothing, and always succeeds, as it does for
+// x/sync/semaphore. a negative one is a bug in the caller, and would
+// otherwise look like it got its permits
+
+func (s *WeightedSemaphore) check(weight int) {
+	if weight < 0 {
+		panic(fmt.Sprintf("crow: semaphore weight %d is negative", weight))
+	}
+	if weight > bits.OnesCount32(s.mask()) {
+		panic(fmt.Sprintf("crow: semaphore weight %d is more than its size", weight))
+	}
+}
+
+// block until there are weight permits free, and take them
+func (s *WeightedSemaphore) Acquire(weight int) {
+	s.check(weight)
+	var b rb_backoff
+	for true {
+		old, new, ok := s.claim(weight)
+		if !ok {
+			b.park(&s.rb, &s.permits, old)
+			continue
+		}
+		if s.permits.CompareAndSwap(old, new) {
+			return
+		}
+	}
+	// huh
+	panic(unreachable("Acquire"))
+}
+
+// take weight permits if they're free, without waiting
+func (s *WeightedSemaphore) TryAcquire(weight int) bool {
+	s.check(weight)
+	for true {
+		old, new, ok := s.claim(weight)
+		if !ok {
+			return false
+		}
+		if s.permits.CompareAndSwap(old, new) {
+			return true
+		}
+	}
+	// huh
+	panic(unreachable("TryAcquire"))
+}
+
+// give back weight permits. permits are all alike, so we clear the
+// lowest bits in use, rather than the ones we were given
+
+func (s *WeightedSemaphore) Release(weight int) {
+	s.check(weight)
+	for true {
+		old := s.permits.Load()
+		used := uint32(old)
+		if bits.OnesCount32(used) < weight {
+			panic("crow: semaphore released more than was acquired")
+		}
+		for range weight {
+			used &= used - 1
+		}
+		if s.permits.CompareAndSwap(old, uint64(used)) {
+			s.rb.wakeup()
+			return
+		}
+	}
+	// huh
+	panic(unreachable("Release"))
+}
+
+// how many permits are in use
+func (s *WeightedSemaphore) InUse() int {
+	return bits.OnesCount64(s.permits.Load())
+}
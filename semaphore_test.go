@@ -0,0 +1,74 @@
+package crow
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWeightedSemaphore(t *testing.T) {
+	s := &WeightedSemaphore{Size: 4}
+	s.Acquire(3)
+	if s.TryAcquire(2) {
+		t.Error("acquired more than the size")
+	}
+	if !s.TryAcquire(1) || s.InUse() != 4 {
+		t.Error("couldn't take the last permit", s.InUse())
+	}
+	s.Release(4)
+	if s.InUse() != 0 {
+		t.Error("permits left after release", s.InUse())
+	}
+
+	// a weight of zero takes nothing
+	s.Acquire(0)
+	if !s.TryAcquire(0) || s.InUse() != 0 {
+		t.Error("a weight of zero took permits", s.InUse())
+	}
+	s.Release(0)
+
+	// too big, or negative, panics
+	expectPanic := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Error(name, "didn't panic")
+			}
+		}()
+		fn()
+	}
+	expectPanic("acquiring more than the size", func() { s.Acquire(5) })
+	expectPanic("acquiring a negative weight", func() { s.Acquire(-1) })
+	expectPanic("trying a negative weight", func() { s.TryAcquire(-1) })
+	expectPanic("releasing a negative weight", func() { s.Release(-1) })
+	if s.InUse() != 0 {
+		t.Error("permits taken by a bad weight", s.InUse())
+	}
+}
+
+func TestWeightedSemaphoreConcurrent(t *testing.T) {
+	s := &WeightedSemaphore{Size: 8}
+	var outstanding atomic.Int32
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				weight := 1 + (w+i)%4
+				s.Acquire(weight)
+				if n := outstanding.Add(int32(weight)); n > 8 {
+					t.Error("too many permits outstanding", n)
+				}
+				outstanding.Add(-int32(weight))
+				s.Release(weight)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s.InUse() != 0 {
+		t.Error("permits left behind", s.InUse())
+	}
+}
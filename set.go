@@ -0,0 +1,72 @@
+package crow
+
+// A Big Locked Set
+//
+// Like LockedMap, reads use ShareRing, and changes use LockRing
+
+type Set[T comparable] struct {
+	rb    Roundabout
+	inner map[T]struct{}
+}
+
+// add the item, returning true if it wasn't already in the set
+
+func (s *Set[T]) Add(item T) (added bool) {
+	s.rb.LockRing(func(epoch uint16, flags uint16) error {
+		if s.inner == nil {
+			s.inner = make(map[T]struct{}, 8)
+		}
+		if _, ok := s.inner[item]; !ok {
+			s.inner[item] = struct{}{}
+			added = true
+		}
+		return nil
+	})
+	return
+}
+
+// remove the item, returning true if it was in the set
+
+func (s *Set[T]) Remove(item T) (removed bool) {
+	s.rb.LockRing(func(epoch uint16, flags uint16) error {
+		if _, ok := s.inner[item]; ok {
+			delete(s.inner, item)
+			removed = true
+		}
+		return nil
+	})
+	return
+}
+
+func (s *Set[T]) Contains(item T) (ok bool) {
+	s.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		_, ok = s.inner[item]
+		return nil
+	})
+	return
+}
+
+func (s *Set[T]) Len() (n int) {
+	s.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		n = len(s.inner)
+		return nil
+	})
+	return
+}
+
+func (s *Set[T]) Range(f func(item T) bool) {
+	// like the maps, we copy so the callback can use the set
+	var items []T
+	s.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		items = make([]T, 0, len(s.inner))
+		for k := range s.inner {
+			items = append(items, k)
+		}
+		return nil
+	})
+	for _, k := range items {
+		if !f(k) {
+			break
+		}
+	}
+}
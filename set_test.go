@@ -0,0 +1,58 @@
+package crow
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	s := &Set[string]{}
+
+	if s.Contains("a") || s.Remove("a") || s.Len() != 0 {
+		t.Error("empty set has items")
+	}
+	if !s.Add("a") || s.Add("a") {
+		t.Error("add didn't report change")
+	}
+	s.Add("b")
+	if !s.Contains("a") || s.Len() != 2 {
+		t.Error("missing items")
+	}
+
+	seen := 0
+	s.Range(func(item string) bool {
+		seen++
+		s.Remove(item)
+		return true
+	})
+	if seen != 2 || s.Len() != 0 {
+		t.Error("range didn't visit every item", seen, s.Len())
+	}
+}
+
+func TestSetConcurrent(t *testing.T) {
+	s := &Set[int]{}
+	var added, removed atomic.Int32
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				if s.Add(i) {
+					added.Add(1)
+				}
+				if s.Remove(99 - i) {
+					removed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if int(added.Load()-removed.Load()) != s.Len() {
+		t.Error("adds and removes don't match", added.Load(), removed.Load(), s.Len())
+	}
+}
@@ -0,0 +1,78 @@
+package crow
+
+import (
+	"fmt"
+)
+
+// Calls with the same key, run once at a time
+//
+// SingleFlight coalesces concurrent calls, like x/sync/singleflight: the
+// first Do for a key runs fn, and any Do for the same key that comes in
+// while it's running waits for it, and gets the same result, rather than
+// running fn again. once fn returns, the key is forgotten, and the next
+// Do runs it afresh. results aren't cached.
+//
+// The calls in flight are kept in a LockedMap, and each key is guarded by
+// a LockLane on LaneFor(key), so that joining a call, and finishing it,
+// only waits on the same lane. fn runs outside of the lane, so it can take
+// as long as it likes, and call Do itself, with another key.
+//
+// If fn panics, the callers waiting on it get an error, and the panic
+// carries on up the caller that ran it.
+//
+// The zero value is ready to use.
+
+type SingleFlight struct {
+	rb    Roundabout
+	calls LockedMap // key -> *flight_call
+}
+
+type flight_call struct {
+	done  chan struct{}
+	value any
+	err   error
+	dups  int // callers that joined, under the lane
+}
+
+// shared is true when the result went to more than one caller, for the
+// one that ran fn as well as the ones that waited
+
+func (s *SingleFlight) Do(key any, fn func() (any, error)) (value any, err error, shared bool) {
+	lane := LaneFor(key)
+	var c *flight_call
+	leader := false
+	s.rb.LockLane(lane, func(epoch uint16, flags uint16) error {
+		if v, ok := s.calls.Load(key); ok {
+			c = v.(*flight_call)
+			c.dups++
+			return nil
+		}
+		c = &flight_call{done: make(chan struct{})}
+		s.calls.Store(key, c)
+		leader = true
+		return nil
+	})
+
+	if !leader {
+		<-c.done
+		return c.value, c.err, true
+	}
+
+	// once we're done, no-one else can join, so dups is settled, and
+	// we can let the waiters go
+	finished := false
+	defer func() {
+		if !finished {
+			c.err = fmt.Errorf("crow: SingleFlight call for %v panicked", key)
+		}
+		s.rb.LockLane(lane, func(epoch uint16, flags uint16) error {
+			s.calls.Delete(key)
+			shared = c.dups > 0
+			return nil
+		})
+		close(c.done)
+	}()
+	c.value, c.err = fn()
+	finished = true
+	return c.value, c.err, false
+}
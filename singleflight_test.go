@@ -0,0 +1,123 @@
+package crow
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// how many callers have joined the call in flight for key
+
+func flightDups(s *SingleFlight, key any) (dups int) {
+	s.rb.ShareLane(LaneFor(key), func(epoch uint16, flags uint16) error {
+		if v, ok := s.calls.Load(key); ok {
+			dups = v.(*flight_call).dups
+		}
+		return nil
+	})
+	return
+}
+
+func TestSingleFlight(t *testing.T) {
+	var s SingleFlight
+	var calls atomic.Int32
+	release := make(chan bool)
+	fn := func() (any, error) {
+		calls.Add(1)
+		<-release
+		return "done", nil
+	}
+
+	// one caller runs fn, and the rest join it
+	callers := stressedWorkers(8)
+	var wg sync.WaitGroup
+	results := make([]any, callers)
+	shared := make([]bool, callers)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _, shared[0] = s.Do("key", fn)
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _, shared[i] = s.Do("key", fn)
+		}()
+	}
+	for flightDups(&s, "key") != callers-1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// another key doesn't wait for it
+	v, err, sh := s.Do("other", func() (any, error) { return 1, nil })
+	if v != 1 || err != nil || sh {
+		t.Error("wrong result for another key:", v, err, sh)
+	}
+
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Error("fn ran", calls.Load(), "times")
+	}
+	for i := range callers {
+		if results[i] != "done" || !shared[i] {
+			t.Error("caller", i, "got", results[i], shared[i])
+		}
+	}
+
+	// once it's finished, the next call runs fn again, and errors are
+	// passed on
+	boom := errors.New("boom")
+	v, err, sh = s.Do("key", func() (any, error) { return nil, boom })
+	if v != nil || err != boom || sh {
+		t.Error("wrong result after the flight:", v, err, sh)
+	}
+	if _, ok := s.calls.Load("key"); ok {
+		t.Error("call left behind")
+	}
+}
+
+// a panic in fn reaches the caller that ran it, and the ones waiting on
+// it get an error rather than hanging
+
+func TestSingleFlightPanic(t *testing.T) {
+	var s SingleFlight
+	release := make(chan bool)
+	running := make(chan bool)
+
+	panicked := make(chan any)
+	go func() {
+		defer func() { panicked <- recover() }()
+		s.Do("key", func() (any, error) {
+			close(running)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-running
+
+	joined := make(chan error)
+	go func() {
+		_, err, _ := s.Do("key", func() (any, error) { return nil, nil })
+		joined <- err
+	}()
+	for flightDups(&s, "key") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if r := <-panicked; r != "boom" {
+		t.Error("wrong panic:", r)
+	}
+	if err := <-joined; err == nil {
+		t.Error("waiter didn't get an error")
+	}
+	if _, ok := s.calls.Load("key"); ok {
+		t.Error("call left behind")
+	}
+}
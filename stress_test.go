@@ -0,0 +1,54 @@
+package crow
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// Concurrency bugs only show up now and again, so the tests that race
+// goroutines against each other can be made to run for longer, with more
+// of them. The defaults keep a normal run quick, and a nightly run can ask
+// for more with
+//
+//	go test -race -stress 20
+//
+// or with CROW_STRESS=20 in the environment, for when the flags aren't
+// easy to reach. CROW_STRESS_WORKERS scales the goroutines separately, and
+// defaults to the same as CROW_STRESS
+
+var (
+	stressRounds  = flag.Int("stress", envInt("CROW_STRESS", 1), "multiply the rounds in concurrent tests")
+	stressWorkers = flag.Int("stress.workers", envInt("CROW_STRESS_WORKERS", 0), "multiply the goroutines in concurrent tests, 0 for -stress")
+)
+
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if *stressRounds < 1 {
+		*stressRounds = 1
+	}
+	if *stressWorkers < 1 {
+		*stressWorkers = *stressRounds
+	}
+	os.Exit(m.Run())
+}
+
+// how many times round a loop, scaled by -stress
+
+func stressed(rounds int) int {
+	return rounds * *stressRounds
+}
+
+// how many goroutines to start, scaled by -stress.workers
+
+func stressedWorkers(workers int) int {
+	return workers * *stressWorkers
+}
@@ -0,0 +1,96 @@
+package crow
+
+import (
+	"sync"
+)
+
+// A sync.Map behind the ConcurrentMap interface
+//
+// *sync.Map already has every method we need, as we build with go 1.23,
+// but it keeps nil values, and we treat them as absent keys. the adapter
+// never stores a nil, so it behaves like the other maps here, and can be
+// swapped in for them to compare workloads:
+//
+// - Store or Swap with a nil value deletes the key
+// - LoadOrStore with a nil value only loads
+// - CompareAndSwap with an old value of nil is insert-if-absent
+// - CompareAndDelete with an old value of nil is always false
+//
+// The zero value is ready to use.
+
+type SyncMapAdapter struct {
+	m sync.Map
+}
+
+func (s *SyncMapAdapter) Clear() {
+	s.m.Clear()
+}
+
+func (s *SyncMapAdapter) Load(key any) (value any, ok bool) {
+	return s.m.Load(key)
+}
+
+func (s *SyncMapAdapter) Store(key, value any) {
+	if value == nil {
+		s.m.Delete(key)
+		return
+	}
+	s.m.Store(key, value)
+}
+
+func (s *SyncMapAdapter) Swap(key, value any) (previous any, loaded bool) {
+	if value == nil {
+		return s.m.LoadAndDelete(key)
+	}
+	return s.m.Swap(key, value)
+}
+
+func (s *SyncMapAdapter) LoadOrStore(key, value any) (actual any, loaded bool) {
+	if value == nil {
+		if actual, ok := s.m.Load(key); ok {
+			return actual, true
+		}
+		return nil, false
+	}
+	return s.m.LoadOrStore(key, value)
+}
+
+func (s *SyncMapAdapter) LoadAndDelete(key any) (value any, loaded bool) {
+	return s.m.LoadAndDelete(key)
+}
+
+func (s *SyncMapAdapter) Delete(key any) {
+	s.m.Delete(key)
+}
+
+func (s *SyncMapAdapter) CompareAndDelete(key, old any) (deleted bool) {
+	if old == nil {
+		return false
+	}
+	return s.m.CompareAndDelete(key, old)
+}
+
+// an old value of nil means the key must be absent, and a new value of nil
+// deletes it
+
+func (s *SyncMapAdapter) CompareAndSwap(key, old, new any) (swapped bool) {
+	switch {
+	case old == nil && new == nil:
+		_, ok := s.m.Load(key)
+		return !ok
+	case old == nil:
+		_, loaded := s.m.LoadOrStore(key, new)
+		return !loaded
+	case new == nil:
+		return s.m.CompareAndDelete(key, old)
+	}
+	return s.m.CompareAndSwap(key, old, new)
+}
+
+func (s *SyncMapAdapter) Range(f func(key, value any) bool) {
+	s.m.Range(f)
+}
+
+func (s *SyncMapAdapter) RangeErr(f func(key, value any) error) error {
+	return rangeErr(s, f)
+}
@@ -0,0 +1,220 @@
+package crow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// A ring operation held outside of a callback
+//
+// AcquireRing gets a cell and waits for its turn, like LockRing, OrderRing,
+// or ShareRing, but hands back a Ticket rather than running a callback.
+// Everything after us waits until Release, so a Ticket must be released
+// exactly once, and shouldn't be held for long. Releasing a ticket twice
+// panics, as the second pop could free someone else's cell.
+//
+// A ticket has no lane, so it can't be used for lane operations.
+//
+// A ticket isn't tied to the goroutine that got it, and it can be handed
+// to another one, over a channel, say, which then owns it: it's the only
+// one that may Wait on it or Release it, and the goroutine that handed it
+// on must not touch it again. ReserveRing takes a cell without waiting for
+// its turn, so that one goroutine can take cells in order, and hand them
+// out to others, which each Wait for their turn, do the work, and Release.
+// Everything after a ticket waits until it's released, however many
+// goroutines it passes through on the way.
+
+type Ticket struct {
+	rb   *Roundabout
+	cell rb_cell
+}
+
+// returned by enter when its done channel closes, and turned into the
+// context's error before anyone outside sees it
+
+var errDone = errors.New("crow: done")
+
+// the epoch our cell was allocated in
+func (t Ticket) Epoch() uint16 {
+	return t.cell.epoch
+}
+
+// the flags from the header when our cell was allocated
+func (t Ticket) Flags() uint16 {
+	return t.cell.flags
+}
+
+// wait for every operation before the ticket that conflicts with it, for
+// a ticket from ReserveRing. if ctx ends first, or the roundabout is
+// aborted, we return the error, and the ticket is still held, to be
+// waited on again or released. a ticket from AcquireRing has already
+// waited, and returns straight away
+
+func (t Ticket) Wait(ctx context.Context) error {
+	if t.rb == nil {
+		panic("crow: waiting on an empty Ticket")
+	}
+	if err := t.rb.waitDone(t.cell, ctx.Done()); errors.Is(err, errDone) {
+		return ctxErr(ctx)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t Ticket) Release() {
+	if t.rb == nil {
+		panic("crow: releasing an empty Ticket")
+	}
+	want := Cell{t.cell.epoch, t.cell.kind, t.cell.lane}.pack()
+	if t.rb.log[t.cell.n].Load() != want {
+		panic("crow: Ticket released twice")
+	}
+	t.rb.pop(t.cell)
+}
+
+// get a ring cell of the given kind, waiting for room in the ring, and
+// then for everything before us that conflicts. if ctx ends first, we
+// give up without a cell, and return ctx.Err(), wrapped in ErrTimeout if
+// the deadline passed. a closed roundabout returns ErrClosed
+
+func (rb *Roundabout) AcquireRing(ctx context.Context, kind uint16) (Ticket, error) {
+	return rb.acquireRing(ctx, kind, false)
+}
+
+// like AcquireRing, but returns ErrRingFull straight away if the ring has
+// no room, rather than waiting for a cell. it still waits for anything
+// before us that conflicts
+
+func (rb *Roundabout) TryAcquireRing(ctx context.Context, kind uint16) (Ticket, error) {
+	return rb.acquireRing(ctx, kind, true)
+}
+
+// like AcquireRing, but we only wait for room in the ring, not for the
+// operations before us, which is left to Ticket.Wait. the ticket still
+// holds up everything after it, so it must be released, even if it's
+// never waited on, or the wait fails
+
+func (rb *Roundabout) ReserveRing(ctx context.Context, kind uint16) (Ticket, error) {
+	if kind != LockRing && kind != OrderRing && kind != ShareRing {
+		panic(fmt.Sprintf("crow: ReserveRing with kind %d, which isn't a ring operation", kind))
+	}
+	if ctx.Err() != nil {
+		return Ticket{}, ctxErr(ctx)
+	}
+	rb_cell, err := rb.enter(rb_cell{kind: kind}, ctx.Done(), false)
+	if errors.Is(err, errDone) {
+		return Ticket{}, ctxErr(ctx)
+	} else if err != nil {
+		return Ticket{}, err
+	}
+	return Ticket{rb: rb, cell: rb_cell}, nil
+}
+
+func (rb *Roundabout) acquireRing(ctx context.Context, kind uint16, try bool) (Ticket, error) {
+	if kind != LockRing && kind != OrderRing && kind != ShareRing {
+		panic(fmt.Sprintf("crow: AcquireRing with kind %d, which isn't a ring operation", kind))
+	}
+	return rb.acquire(ctx, rb_cell{kind: kind}, try)
+}
+
+// enter and wait, giving up part way if ctx ends, and popping the cell
+// ourselves if we do. LockRing, OrderRing, and ShareRing are built on
+// this, and lane cells come through here too, for LockManager
+
+func (rb *Roundabout) acquire(ctx context.Context, want rb_cell, try bool) (Ticket, error) {
+	if ctx.Err() != nil {
+		return Ticket{}, ctxErr(ctx)
+	}
+	done := ctx.Done()
+	var t Ticket
+	var err error
+	t.cell, err = rb.enter(want, done, try)
+	if err != nil {
+		if errors.Is(err, errDone) {
+			return Ticket{}, ctxErr(ctx)
+		}
+		return Ticket{}, err
+	}
+
+	// t.rb is only set once we hold the cell
+	defer func() {
+		if t.rb == nil {
+			rb.pop(t.cell)
+		}
+	}()
+	if err := rb.waitDone(t.cell, done); err != nil {
+		if errors.Is(err, errDone) {
+			return Ticket{}, ctxErr(ctx)
+		}
+		return Ticket{}, err
+	}
+	t.rb = rb
+	return t, nil
+}
+
+// a deadline that passed is a timeout, and a cancel is just a cancel
+
+func ctxErr(ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// A LockRing held until it's lowered
+//
+// RaiseBarrier takes a LockRing cell and keeps it, so every operation
+// that starts afterwards waits until LowerBarrier, while the ones that
+// started before it finish first. It's a Ticket under another name, and
+// the token can be passed around and lowered somewhere else.
+//
+// Nothing stops the goroutine holding the barrier from calling into the
+// roundabout again, and if it does, it waits behind its own barrier, and
+// deadlocks. with -tags crowdebug, we note the goroutine that raised it,
+// and it panics instead, until the barrier is lowered.
+//
+// If the roundabout is closed or aborted, RaiseBarrier returns a token
+// that isn't raised, and lowering it does nothing
+
+type BarrierToken struct {
+	ticket Ticket
+	g      uint64 // goroutine that raised it, with checkNesting
+}
+
+func (b BarrierToken) Raised() bool {
+	return b.ticket.rb != nil
+}
+
+func (rb *Roundabout) RaiseBarrier() BarrierToken {
+	ticket, err := rb.AcquireRing(context.Background(), LockRing)
+	if err != nil {
+		return BarrierToken{}
+	}
+	b := BarrierToken{ticket: ticket}
+	if checkNesting {
+		b.g = goid()
+		rb.guarded.Store(b.g, "RaiseBarrier")
+		rb.guards.Add(1)
+	}
+	return b
+}
+
+// like Ticket.Release, lowering a barrier twice panics
+
+func (rb *Roundabout) LowerBarrier(b BarrierToken) {
+	if !b.Raised() {
+		return
+	}
+	if b.ticket.rb != rb {
+		panic("crow: lowering a barrier from another roundabout")
+	}
+	if checkNesting {
+		if _, ok := rb.guarded.LoadAndDelete(b.g); ok {
+			rb.guards.Add(-1)
+		}
+	}
+	b.ticket.Release()
+}
@@ -0,0 +1,327 @@
+package crow
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAcquireRing(t *testing.T) {
+	rb := &Roundabout{}
+	ctx := context.Background()
+
+	lock, err := rb.AcquireRing(ctx, LockRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.Epoch() != 0 {
+		t.Error("wrong epoch", lock.Epoch())
+	}
+
+	done := make(chan bool)
+	go func() {
+		rb.ShareRing(func(uint16, uint16) error { return nil })
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Error("ShareRing ran while a LockRing ticket was held")
+	case <-time.After(20 * time.Millisecond):
+	}
+	lock.Release()
+	<-done
+
+	// readers hold tickets side by side
+	a, err := rb.AcquireRing(ctx, ShareRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := rb.TryAcquireRing(ctx, ShareRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+	a.Release()
+
+	if !rb.idle() {
+		t.Error("tickets leaked a cell", rb.String())
+	}
+}
+
+func TestAcquireRingContext(t *testing.T) {
+	rb := &Roundabout{}
+	lock, err := rb.AcquireRing(context.Background(), LockRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = rb.AcquireRing(ctx, ShareRing)
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrTimeout) {
+		t.Error("wrong error on cancel", err)
+	}
+
+	// an expired context doesn't even try
+	_, err = rb.AcquireRing(ctx, ShareRing)
+	if !errors.Is(err, context.Canceled) {
+		t.Error("wrong error with a done context", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = rb.AcquireRing(ctx, OrderRing)
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("wrong error on deadline", err)
+	}
+
+	lock.Release()
+	if !rb.idle() {
+		t.Error("giving up leaked a cell", rb.String())
+	}
+}
+
+func TestAcquireRingFull(t *testing.T) {
+	rb := &Roundabout{}
+	cells := make([]rb_cell, 0, width)
+	for range width {
+		c, r := rb.push(0, ShareRing)
+		if r != pushInserted {
+			t.Fatal("couldn't fill the ring", r)
+		}
+		cells = append(cells, c)
+	}
+
+	if _, err := rb.TryAcquireRing(context.Background(), ShareRing); !errors.Is(err, ErrRingFull) {
+		t.Error("wrong error on a full ring", err)
+	}
+
+	// queue up a waiter, one that gives up, and another waiter behind it.
+	// the one that gave up mustn't hold up the one behind it
+	var wg sync.WaitGroup
+	queue := func() {
+		arrivals := rb.arrivals.Load()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rb.ShareRing(func(uint16, uint16) error { return nil })
+		}()
+		for rb.arrivals.Load() == arrivals {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	queue()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := rb.AcquireRing(ctx, ShareRing); !errors.Is(err, ErrTimeout) {
+		t.Error("wrong error waiting on a full ring", err)
+	}
+
+	queue()
+
+	// two cells free, for the two waiters
+	rb.pop(cells[0])
+	rb.pop(cells[1])
+	wg.Wait()
+
+	for _, c := range cells[2:] {
+		rb.pop(c)
+	}
+	if rb.arrivals.Load() != rb.admitted.Load() {
+		t.Error("queue left behind", rb.arrivals.Load(), rb.admitted.Load())
+	}
+	if !rb.idle() {
+		t.Error("cells leaked", rb.String())
+	}
+}
+
+func TestAcquireRingClosed(t *testing.T) {
+	rb := &Roundabout{}
+	rb.Close()
+	if _, err := rb.AcquireRing(context.Background(), LockRing); !errors.Is(err, ErrClosed) {
+		t.Error("wrong error when closed", err)
+	}
+}
+
+func TestTicketMisuse(t *testing.T) {
+	rb := &Roundabout{}
+	panics := func(name string, fn func()) {
+		defer func() {
+			if recover() == nil {
+				t.Error(name, "didn't panic")
+			}
+		}()
+		fn()
+	}
+
+	panics("lane kind", func() {
+		rb.AcquireRing(context.Background(), LockLane)
+	})
+
+	ticket, err := rb.AcquireRing(context.Background(), OrderRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket.Release()
+	panics("second release", ticket.Release)
+	panics("empty ticket", Ticket{}.Release)
+	panics("reserve lane kind", func() {
+		rb.ReserveRing(context.Background(), OrderLane)
+	})
+	panics("wait on empty ticket", func() {
+		Ticket{}.Wait(context.Background())
+	})
+}
+
+func TestBarrier(t *testing.T) {
+	rb := &Roundabout{}
+
+	// a reader that started before the barrier goes first
+	reading := make(chan bool)
+	release := make(chan bool)
+	go rb.ShareRing(func(uint16, uint16) error {
+		close(reading)
+		<-release
+		return nil
+	})
+	<-reading
+
+	raised := make(chan BarrierToken)
+	go func() { raised <- rb.RaiseBarrier() }()
+	select {
+	case <-raised:
+		t.Fatal("barrier raised over an earlier reader")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	b := <-raised
+	if !b.Raised() {
+		t.Fatal("barrier wasn't raised")
+	}
+
+	// everything after it waits, lanes and rings
+	var ran sync.WaitGroup
+	var after atomic.Int32
+	for _, fn := range []func(func(uint16, uint16) error) error{
+		rb.ShareRing,
+		rb.LockRing,
+		func(fn func(uint16, uint16) error) error { return rb.ShareLane(1, fn) },
+		func(fn func(uint16, uint16) error) error { return rb.LockLane(2, fn) },
+	} {
+		ran.Add(1)
+		go func() {
+			defer ran.Done()
+			fn(func(uint16, uint16) error {
+				after.Add(1)
+				return nil
+			})
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := after.Load(); n != 0 {
+		t.Error(n, "operations ran while the barrier was up")
+	}
+
+	rb.LowerBarrier(b)
+	ran.Wait()
+	if n := after.Load(); n != 4 {
+		t.Error("operations lost after lowering", n)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("lowering twice didn't panic")
+			}
+		}()
+		rb.LowerBarrier(b)
+	}()
+	if !rb.idle() {
+		t.Error("barrier leaked a cell", rb.String())
+	}
+
+	// closed roundabouts don't raise one
+	rb.Close()
+	b = rb.RaiseBarrier()
+	if b.Raised() {
+		t.Error("barrier raised on a closed roundabout")
+	}
+	rb.LowerBarrier(b)
+}
+
+func TestTicketHandoff(t *testing.T) {
+	// one producer takes the cells in order, and hands each to whichever
+	// consumer is free, which waits for its turn, does the work, and
+	// releases it. OrderRing cells run one at a time, in epoch order,
+	// whoever ends up holding them
+	rb := &Roundabout{}
+	ctx := context.Background()
+	tickets := make(chan Ticket)
+	var order []uint16
+	var inside atomic.Int32
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ticket := range tickets {
+				if err := ticket.Wait(ctx); err != nil {
+					t.Error(err)
+				}
+				if inside.Add(1) != 1 {
+					t.Error("two tickets running at once")
+				}
+				order = append(order, ticket.Epoch())
+				inside.Add(-1)
+				ticket.Release()
+			}
+		}()
+	}
+
+	for range 100 {
+		ticket, err := rb.ReserveRing(ctx, OrderRing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tickets <- ticket
+	}
+	close(tickets)
+	wg.Wait()
+
+	if len(order) != 100 {
+		t.Fatal("lost a ticket", len(order))
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i] != order[i-1]+1 {
+			t.Error("tickets ran out of order", order[i-1], order[i])
+		}
+	}
+	if !rb.idle() {
+		t.Error("handoff leaked a cell", rb.String())
+	}
+
+	// a reserved ticket hasn't waited yet, and a failed wait still holds
+	lock, _ := rb.AcquireRing(ctx, LockRing)
+	ticket, err := rb.ReserveRing(ctx, ShareRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := ticket.Wait(short); !errors.Is(err, ErrTimeout) {
+		t.Error("wait didn't time out behind a LockRing", err)
+	}
+	lock.Release()
+	if err := ticket.Wait(ctx); err != nil {
+		t.Error(err)
+	}
+	ticket.Release()
+	if !rb.idle() {
+		t.Error("cells leaked", rb.String())
+	}
+}
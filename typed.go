@@ -0,0 +1,209 @@
+package crow
+
+import (
+	"sync/atomic"
+)
+
+// A BoxedEntry with a type
+//
+// An atomic.Pointer rather than an atomic.Value, so there's no interface
+// boxing, and no panic for storing values of different concrete types
+// into an Entry[any]. A nil pointer is a tombstone for a deleted value.
+// Pointers are compared by identity, so CompareAndSwap needs the pointer
+// that was loaded, not an equal value.
+
+type Entry[V any] struct {
+	p atomic.Pointer[V]
+}
+
+func (e *Entry[V]) Load() *V {
+	return e.p.Load()
+}
+
+func (e *Entry[V]) Store(v *V) {
+	e.p.Store(v)
+}
+
+func (e *Entry[V]) Swap(v *V) (old *V) {
+	return e.p.Swap(v)
+}
+
+// an old value of nil means the entry must be empty, so that it can be
+// filled in without overwriting anyone
+
+func (e *Entry[V]) CompareAndSwap(old, new *V) bool {
+	return e.p.CompareAndSwap(old, new)
+}
+
+func (e *Entry[V]) Delete() {
+	e.p.Store(nil)
+}
+
+// A BoxedMap with types
+//
+// Each value lives in an Entry rather than a BoxedEntry, so there's no
+// interface boxing on a load, and no restriction on the concrete types
+// stored. A nil pointer is a tombstone for a deleted value.
+//
+// Like BoxedMap, reads use ShareRing, and only adding or removing keys
+// needs a LockRing. Changing the value of a key that's already there only
+// needs an OrderRing, which doesn't keep readers out.
+
+type TypedBoxedMap[K comparable, V any] struct {
+	rb    Roundabout
+	inner map[K]*Entry[V]
+}
+
+func (m *TypedBoxedMap[K, V]) Load(key K) (value V, ok bool) {
+	if m == nil {
+		return
+	}
+
+	var p *V
+	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		if e := m.inner[key]; e != nil {
+			p = e.Load()
+		}
+		return nil
+	})
+	if p == nil {
+		return value, false
+	}
+	return *p, true
+}
+
+// update the entry for key under an OrderRing if it's there, returning
+// false if we need a LockRing to add it
+
+func (m *TypedBoxedMap[K, V]) update(key K, fn func(e *Entry[V])) (found bool) {
+	m.rb.OrderRing(func(epoch uint16, flags uint16) error {
+		if e := m.inner[key]; e != nil {
+			fn(e)
+			found = true
+		}
+		return nil
+	})
+	return
+}
+
+// like update, but adds the entry under a LockRing if it's missing. we
+// look again once we have the LockRing, as someone may have beaten us
+
+func (m *TypedBoxedMap[K, V]) upsert(key K, fn func(e *Entry[V])) {
+	if m.update(key, fn) {
+		return
+	}
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		if m.inner == nil {
+			m.inner = make(map[K]*Entry[V], 8)
+		}
+		e := m.inner[key]
+		if e == nil {
+			e = new(Entry[V])
+			m.inner[key] = e
+		}
+		fn(e)
+		return nil
+	})
+}
+
+func (m *TypedBoxedMap[K, V]) Store(key K, value V) {
+	m.upsert(key, func(e *Entry[V]) {
+		e.Store(&value)
+	})
+}
+
+func (m *TypedBoxedMap[K, V]) Swap(key K, value V) (previous V, loaded bool) {
+	m.upsert(key, func(e *Entry[V]) {
+		if p := e.Swap(&value); p != nil {
+			previous, loaded = *p, true
+		}
+	})
+	return
+}
+
+func (m *TypedBoxedMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	m.upsert(key, func(e *Entry[V]) {
+		if e.CompareAndSwap(nil, &value) {
+			actual = value
+		} else {
+			actual, loaded = *e.Load(), true
+		}
+	})
+	return
+}
+
+// deleting leaves a tombstone behind, so it never needs a LockRing
+
+func (m *TypedBoxedMap[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
+	m.update(key, func(e *Entry[V]) {
+		if p := e.Swap(nil); p != nil {
+			value, loaded = *p, true
+		}
+	})
+	return
+}
+
+func (m *TypedBoxedMap[K, V]) Delete(key K) {
+	m.update(key, func(e *Entry[V]) {
+		e.Delete()
+	})
+}
+
+// like BoxedMap, we copy the values out first, so that f can change the map
+
+func (m *TypedBoxedMap[K, V]) Range(f func(key K, value V) bool) {
+	var copy map[K]*V
+	m.rb.ShareRing(func(epoch uint16, flags uint16) error {
+		if len(m.inner) == 0 {
+			return nil
+		}
+		copy = make(map[K]*V, len(m.inner))
+		for k, e := range m.inner {
+			if p := e.Load(); p != nil {
+				copy[k] = p
+			}
+		}
+		return nil
+	})
+
+	for k, p := range copy {
+		if !f(k, *p) {
+			break
+		}
+	}
+}
+
+// removes every entry, tombstones included
+
+func (m *TypedBoxedMap[K, V]) Clear() {
+	m.rb.LockRing(func(epoch uint16, flags uint16) error {
+		clear(m.inner)
+		return nil
+	})
+}
+
+// typed reads from the untyped maps, for when every value has the same
+// type, so the caller doesn't have to assert it on every Load. a missing
+// key, or a value of some other type, gives the zero value and false
+
+type map_loader interface {
+	Load(key any) (value any, ok bool)
+}
+
+func Get[V any](m map_loader, key any) (V, bool) {
+	v, ok := m.Load(key)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	value, ok := v.(V)
+	return value, ok
+}
+
+// like Get, for when the zero value will do for a missing key
+
+func GetOrZero[V any](m map_loader, key any) V {
+	value, _ := Get[V](m, key)
+	return value
+}
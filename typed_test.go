@@ -0,0 +1,219 @@
+package crow
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestEntry(t *testing.T) {
+	var e Entry[string]
+	if e.Load() != nil {
+		t.Error("empty entry has a value")
+	}
+
+	// nil as the old value only fills in an empty entry
+	one, two := "one", "two"
+	if !e.CompareAndSwap(nil, &one) || e.Load() != &one {
+		t.Error("couldn't fill in an empty entry")
+	}
+	if e.CompareAndSwap(nil, &two) || e.Load() != &one {
+		t.Error("filled in an entry that wasn't empty")
+	}
+
+	// pointers are compared, not the strings they point at
+	same := "one"
+	if e.CompareAndSwap(&same, &two) {
+		t.Error("swapped with an equal value, not the same pointer")
+	}
+	if !e.CompareAndSwap(&one, &two) || *e.Load() != "two" {
+		t.Error("compare and swap failed")
+	}
+	if old := e.Swap(&one); old != &two {
+		t.Error("wrong old value from Swap:", old)
+	}
+
+	// a deleted entry is empty, and can be filled in again
+	e.Delete()
+	if e.Load() != nil || e.CompareAndSwap(&one, &two) {
+		t.Error("deleted entry has a value")
+	}
+	if !e.CompareAndSwap(nil, &two) {
+		t.Error("couldn't fill in a deleted entry")
+	}
+
+	// an Entry[any] takes values of different types, which would panic
+	// in a bare atomic.Value
+	var a Entry[any]
+	x, y := any(1), any("one")
+	a.Store(&x)
+	a.Store(&y)
+	if *a.Load() != "one" {
+		t.Error("wrong value:", *a.Load())
+	}
+}
+
+func TestTypedBoxedMap(t *testing.T) {
+	m := &TypedBoxedMap[string, int]{}
+
+	if _, ok := m.Load("a"); ok {
+		t.Error("empty map has values")
+	}
+	m.Store("a", 1)
+	if v, ok := m.Load("a"); !ok || v != 1 {
+		t.Error("missing value", v, ok)
+	}
+	if prev, loaded := m.Swap("a", 2); !loaded || prev != 1 {
+		t.Error("wrong swap", prev, loaded)
+	}
+	if actual, loaded := m.LoadOrStore("a", 3); !loaded || actual != 2 {
+		t.Error("LoadOrStore replaced a value", actual, loaded)
+	}
+
+	// zero is a value, not a tombstone
+	m.Store("z", 0)
+	if v, ok := m.Load("z"); !ok || v != 0 {
+		t.Error("zero value went missing", v, ok)
+	}
+
+	if v, loaded := m.LoadAndDelete("a"); !loaded || v != 2 {
+		t.Error("wrong LoadAndDelete", v, loaded)
+	}
+	if _, ok := m.Load("a"); ok {
+		t.Error("value still there after delete")
+	}
+	if _, loaded := m.LoadAndDelete("a"); loaded {
+		t.Error("deleted a tombstone")
+	}
+	if actual, loaded := m.LoadOrStore("a", 4); loaded || actual != 4 {
+		t.Error("LoadOrStore didn't replace a tombstone", actual, loaded)
+	}
+
+	m.Delete("z")
+	seen := map[string]int{}
+	m.Range(func(k string, v int) bool {
+		seen[k] = v
+		return true
+	})
+	if len(seen) != 1 || seen["a"] != 4 {
+		t.Error("range saw wrong entries", seen)
+	}
+
+	m.Clear()
+	if len(m.inner) != 0 {
+		t.Error("clear left entries behind", len(m.inner))
+	}
+}
+
+func TestTypedBoxedMapTypes(t *testing.T) {
+	// an atomic.Value would panic storing different concrete types
+	m := &TypedBoxedMap[string, error]{}
+	m.Store("e", errors.New("one"))
+	m.Store("e", fmt.Errorf("two: %w", ErrRetry))
+	if v, ok := m.Load("e"); !ok || !errors.Is(v, ErrRetry) {
+		t.Error("wrong error", v)
+	}
+
+	// a nil interface is still a value
+	m.Store("nil", nil)
+	if v, ok := m.Load("nil"); !ok || v != nil {
+		t.Error("nil value went missing", v, ok)
+	}
+}
+
+func TestTypedBoxedMapConcurrent(t *testing.T) {
+	m := &TypedBoxedMap[int, int]{}
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				k := i % 20
+				switch (w + i) % 4 {
+				case 0:
+					m.Store(k, i)
+				case 1:
+					m.LoadOrStore(k, i)
+				case 2:
+					m.Delete(k)
+				case 3:
+					if v, ok := m.Load(k); ok && v >= 200 {
+						t.Error("impossible value", v)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// reads spread over a thousand keys, against the any-based BoxedMap
+
+func TestGet(t *testing.T) {
+	type point struct{ X, Y int }
+
+	for _, m := range []ConcurrentMap{&LockedMap{}, &BoxedMap{}, &ReadWriteMap{}} {
+		m.Store("name", "crow")
+		m.Store("at", point{1, 2})
+
+		if s, ok := Get[string](m, "name"); !ok || s != "crow" {
+			t.Errorf("%T: wrong string: %q %v", m, s, ok)
+		}
+		if p, ok := Get[point](m, "at"); !ok || p != (point{1, 2}) {
+			t.Errorf("%T: wrong struct: %v %v", m, p, ok)
+		}
+
+		// the wrong type, or a missing key, is the zero value
+		if p, ok := Get[point](m, "name"); ok || p != (point{}) {
+			t.Errorf("%T: wrong type came back: %v %v", m, p, ok)
+		}
+		if s, ok := Get[string](m, "missing"); ok || s != "" {
+			t.Errorf("%T: missing key came back: %q %v", m, s, ok)
+		}
+		if s := GetOrZero[string](m, "at"); s != "" {
+			t.Errorf("%T: wrong type came back: %q", m, s)
+		}
+		if p := GetOrZero[point](m, "at"); p.Y != 2 {
+			t.Errorf("%T: wrong struct: %v", m, p)
+		}
+
+		// an interface type works too
+		m.Store("err", errors.New("boom"))
+		if err, ok := Get[error](m, "err"); !ok || err.Error() != "boom" {
+			t.Errorf("%T: wrong error: %v %v", m, err, ok)
+		}
+	}
+}
+
+func BenchmarkTypedBoxedMapLoad(b *testing.B) {
+	b.Run("TypedBoxedMap", func(b *testing.B) {
+		m := &TypedBoxedMap[int, int]{}
+		for i := range 1000 {
+			m.Store(i, i)
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				i++
+				m.Load(i % 1000)
+			}
+		})
+	})
+	b.Run("BoxedMap", func(b *testing.B) {
+		m := &BoxedMap{}
+		for i := range 1000 {
+			m.Store(i, i)
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				i++
+				m.Load(i % 1000)
+			}
+		})
+	})
+}
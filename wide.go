@@ -0,0 +1,132 @@
+package crow
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// A Roundabout with 64 bit lanes
+//
+// A cell only has room for a 32 bit lane, so each slot in the log gets a
+// second word for the wide lane, and the cell keeps a hash of it. Most of
+// the time, the hashes are enough to tell two lanes apart, and we only
+// look at the wide lane when they match.
+//
+// The wide lane is written after the cell is claimed, but before it's in
+// the header, and it's only written again after the cell has been popped
+// and claimed again, so a reader loads the cell, then the wide lane, then
+// checks the cell is unchanged. If it has changed, the wide lane might
+// belong to the next cell in the slot, so we look again.
+//
+// Every lane operation on a WideRoundabout has to go through it, so it
+// doesn't expose the 32 bit lane operations.
+
+type WideRoundabout struct {
+	rb       Roundabout
+	lanes    [width]atomic.Uint64
+	Conflict func(uint64, uint64) bool // defaults to equality
+}
+
+func wideHash(lane uint64) uint32 {
+	return foldLane(lane)
+}
+
+func (w *WideRoundabout) Epoch() uint16 {
+	return w.rb.Epoch()
+}
+
+func (w *WideRoundabout) Flags() uint16 {
+	return w.rb.Flags()
+}
+
+func (w *WideRoundabout) String() string {
+	return w.rb.String()
+}
+
+func (w *WideRoundabout) Close() {
+	w.rb.Close()
+}
+
+func (w *WideRoundabout) IsClosed() bool {
+	return w.rb.IsClosed()
+}
+
+// called from wait() for a cell in slot n, when we need to compare lanes
+
+func (w *WideRoundabout) conflicts(r rb_cell, n int, item Cell) bool {
+	if w.Conflict == nil && r.lane != item.lane {
+		// different hashes, different lanes
+		return false
+	}
+
+	lane := w.lanes[n].Load()
+	if w.rb.log[n].Load() != item.pack() {
+		// the cell has moved on, so we can't trust the lane, and
+		// we say it conflicts so that wait() looks at the cell again
+		return true
+	}
+
+	if w.Conflict == nil {
+		return r.wlane == lane
+	}
+	return callConflict(w.Conflict, r.wlane, lane, r, item)
+}
+
+func (w *WideRoundabout) once(lane uint64, kind uint16, fn func(uint16, uint16) error) error {
+	rb_cell, err := w.rb.enter(rb_cell{lane: wideHash(lane), kind: kind, wide: w, wlane: lane}, nil, false)
+	if err != nil {
+		return err
+	}
+	defer w.rb.pop(rb_cell)
+	if err = w.rb.wait(rb_cell); err != nil {
+		return err
+	}
+
+	if checkNesting {
+		w.rb.guard(kindNames[kind], func() {
+			err = fn(rb_cell.epoch, rb_cell.flags)
+		})
+		return err
+	}
+	return fn(rb_cell.epoch, rb_cell.flags)
+}
+
+func (w *WideRoundabout) run(lane uint64, kind uint16, fn func(uint16, uint16) error) error {
+	for true {
+		err := w.once(lane, kind, fn)
+		if !errors.Is(err, ErrRetry) {
+			return err
+		}
+	}
+	// huh
+	panic(unreachable("run"))
+}
+
+// the ring operations don't have a lane, so they're the same as a Roundabout
+
+func (w *WideRoundabout) LockRing(fn func(uint16, uint16) error) error {
+	return w.rb.LockRing(fn)
+}
+
+func (w *WideRoundabout) OrderRing(fn func(uint16, uint16) error) error {
+	return w.rb.OrderRing(fn)
+}
+
+func (w *WideRoundabout) ShareRing(fn func(uint16, uint16) error) error {
+	return w.rb.ShareRing(fn)
+}
+
+// like Roundabout.LockLane, with a 64 bit lane
+func (w *WideRoundabout) LockLane(lane uint64, fn func(uint16, uint16) error) error {
+	return w.run(lane, LockLane, fn)
+}
+
+// like Roundabout.OrderLane, with a 64 bit lane
+func (w *WideRoundabout) OrderLane(lane uint64, fn func(uint16, uint16) error) error {
+	return w.run(lane, OrderLane, fn)
+}
+
+// like Roundabout.ShareLane, with a 64 bit lane
+func (w *WideRoundabout) ShareLane(lane uint64, fn func(uint16, uint16) error) error {
+	return w.run(lane, ShareLane, fn)
+}
@@ -0,0 +1,130 @@
+package crow
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWideRoundabout(t *testing.T) {
+	w := &WideRoundabout{}
+
+	// both of these hash to 4, but they're different lanes
+	a := uint64(1)<<32 | 5
+	b := uint64(4)
+	if wideHash(a) != wideHash(b) {
+		t.Fatal("lanes should share a hash")
+	}
+
+	held := make(chan bool)
+	release := make(chan bool)
+	go w.LockLane(a, func(uint16, uint16) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+
+	done := make(chan bool)
+	go func() {
+		w.LockLane(b, func(uint16, uint16) error { return nil })
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lanes with the same hash conflicted", w.String())
+	}
+
+	go func() {
+		w.LockLane(a, func(uint16, uint16) error { return nil })
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatal("same lane didn't conflict")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	<-done
+}
+
+func TestWideRoundaboutTorn(t *testing.T) {
+	// every lane has the same hash, so every check reads the wide lane,
+	// and if we ever read a lane from the wrong cell, two goroutines will
+	// end up in the same lane at once
+
+	lanes := make([]uint64, 4)
+	for i := range lanes {
+		lanes[i] = uint64(i)<<32 | uint64(i)
+	}
+
+	w := &WideRoundabout{}
+	var inside [4]atomic.Int32
+	var wg sync.WaitGroup
+
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				k := (g + i) % len(lanes)
+				w.LockLane(lanes[k], func(uint16, uint16) error {
+					if inside[k].Add(1) != 1 {
+						t.Error("two goroutines in lane", k)
+					}
+					inside[k].Add(-1)
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if w.rb.header.Load()&0xFFFFFFFF != 0 {
+		t.Error("roundabout not empty", w.String())
+	}
+}
+
+func TestWideConflictPanic(t *testing.T) {
+	w := &WideRoundabout{}
+	w.Conflict = func(a, b uint64) bool {
+		if a == 1<<40 {
+			panic("bad lane")
+		}
+		return a == b
+	}
+
+	held := make(chan bool)
+	release := make(chan bool)
+	go w.LockLane(2, func(uint16, uint16) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+
+	func() {
+		defer func() {
+			p, _ := recover().(ConflictPanic)
+			if p.Lane != 1<<40 || p.Other != 2 || p.Value != "bad lane" {
+				t.Error("wrong panic", p)
+			}
+		}()
+		w.LockLane(1<<40, func(uint16, uint16) error {
+			t.Error("callback ran")
+			return nil
+		})
+	}()
+	close(release)
+
+	// the panicking cell was popped, so the ring still works
+	if err := w.rb.LockRing(func(uint16, uint16) error { return nil }); err != nil {
+		t.Error(err)
+	}
+	if !w.rb.idle() {
+		t.Error("cell leaked after panic", w.rb.String())
+	}
+}
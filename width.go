@@ -0,0 +1,10 @@
+//go:build !crowwidth4 && !crowwidth8
+
+package crow
+
+// the number of slots in the log, and so the number of bits of the header's
+// bitmap in use. building with -tags crowwidth8 or crowwidth4 shrinks the
+// ring, so that the tests wrap around it, and fill it, far more often, see
+// width_8.go
+
+const width = 32
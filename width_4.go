@@ -0,0 +1,7 @@
+//go:build crowwidth4 && !crowwidth8
+
+package crow
+
+// the smallest ring we test with, see width_8.go
+
+const width = 4
@@ -0,0 +1,9 @@
+//go:build crowwidth8
+
+package crow
+
+// a smaller ring, for shaking out mistakes in the epoch and bitmap math
+// that only show up at the edge of the ring. the header keeps its 32 bit
+// bitmap, and only the low width bits are ever set
+
+const width = 8